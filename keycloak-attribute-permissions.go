@@ -0,0 +1,67 @@
+package keycloak
+
+import "slices"
+
+// Common attribute permissions
+var (
+	// Users can see and change their own value
+	PermissionsUserEditable = Permissions{
+		View: []string{AttributePermissionAdmin, AttributePermissionUser},
+		Edit: []string{AttributePermissionAdmin, AttributePermissionUser},
+	}
+	// Users can see their own value, only admins can change it
+	PermissionsAdminEditable = Permissions{
+		View: []string{AttributePermissionAdmin, AttributePermissionUser},
+		Edit: []string{AttributePermissionAdmin},
+	}
+	// Users can not see the value
+	PermissionsAdminOnly = Permissions{
+		View: []string{AttributePermissionAdmin},
+		Edit: []string{AttributePermissionAdmin},
+	}
+)
+
+// PermissionPolicy decides who can view and edit each attribute when a schema is pushed
+// to the realm, overriding the permissions the attributes were declared with
+type PermissionPolicy struct {
+	// Permissions of attributes not listed in Attributes. Nil keeps their own permissions.
+	// Point it at a copy of the common permissions, not at the package variables
+	Default *Permissions `json:"default,omitempty"`
+	// Permissions by attribute name
+	Attributes map[string]Permissions `json:"attributes,omitempty"`
+}
+
+// DefaultPermissionPolicy keeps the permissions the attributes are declared with, where
+// users can see every built-in attribute but only change MobilePhone and OfficePhone
+func DefaultPermissionPolicy() *PermissionPolicy {
+	return &PermissionPolicy{}
+}
+
+// For returns a copy of the permissions the policy gives an attribute
+func (p *PermissionPolicy) For(attr *Attribute) Permissions {
+	if perms, ok := p.Attributes[attr.Name]; ok {
+		return perms.clone()
+	}
+	if p.Default != nil {
+		return p.Default.clone()
+	}
+	return attr.Permissions.clone()
+}
+
+func (perms Permissions) clone() Permissions {
+	return Permissions{
+		View: slices.Clone(perms.View),
+		Edit: slices.Clone(perms.Edit),
+	}
+}
+
+// Apply returns copies of the attributes with the policy's permissions
+func (p *PermissionPolicy) Apply(attrs []*Attribute) []*Attribute {
+	rtn := make([]*Attribute, len(attrs))
+	for i, attr := range attrs {
+		cp := *attr
+		cp.Permissions = p.For(attr)
+		rtn[i] = &cp
+	}
+	return rtn
+}
@@ -0,0 +1,59 @@
+package keycloak
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPermissionPolicy(t *testing.T) {
+	attrs := DefaultAttributeSchema().ProfileAttributes()
+	byName := make(map[string]*Attribute)
+	for _, attr := range attrs {
+		byName[attr.Name] = attr
+	}
+	assert.Equal(t, []string{"admin"}, byName["Citizenship"].Permissions.Edit)
+	assert.Equal(t, []string{"admin", "user"}, byName["Citizenship"].Permissions.View)
+	assert.Equal(t, []string{"admin"}, byName["ContractNumber"].Permissions.Edit)
+	assert.Equal(t, []string{"admin", "user"}, byName["MobilePhone"].Permissions.Edit)
+	assert.Equal(t, PermissionsAdminEditable, byName["Organization"].Permissions)
+
+	// Only the phone numbers are self-service
+	for _, attr := range AdditionalAttributes {
+		edit := []string{"admin"}
+		if attr.Name == "MobilePhone" || attr.Name == "OfficePhone" {
+			edit = []string{"admin", "user"}
+		}
+		assert.Equal(t, edit, byName[attr.Name].Permissions.Edit, attr.Name)
+		assert.Equal(t, []string{"admin", "user"}, byName[attr.Name].Permissions.View, attr.Name)
+	}
+
+	// The pushed permissions are those declared on the attributes, as copies
+	assert.Equal(t, PermissionsAdminEditable, AttrCitizenship.Permissions)
+	byName["MobilePhone"].Permissions.Edit[0] = "changed"
+	assert.Equal(t, AttributePermissionAdmin, AttrMobilePhone.Permissions.Edit[0])
+
+	// A policy default is copied too
+	def := PermissionsAdminEditable
+	policy := &PermissionPolicy{Default: &def}
+	policy.For(AttrCompany).Edit[0] = "changed"
+	assert.Equal(t, []string{AttributePermissionAdmin}, PermissionsAdminEditable.Edit)
+	assert.Equal(t, PermissionsAdminEditable, policy.For(AttrCompany))
+
+	schema, err := ParseAttributeSchema([]byte(`
+attributes:
+  - name: Badge
+    permissions: {view: [admin, user], edit: [admin, user]}
+  - name: Secret
+permissions:
+  attributes:
+    Secret: {view: [admin], edit: [admin]}
+`))
+	assert.NoError(t, err)
+	attrs = schema.ProfileAttributes()
+	assert.Equal(t, PermissionsUserEditable, attrs[0].Permissions)
+	assert.Equal(t, PermissionsAdminOnly, attrs[1].Permissions)
+
+	_, err = ParseAttributeSchema([]byte(`{"attributes": [], "permissions": {"default": {"view": ["everyone"]}}}`))
+	assert.ErrorContains(t, err, "everyone")
+}
@@ -0,0 +1,291 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy/models"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// Attributes outside the schema are dropped when converting users, the original behaviour
+	UnknownAttributesDrop = "drop"
+	// Attributes outside the schema are passed through as is. Keycloak 24 only stores them
+	// when the realm's unmanaged attribute policy allows it
+	UnknownAttributesPreserve = "preserve"
+	// Writing a user with attributes outside the schema fails with ErrUnknownAttribute.
+	// They are dropped when reading
+	UnknownAttributesReject = "reject"
+)
+
+var ErrUnknownAttribute = errors.New("unknown user attribute")
+
+// AttributeSchema is the set of custom user attributes a manager provisions in the realm's
+// user profile and maps between Keycloak and cloudy users.
+//
+// A schema can be built in code, loaded from a JSON or YAML file with LoadAttributeSchema,
+// or read back from the realm with ReadAttributeSchema. The file format is
+//
+//	unknownAttributes: preserve
+//	attributes:
+//	  - name: Organization
+//	    displayName: Organization
+//	    validations:
+//	      length: {min: 1, max: 255}
+//	    permissions:
+//	      view: [admin, user]
+//	      edit: [admin]
+//	permissions:
+//	  default: {view: [admin, user], edit: [admin]}
+//	  attributes:
+//	    MobilePhone: {view: [admin, user], edit: [admin, user]}
+type AttributeSchema struct {
+	Attributes []*Attribute `json:"attributes"`
+	// UnknownAttributesDrop (the default), UnknownAttributesPreserve or UnknownAttributesReject
+	UnknownAttributes string `json:"unknownAttributes,omitempty"`
+	// Permissions override those of the attributes when the schema is pushed
+	Permissions *PermissionPolicy `json:"permissions,omitempty"`
+}
+
+// NewAttributeSchema creates a schema of the given attributes that drops unknown ones
+func NewAttributeSchema(attrs ...*Attribute) *AttributeSchema {
+	return &AttributeSchema{
+		Attributes:        attrs,
+		UnknownAttributes: UnknownAttributesDrop,
+	}
+}
+
+// DefaultAttributeSchema is the schema of AdditionalAttributes used when none is set,
+// with the DefaultPermissionPolicy
+func DefaultAttributeSchema() *AttributeSchema {
+	schema := NewAttributeSchema(AdditionalAttributes...)
+	schema.Permissions = DefaultPermissionPolicy()
+	return schema
+}
+
+// ParseAttributeSchema parses a schema in JSON or YAML
+func ParseAttributeSchema(data []byte) (*AttributeSchema, error) {
+	// YAML is a superset of JSON. Go through JSON so the json tags are the only mapping
+	var raw interface{}
+	err := yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attribute schema: %w", err)
+	}
+	asJson, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attribute schema: %w", err)
+	}
+
+	schema := &AttributeSchema{}
+	err = json.Unmarshal(asJson, schema)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attribute schema: %w", err)
+	}
+	return schema, schema.Validate()
+}
+
+// LoadAttributeSchema reads a schema from a .json, .yaml or .yml file
+func LoadAttributeSchema(file string) (*AttributeSchema, error) {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json", ".yaml", ".yml":
+	default:
+		return nil, fmt.Errorf("attribute schema %v must be a .json, .yaml or .yml file", file)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseAttributeSchema(data)
+}
+
+// AttributeSchemaFromProfile creates a schema from the custom attributes of a user
+// profile, leaving out the built in username, email, firstName and lastName
+func AttributeSchemaFromProfile(cfg *UserProfileConfig) *AttributeSchema {
+	schema := NewAttributeSchema()
+	for _, attr := range cfg.Attributes {
+		if isBuiltInAttribute(attr.Name) {
+			continue
+		}
+		schema.Attributes = append(schema.Attributes, attr)
+	}
+	return schema
+}
+
+func isBuiltInAttribute(name string) bool {
+	return slices.ContainsFunc(DefaultAttributes, func(a *Attribute) bool {
+		return a.Name == name
+	})
+}
+
+// Validate checks that every attribute is named once and the unknown attribute policy is known
+func (s *AttributeSchema) Validate() error {
+	switch s.UnknownAttributes {
+	case "", UnknownAttributesDrop, UnknownAttributesPreserve, UnknownAttributesReject:
+	default:
+		return fmt.Errorf("unknown attribute policy %q must be %v, %v or %v", s.UnknownAttributes,
+			UnknownAttributesDrop, UnknownAttributesPreserve, UnknownAttributesReject)
+	}
+
+	if s.Permissions != nil {
+		perms := []Permissions{}
+		if s.Permissions.Default != nil {
+			perms = append(perms, *s.Permissions.Default)
+		}
+		for _, p := range s.Permissions.Attributes {
+			perms = append(perms, p)
+		}
+		for _, p := range perms {
+			for _, role := range append(slices.Clone(p.View), p.Edit...) {
+				if role != AttributePermissionAdmin && role != AttributePermissionUser {
+					return fmt.Errorf("attribute permission %q must be %v or %v", role, AttributePermissionAdmin, AttributePermissionUser)
+				}
+			}
+		}
+	}
+
+	seen := make(map[string]bool, len(s.Attributes))
+	for _, attr := range s.Attributes {
+		if attr == nil || attr.Name == "" {
+			return errors.New("attribute schema has an attribute without a name")
+		}
+		if seen[attr.Name] {
+			return fmt.Errorf("attribute schema has %v more than once", attr.Name)
+		}
+		seen[attr.Name] = true
+	}
+	return nil
+}
+
+// Find returns the attribute with the given name, or nil
+func (s *AttributeSchema) Find(name string) *Attribute {
+	for _, attr := range s.Attributes {
+		if attr.Name == name {
+			return attr
+		}
+	}
+	return nil
+}
+
+// ProfileAttributes are the attributes as they are pushed to the user profile, with the
+// permission policy applied
+func (s *AttributeSchema) ProfileAttributes() []*Attribute {
+	if s.Permissions == nil {
+		return s.Attributes
+	}
+	return s.Permissions.Apply(s.Attributes)
+}
+
+// Names are the names of the attributes in the schema
+func (s *AttributeSchema) Names() []string {
+	rtn := make([]string, len(s.Attributes))
+	for i, attr := range s.Attributes {
+		rtn[i] = attr.Name
+	}
+	return rtn
+}
+
+// ToCloudy converts a Keycloak user, keeping the attributes the schema allows. Attributes
+// with several values are encoded, see GetAttributeValues
+func (s *AttributeSchema) ToCloudy(user *gocloak.User) *models.User {
+	u := &models.User{
+		UID:         str(user.ID, ""),
+		Username:    str(user.Username, ""),
+		FirstName:   str(user.FirstName, ""),
+		LastName:    str(user.LastName, ""),
+		Email:       str(user.Email, ""),
+		Enabled:     user.Enabled != nil && *user.Enabled,
+		DisplayName: first(user.Attributes, "DisplayName"),
+	}
+
+	u.Attributes = make(map[string]string)
+	if user.Attributes == nil {
+		return u
+	}
+	for name, values := range *user.Attributes {
+		attr := s.Find(name)
+		if s.UnknownAttributes != UnknownAttributesPreserve && attr == nil {
+			continue
+		}
+		if val := attributeToCloudy(attr, values); val != "" {
+			u.Attributes[name] = val
+		}
+	}
+
+	return u
+}
+
+// ToKeycloak converts a cloudy user. Under UnknownAttributesReject any attribute outside
+// the schema fails with ErrUnknownAttribute
+func (s *AttributeSchema) ToKeycloak(u *models.User) (*gocloak.User, error) {
+	attrs := make(map[string][]string)
+
+	var unknown []string
+	for name, val := range u.Attributes {
+		attr := s.Find(name)
+		if attr == nil {
+			switch s.UnknownAttributes {
+			case UnknownAttributesPreserve:
+			case UnknownAttributesReject:
+				unknown = append(unknown, name)
+				continue
+			default:
+				continue
+			}
+		}
+		attrs[name] = attributeToKeycloak(attr, val)
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("%w: %v", ErrUnknownAttribute, strings.Join(unknown, ", "))
+	}
+
+	user := &gocloak.User{
+		ID:         &u.UID,
+		Username:   &u.Username,
+		Enabled:    &u.Enabled,
+		FirstName:  &u.FirstName,
+		LastName:   &u.LastName,
+		Email:      &u.Email,
+		Attributes: &attrs,
+	}
+
+	return user, nil
+}
+
+// SetAttributeSchema replaces the attributes this manager provisions and maps. Set it
+// before the manager is first used, a nil schema restores DefaultAttributeSchema
+func (um *KeycloakUserManager) SetAttributeSchema(schema *AttributeSchema) {
+	if schema == nil {
+		schema = DefaultAttributeSchema()
+	}
+	um.schema.Store(schema)
+}
+
+func (um *KeycloakUserManager) AttributeSchema() *AttributeSchema {
+	return um.schema.Load()
+}
+
+// ReadAttributeSchema reads the custom attributes currently declared in the realm's user
+// profile. Pass the result to SetAttributeSchema to map exactly what the realm defines
+func (um *KeycloakUserManager) ReadAttributeSchema(ctx context.Context) (*AttributeSchema, error) {
+	err := um.session.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := um.getUserProfile(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return AttributeSchemaFromProfile(cfg), nil
+}
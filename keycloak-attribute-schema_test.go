@@ -0,0 +1,87 @@
+package keycloak
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadAttributeSchema(t *testing.T) {
+	dir := t.TempDir()
+
+	yamlFile := filepath.Join(dir, "schema.yaml")
+	err := os.WriteFile(yamlFile, []byte(`
+unknownAttributes: reject
+attributes:
+  - name: Badge
+    displayName: Badge Number
+    validations:
+      length: {min: 1, max: 10}
+    permissions:
+      view: [admin, user]
+      edit: [admin]
+`), 0600)
+	assert.NoError(t, err)
+
+	schema, err := LoadAttributeSchema(yamlFile)
+	assert.NoError(t, err)
+	assert.Equal(t, UnknownAttributesReject, schema.UnknownAttributes)
+	assert.Equal(t, []string{"Badge"}, schema.Names())
+	badge := schema.Find("Badge")
+	assert.Equal(t, "Badge Number", badge.DisplayName)
+	assert.Equal(t, 10, badge.Validations.Length.Max)
+	assert.Equal(t, []string{"admin"}, badge.Permissions.Edit)
+
+	jsonFile := filepath.Join(dir, "schema.json")
+	err = os.WriteFile(jsonFile, []byte(`{"attributes": [{"name": "Badge"}, {"name": "Badge"}]}`), 0600)
+	assert.NoError(t, err)
+	_, err = LoadAttributeSchema(jsonFile)
+	assert.ErrorContains(t, err, "more than once")
+
+	_, err = LoadAttributeSchema(filepath.Join(dir, "schema.txt"))
+	assert.Error(t, err)
+}
+
+func TestAttributeSchemaConvert(t *testing.T) {
+	kcUser := &gocloak.User{
+		ID:       gocloak.StringP("id"),
+		Username: gocloak.StringP("bob"),
+		Attributes: &map[string][]string{
+			"Badge":        {"42"},
+			"Organization": {"ACME"},
+		},
+	}
+
+	schema := NewAttributeSchema(&Attribute{Name: "Badge"})
+	u := schema.ToCloudy(kcUser)
+	assert.Equal(t, map[string]string{"Badge": "42"}, u.Attributes)
+	assert.False(t, u.Enabled)
+
+	schema.UnknownAttributes = UnknownAttributesPreserve
+	u = schema.ToCloudy(kcUser)
+	assert.Equal(t, map[string]string{"Badge": "42", "Organization": "ACME"}, u.Attributes)
+
+	kcUser2, err := schema.ToKeycloak(u)
+	assert.NoError(t, err)
+	assert.Equal(t, *kcUser.Attributes, *kcUser2.Attributes)
+
+	schema.UnknownAttributes = UnknownAttributesDrop
+	kcUser2, err = schema.ToKeycloak(u)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"Badge": {"42"}}, *kcUser2.Attributes)
+
+	schema.UnknownAttributes = UnknownAttributesReject
+	_, err = schema.ToKeycloak(&models.User{Attributes: map[string]string{"Organization": "ACME", "Badge": "1"}})
+	assert.True(t, errors.Is(err, ErrUnknownAttribute))
+	assert.ErrorContains(t, err, "Organization")
+
+	profile := AttributeSchemaFromProfile(&UserProfileConfig{
+		Attributes: append(append([]*Attribute{}, DefaultAttributes...), AttrProject),
+	})
+	assert.Equal(t, []string{"Project"}, profile.Names())
+}
@@ -0,0 +1,87 @@
+package keycloak
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/appliedres/cloudy/models"
+)
+
+// models.User.Attributes holds one string per attribute. Attributes with several values,
+// and every attribute marked Multivalued in the schema, are stored there as a JSON array
+// such as ["a","b"] so that no value is lost between reading and updating a user.
+// Use GetAttributeValues and SetAttributeValues rather than reading the string directly.
+
+// EncodeAttributeValues encodes values the way multivalued attributes are stored in models.User
+func EncodeAttributeValues(values []string) string {
+	if values == nil {
+		values = []string{}
+	}
+	data, _ := json.Marshal(values)
+	return string(data)
+}
+
+// DecodeAttributeValues is the reverse of EncodeAttributeValues. A value that is not an
+// encoded list is returned as the only value
+func DecodeAttributeValues(val string) []string {
+	if values, ok := decodeAttributeList(val); ok {
+		return values
+	}
+	if val == "" {
+		return nil
+	}
+	return []string{val}
+}
+
+func decodeAttributeList(val string) ([]string, bool) {
+	if !strings.HasPrefix(val, "[") {
+		return nil, false
+	}
+	var values []string
+	if json.Unmarshal([]byte(val), &values) != nil {
+		return nil, false
+	}
+	return values, true
+}
+
+// GetAttributeValues returns every value of a user attribute
+func GetAttributeValues(u *models.User, name string) []string {
+	return DecodeAttributeValues(u.Attributes[name])
+}
+
+// SetAttributeValues sets every value of a user attribute, no values removes it
+func SetAttributeValues(u *models.User, name string, values ...string) {
+	if len(values) == 0 {
+		delete(u.Attributes, name)
+		return
+	}
+	if u.Attributes == nil {
+		u.Attributes = make(map[string]string)
+	}
+	u.Attributes[name] = EncodeAttributeValues(values)
+}
+
+// attributeToCloudy encodes the Keycloak values of an attribute, "" when there are none
+func attributeToCloudy(attr *Attribute, values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	if len(values) > 1 || (attr != nil && attr.Multivalued) {
+		return EncodeAttributeValues(values)
+	}
+	return values[0]
+}
+
+// attributeToKeycloak decodes an attribute value. A single valued attribute is only
+// split when it holds a JSON list of several values, the only case attributeToCloudy
+// encodes it, so a value that merely looks like a list is kept as it is
+func attributeToKeycloak(attr *Attribute, val string) []string {
+	multivalued := attr != nil && attr.Multivalued
+	if values, ok := decodeAttributeList(val); ok && (multivalued || len(values) > 1) {
+		return values
+	}
+	if val == "" && multivalued {
+		return []string{}
+	}
+	return []string{val}
+}
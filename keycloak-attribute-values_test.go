@@ -0,0 +1,51 @@
+package keycloak
+
+import (
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultivaluedAttributes(t *testing.T) {
+	schema := NewAttributeSchema(
+		&Attribute{Name: "Project", Multivalued: true},
+		&Attribute{Name: "Organization"},
+	)
+
+	kcUser := &gocloak.User{
+		ID:       gocloak.StringP("id"),
+		Username: gocloak.StringP("bob"),
+		Attributes: &map[string][]string{
+			"Project":      {"X"},
+			"Organization": {"ACME", "Umbrella"},
+		},
+	}
+
+	u := schema.ToCloudy(kcUser)
+	assert.Equal(t, `["X"]`, u.Attributes["Project"])
+	assert.Equal(t, []string{"X"}, GetAttributeValues(u, "Project"))
+	assert.Equal(t, []string{"ACME", "Umbrella"}, GetAttributeValues(u, "Organization"))
+
+	// Nothing is lost on the way back
+	back, err := schema.ToKeycloak(u)
+	assert.NoError(t, err)
+	assert.Equal(t, *kcUser.Attributes, *back.Attributes)
+
+	SetAttributeValues(u, "Project", "X", "Y, with a comma")
+	back, err = schema.ToKeycloak(u)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"X", "Y, with a comma"}, (*back.Attributes)["Project"])
+
+	// Single values that only look like lists are kept
+	plain := &models.User{Attributes: map[string]string{"Organization": `["ACME"]`, "Project": "Z"}}
+	back, err = schema.ToKeycloak(plain)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`["ACME"]`}, (*back.Attributes)["Organization"])
+	assert.Equal(t, []string{"Z"}, (*back.Attributes)["Project"])
+
+	SetAttributeValues(u, "Project")
+	assert.NotContains(t, u.Attributes, "Project")
+	assert.Nil(t, GetAttributeValues(u, "Project"))
+}
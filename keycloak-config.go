@@ -0,0 +1,267 @@
+package keycloak
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/appliedres/cloudy"
+)
+
+const (
+	// Admin user name and password through the admin-cli client
+	AuthModeAdmin = "admin"
+	// Service account of a confidential client with a client secret
+	AuthModeClientSecret = "client-secret"
+	// Service account of a confidential client with a signed JWT client assertion
+	AuthModeClientJWT = "client-jwt"
+)
+
+// KeycloakConfig is everything needed to connect to Keycloak. It is what the user and
+// group provider factories create from the environment.
+type KeycloakConfig struct {
+	Address string
+	// Default realm to manage
+	Realm string
+	// Realm to log in to, see KeycloakConfigFromEnv for its default
+	AuthRealm string
+	// When set the providers route each call to one of these realms, see WithRealm
+	Realms []string
+
+	AuthMode      string
+	User          string
+	Password      string
+	ClientID      string
+	ClientSecret  string
+	ClientKeyFile string
+	ClientKeyAlg  string
+
+	// PEM file with additional CA certificates to trust
+	CACertFile         string
+	InsecureSkipVerify bool
+	// Timeout for each request, 0 means no timeout
+	Timeout time.Duration
+
+	// JSON or YAML file with the custom user attributes, see AttributeSchema.
+	// Defaults to AdditionalAttributes
+	AttributeSchemaFile string
+	// JSON or YAML file with the group attributes, in the same format. By default every
+	// group attribute is mapped
+	GroupAttributeSchemaFile string
+	// Reconcile the user profile with the attribute schema on the first call of each user
+	// manager, see KeycloakUserManager.SetReconcileOnConnect
+	ReconcileProfile bool
+}
+
+// KeycloakConfigFromEnv reads and validates the configuration
+//
+//	KEYCLOAK_HOST                 Keycloak base url (required)
+//	KEYCLOAK_REALM                realm to manage, defaults to the first of KEYCLOAK_REALMS
+//	                              or master
+//	KEYCLOAK_REALMS               comma separated realms to route between
+//	KEYCLOAK_AUTH_REALM           realm to log in to, defaults to KEYCLOAK_REALM when that is
+//	                              set, as logins did before this variable, or else master
+//	KEYCLOAK_AUTH_MODE            admin, client-secret or client-jwt. Defaults to admin
+//	                              unless KEYCLOAK_CLIENT_ID is set
+//	KEYCLOAK_USER, KEYCLOAK_PWD   admin credentials
+//	KEYCLOAK_CLIENT_ID            confidential client
+//	KEYCLOAK_CLIENT_SECRET        client secret
+//	KEYCLOAK_CLIENT_KEY_FILE      PEM private key for signed JWTs
+//	KEYCLOAK_CLIENT_KEY_ALG       signing algorithm, defaults to RS256
+//	KEYCLOAK_CA_CERT              PEM file of CA certificates to trust
+//	KEYCLOAK_TLS_INSECURE         skip TLS verification (true/false)
+//	KEYCLOAK_TIMEOUT              request timeout, e.g. 30s
+//	KEYCLOAK_ATTRIBUTE_SCHEMA     JSON or YAML file of custom user attributes
+//	KEYCLOAK_GROUP_ATTRIBUTE_SCHEMA  JSON or YAML file of group attributes
+//	KEYCLOAK_RECONCILE_PROFILE    reconcile the user profile on the first call (true/false)
+func KeycloakConfigFromEnv(env *cloudy.Environment) (*KeycloakConfig, error) {
+	cfg := &KeycloakConfig{
+		Address:       env.Get("KEYCLOAK_HOST"),
+		Realm:         env.Get("KEYCLOAK_REALM"),
+		AuthRealm:     env.Get("KEYCLOAK_AUTH_REALM"),
+		AuthMode:      env.Get("KEYCLOAK_AUTH_MODE"),
+		User:          env.Get("KEYCLOAK_USER"),
+		Password:      env.Get("KEYCLOAK_PWD"),
+		ClientID:      env.Get("KEYCLOAK_CLIENT_ID"),
+		ClientSecret:  env.Get("KEYCLOAK_CLIENT_SECRET"),
+		ClientKeyFile: env.Get("KEYCLOAK_CLIENT_KEY_FILE"),
+		ClientKeyAlg:  env.Default("KEYCLOAK_CLIENT_KEY_ALG", "RS256"),
+		CACertFile:    env.Get("KEYCLOAK_CA_CERT"),
+
+		AttributeSchemaFile:      env.Get("KEYCLOAK_ATTRIBUTE_SCHEMA"),
+		GroupAttributeSchemaFile: env.Get("KEYCLOAK_GROUP_ATTRIBUTE_SCHEMA"),
+	}
+
+	if realms := env.Get("KEYCLOAK_REALMS"); realms != "" {
+		for _, realm := range strings.Split(realms, ",") {
+			if realm = strings.TrimSpace(realm); realm != "" {
+				cfg.Realms = append(cfg.Realms, realm)
+			}
+		}
+	}
+	if cfg.AuthRealm == "" {
+		cfg.AuthRealm = cfg.Realm
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = "master"
+		if len(cfg.Realms) > 0 {
+			cfg.Realm = cfg.Realms[0]
+		}
+	}
+	if cfg.AuthRealm == "" {
+		cfg.AuthRealm = "master"
+	}
+
+	if cfg.AuthMode == "" {
+		cfg.AuthMode = AuthModeAdmin
+		if cfg.ClientID != "" {
+			cfg.AuthMode = AuthModeClientSecret
+			if cfg.ClientKeyFile != "" {
+				cfg.AuthMode = AuthModeClientJWT
+			}
+		}
+	}
+
+	merr := cloudy.MultiError()
+	if v := env.Get("KEYCLOAK_TLS_INSECURE"); v != "" {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			merr.Append(fmt.Errorf("KEYCLOAK_TLS_INSECURE must be true or false, got %q", v))
+		}
+		cfg.InsecureSkipVerify = insecure
+	}
+	if v := env.Get("KEYCLOAK_RECONCILE_PROFILE"); v != "" {
+		reconcile, err := strconv.ParseBool(v)
+		if err != nil {
+			merr.Append(fmt.Errorf("KEYCLOAK_RECONCILE_PROFILE must be true or false, got %q", v))
+		}
+		cfg.ReconcileProfile = reconcile
+	}
+	if v := env.Get("KEYCLOAK_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			merr.Append(fmt.Errorf("KEYCLOAK_TIMEOUT must be a duration such as 30s, got %q", v))
+		}
+		cfg.Timeout = timeout
+	}
+	if merr.HasError() {
+		return nil, merr
+	}
+
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks the configuration, reporting every problem found
+func (cfg *KeycloakConfig) Validate() error {
+	merr := cloudy.MultiError()
+
+	if cfg.Address == "" {
+		merr.Append(errors.New("keycloak address (KEYCLOAK_HOST) is required"))
+	} else if u, err := url.Parse(cfg.Address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		merr.Append(fmt.Errorf("keycloak address (KEYCLOAK_HOST) must be an http or https url, got %q", cfg.Address))
+	}
+
+	switch cfg.AuthMode {
+	case AuthModeAdmin, "":
+		if cfg.User == "" || cfg.Password == "" {
+			merr.Append(errors.New("admin authentication requires a user (KEYCLOAK_USER) and password (KEYCLOAK_PWD)"))
+		}
+	case AuthModeClientSecret:
+		if cfg.ClientID == "" || cfg.ClientSecret == "" {
+			merr.Append(errors.New("client-secret authentication requires a client id (KEYCLOAK_CLIENT_ID) and secret (KEYCLOAK_CLIENT_SECRET)"))
+		}
+	case AuthModeClientJWT:
+		if cfg.ClientID == "" || cfg.ClientKeyFile == "" {
+			merr.Append(errors.New("client-jwt authentication requires a client id (KEYCLOAK_CLIENT_ID) and key file (KEYCLOAK_CLIENT_KEY_FILE)"))
+		}
+	default:
+		merr.Append(fmt.Errorf("unknown keycloak auth mode %q, must be %v, %v or %v", cfg.AuthMode, AuthModeAdmin, AuthModeClientSecret, AuthModeClientJWT))
+	}
+
+	if cfg.Timeout < 0 {
+		merr.Append(fmt.Errorf("keycloak timeout must not be negative, got %v", cfg.Timeout))
+	}
+
+	if len(cfg.Realms) > 0 && cfg.Realm != "" && !slices.Contains(cfg.Realms, cfg.Realm) {
+		merr.Append(fmt.Errorf("keycloak realm %q is not one of the configured realms %v", cfg.Realm, cfg.Realms))
+	}
+
+	return merr.AsErr()
+}
+
+// Credentials creates the credentials for the configured auth mode
+func (cfg *KeycloakConfig) Credentials() (Credentials, error) {
+	switch cfg.AuthMode {
+	case AuthModeAdmin, "":
+		return &AdminCredentials{User: cfg.User, Password: cfg.Password}, nil
+	case AuthModeClientSecret:
+		return &ClientCredentials{ClientID: cfg.ClientID, ClientSecret: cfg.ClientSecret}, nil
+	case AuthModeClientJWT:
+		return NewSignedJWTCredentialsFromFile(cfg.ClientID, cfg.ClientKeyFile, cfg.ClientKeyAlg)
+	}
+	return nil, fmt.Errorf("unknown keycloak auth mode %q", cfg.AuthMode)
+}
+
+// AttributeSchema loads the configured attribute schema, or returns DefaultAttributeSchema
+func (cfg *KeycloakConfig) AttributeSchema() (*AttributeSchema, error) {
+	if cfg.AttributeSchemaFile == "" {
+		return DefaultAttributeSchema(), nil
+	}
+	schema, err := LoadAttributeSchema(cfg.AttributeSchemaFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the attribute schema (KEYCLOAK_ATTRIBUTE_SCHEMA): %w", err)
+	}
+	return schema, nil
+}
+
+// GroupAttributeSchema loads the configured group attribute schema, or returns DefaultGroupAttributeSchema
+func (cfg *KeycloakConfig) GroupAttributeSchema() (*AttributeSchema, error) {
+	if cfg.GroupAttributeSchemaFile == "" {
+		return DefaultGroupAttributeSchema(), nil
+	}
+	schema, err := LoadAttributeSchema(cfg.GroupAttributeSchemaFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the group attribute schema (KEYCLOAK_GROUP_ATTRIBUTE_SCHEMA): %w", err)
+	}
+	return schema, nil
+}
+
+// NewKeycloakSessionFromConfig validates the configuration and creates a session from it
+func NewKeycloakSessionFromConfig(cfg *KeycloakConfig) (*KeycloakSession, error) {
+	err := cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := cfg.Credentials()
+	if err != nil {
+		return nil, err
+	}
+
+	session := NewKeycloakSessionWithCredentials(cfg.Address, creds, cfg.AuthRealm, cfg.Realm)
+	resty := session.Client().RestyClient()
+	if cfg.Timeout > 0 {
+		resty.SetTimeout(cfg.Timeout)
+	}
+	if cfg.InsecureSkipVerify {
+		resty.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
+	}
+	if cfg.CACertFile != "" {
+		pem, err := os.ReadFile(cfg.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read keycloak CA certificates (KEYCLOAK_CA_CERT): %w", err)
+		}
+		resty.SetRootCertificateFromString(string(pem))
+	}
+	return session, nil
+}
@@ -0,0 +1,144 @@
+package keycloak
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/appliedres/cloudy"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeycloakConfigFromEnv(t *testing.T) {
+	svc := cloudy.NewMapEnvironment()
+	env := cloudy.NewEnvironment(svc)
+
+	// Everything missing is reported at once
+	_, err := KeycloakConfigFromEnv(env)
+	assert.ErrorContains(t, err, "KEYCLOAK_HOST")
+	assert.ErrorContains(t, err, "KEYCLOAK_USER")
+
+	svc.Set("KEYCLOAK_HOST", "http://localhost:8080/")
+	svc.Set("KEYCLOAK_USER", "adminuser")
+	svc.Set("KEYCLOAK_PWD", "admin")
+	cfg, err := KeycloakConfigFromEnv(env)
+	assert.NoError(t, err)
+	assert.Equal(t, AuthModeAdmin, cfg.AuthMode)
+	assert.Equal(t, "master", cfg.Realm)
+	assert.Equal(t, "master", cfg.AuthRealm)
+
+	creds, err := cfg.Credentials()
+	assert.NoError(t, err)
+	assert.Equal(t, &AdminCredentials{User: "adminuser", Password: "admin"}, creds)
+
+	svc.Set("KEYCLOAK_CLIENT_ID", "svc")
+	_, err = KeycloakConfigFromEnv(env)
+	assert.ErrorContains(t, err, "KEYCLOAK_CLIENT_SECRET")
+
+	svc.Set("KEYCLOAK_CLIENT_SECRET", "secret")
+	svc.Set("KEYCLOAK_TIMEOUT", "soon")
+	_, err = KeycloakConfigFromEnv(env)
+	assert.ErrorContains(t, err, "KEYCLOAK_TIMEOUT")
+
+	svc.Set("KEYCLOAK_TIMEOUT", "30s")
+	svc.Set("KEYCLOAK_REALMS", "acme, globex")
+	svc.Set("KEYCLOAK_REALM", "initech")
+	_, err = KeycloakConfigFromEnv(env)
+	assert.ErrorContains(t, err, "not one of the configured realms")
+
+	svc.Set("KEYCLOAK_REALM", "globex")
+	cfg, err = KeycloakConfigFromEnv(env)
+	assert.NoError(t, err)
+	assert.Equal(t, "globex", cfg.Realm)
+	// Logs in to the managed realm like before KEYCLOAK_AUTH_REALM existed
+	assert.Equal(t, "globex", cfg.AuthRealm)
+	assert.Equal(t, AuthModeClientSecret, cfg.AuthMode)
+	assert.Equal(t, []string{"acme", "globex"}, cfg.Realms)
+
+	creds, err = cfg.Credentials()
+	assert.NoError(t, err)
+	assert.Equal(t, &ClientCredentials{ClientID: "svc", ClientSecret: "secret"}, creds)
+
+	svc.Set("KEYCLOAK_AUTH_REALM", "master")
+	cfg, err = KeycloakConfigFromEnv(env)
+	assert.NoError(t, err)
+	assert.Equal(t, "master", cfg.AuthRealm)
+}
+
+func TestKeycloakConfigRealmsOnly(t *testing.T) {
+	svc := cloudy.NewMapEnvironment()
+	env := cloudy.NewEnvironment(svc)
+	svc.Set("KEYCLOAK_HOST", "http://localhost:8080/")
+	svc.Set("KEYCLOAK_USER", "adminuser")
+	svc.Set("KEYCLOAK_PWD", "admin")
+	svc.Set("KEYCLOAK_REALMS", "acme,globex")
+
+	// The first listed realm is the default
+	cfg, err := KeycloakConfigFromEnv(env)
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", cfg.Realm)
+	assert.Equal(t, []string{"acme", "globex"}, cfg.Realms)
+	assert.Equal(t, "master", cfg.AuthRealm)
+}
+
+func TestKeycloakSessionFromEnv(t *testing.T) {
+	env := cloudy.NewEnvironment(cloudy.NewMapEnvironment())
+	_, err := NewKeycloakSessionFromEnv(env)
+	assert.ErrorContains(t, err, "KEYCLOAK_HOST")
+	_, err = NewKeycloakUserManagerFromEnv(context.Background(), env)
+	assert.Error(t, err)
+	_, err = NewGroupManagerFromEnv(context.Background(), env)
+	assert.Error(t, err)
+}
+
+func TestKeycloakProviderFactories(t *testing.T) {
+	svc := cloudy.NewMapEnvironment()
+	env := cloudy.NewEnvironment(svc)
+	svc.Set("KEYCLOAK_HOST", "http://localhost:8080/")
+	svc.Set("KEYCLOAK_USER", "adminuser")
+	svc.Set("KEYCLOAK_PWD", "admin")
+
+	schemaFile := filepath.Join(t.TempDir(), "schema.yaml")
+	assert.NoError(t, os.WriteFile(schemaFile, []byte("attributes:\n  - name: Badge\n"), 0o600))
+	svc.Set("KEYCLOAK_ATTRIBUTE_SCHEMA", schemaFile)
+
+	gf := &KeycloakGroupManagerFactory{}
+	cfg, err := gf.FromEnv(env)
+	assert.NoError(t, err)
+	gm, err := gf.Create(cfg)
+	assert.NoError(t, err)
+	assert.IsType(t, &KeycloakGroupManager{}, gm)
+
+	// Group members are mapped with the configured user schema
+	assert.NotNil(t, gm.(*KeycloakGroupManager).UserAttributeSchema().Find("Badge"))
+
+	uf := &KeycloakUserManagerFactory{}
+	cfg, err = uf.FromEnv(env)
+	assert.NoError(t, err)
+	um, err := uf.Create(cfg)
+	assert.NoError(t, err)
+	assert.IsType(t, &KeycloakUserManager{}, um)
+	assert.Nil(t, um.(*KeycloakUserManager).reconcile)
+
+	// Reconciling on connect is opt in
+	svc.Set("KEYCLOAK_RECONCILE_PROFILE", "maybe")
+	_, err = uf.FromEnv(env)
+	assert.ErrorContains(t, err, "KEYCLOAK_RECONCILE_PROFILE")
+	svc.Set("KEYCLOAK_RECONCILE_PROFILE", "true")
+	cfg, err = uf.FromEnv(env)
+	assert.NoError(t, err)
+	um, err = uf.Create(cfg)
+	assert.NoError(t, err)
+	assert.NotNil(t, um.(*KeycloakUserManager).reconcile)
+
+	_, err = gf.Create(um)
+	assert.ErrorIs(t, err, cloudy.ErrInvalidConfiguration)
+
+	svc.Set("KEYCLOAK_REALMS", "master,acme")
+	cfg, err = gf.FromEnv(env)
+	assert.NoError(t, err)
+	gm, err = gf.Create(cfg)
+	assert.NoError(t, err)
+	assert.IsType(t, &KeycloakRealmRouter{}, gm)
+}
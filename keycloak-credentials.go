@@ -0,0 +1,105 @@
+package keycloak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// The admin-cli client is used by LoginAdmin, so refreshes have to use it as well
+const adminClientID = "admin-cli"
+
+var ErrRefreshNotSupported = errors.New("credentials do not support token refresh")
+
+// Credentials obtain tokens from Keycloak. The TokenSource takes care of the
+// lifecycle, credentials only know how to log in and how to refresh.
+type Credentials interface {
+	Login(ctx context.Context, client *gocloak.GoCloak, realm string) (*gocloak.JWT, error)
+	Refresh(ctx context.Context, client *gocloak.GoCloak, realm string, refreshToken string) (*gocloak.JWT, error)
+}
+
+// AdminCredentials log in with a user name and password through the admin-cli client
+type AdminCredentials struct {
+	User     string
+	Password string
+}
+
+func (c *AdminCredentials) Login(ctx context.Context, client *gocloak.GoCloak, realm string) (*gocloak.JWT, error) {
+	return client.LoginAdmin(ctx, c.User, c.Password, realm)
+}
+
+func (c *AdminCredentials) Refresh(ctx context.Context, client *gocloak.GoCloak, realm string, refreshToken string) (*gocloak.JWT, error) {
+	return client.RefreshToken(ctx, refreshToken, adminClientID, "", realm)
+}
+
+// ClientCredentials log in as the service account of a confidential client
+type ClientCredentials struct {
+	ClientID     string
+	ClientSecret string
+}
+
+func (c *ClientCredentials) Login(ctx context.Context, client *gocloak.GoCloak, realm string) (*gocloak.JWT, error) {
+	return client.LoginClient(ctx, c.ClientID, c.ClientSecret, realm)
+}
+
+func (c *ClientCredentials) Refresh(ctx context.Context, client *gocloak.GoCloak, realm string, refreshToken string) (*gocloak.JWT, error) {
+	return client.RefreshToken(ctx, refreshToken, c.ClientID, c.ClientSecret, realm)
+}
+
+// SignedJWTCredentials log in as the service account of a confidential client that
+// authenticates with a signed JWT client assertion instead of a secret
+type SignedJWTCredentials struct {
+	ClientID string
+	Key      interface{}
+	Method   jwt.SigningMethod
+	// How long each assertion is valid for, defaults to one minute
+	Lifetime time.Duration
+}
+
+func (c *SignedJWTCredentials) Login(ctx context.Context, client *gocloak.GoCloak, realm string) (*gocloak.JWT, error) {
+	lifetime := c.Lifetime
+	if lifetime == 0 {
+		lifetime = time.Minute
+	}
+	expires := jwt.NewNumericDate(time.Now().Add(lifetime))
+	return client.LoginClientSignedJWT(ctx, c.ClientID, realm, c.Key, c.Method, expires)
+}
+
+// Refreshing would need a new assertion anyway, so just log in again
+func (c *SignedJWTCredentials) Refresh(ctx context.Context, client *gocloak.GoCloak, realm string, refreshToken string) (*gocloak.JWT, error) {
+	return nil, ErrRefreshNotSupported
+}
+
+// NewSignedJWTCredentialsFromFile loads a PEM encoded RSA or EC private key.
+// The algorithm is one of RS256, RS384, RS512, ES256, ES384 or ES512
+func NewSignedJWTCredentialsFromFile(clientID string, keyFile string, alg string) (*SignedJWTCredentials, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	method := jwt.GetSigningMethod(alg)
+	var key interface{}
+	switch method.(type) {
+	case *jwt.SigningMethodRSA:
+		key, err = jwt.ParseRSAPrivateKeyFromPEM(data)
+	case *jwt.SigningMethodECDSA:
+		key, err = jwt.ParseECPrivateKeyFromPEM(data)
+	default:
+		return nil, fmt.Errorf("unsupported client assertion algorithm: %v", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &SignedJWTCredentials{
+		ClientID: clientID,
+		Key:      key,
+		Method:   method,
+	}, nil
+}
@@ -0,0 +1,41 @@
+package keycloak
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// fakeKeycloak starts a server that logs in to the master realm and returns its mux, for the
+// test to register the admin routes it needs, and a session connected to it
+func fakeKeycloak(t *testing.T) (*http.ServeMux, *KeycloakSession) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/realms/master/protocol/openid-connect/token", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, gocloak.JWT{AccessToken: "access", ExpiresIn: 60})
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return mux, NewKeycloakSession(srv.URL, "adminuser", "admin", "master")
+}
+
+// fakeServerInfo reports the server version, an empty version is forbidden like it is for
+// service accounts without the view-system permission
+func fakeServerInfo(mux *http.ServeMux, version string) {
+	mux.HandleFunc("/admin/serverinfo", func(w http.ResponseWriter, r *http.Request) {
+		if version == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		writeJSON(w, gocloak.ServerInfoRepresentation{
+			SystemInfo: &gocloak.SystemInfoRepresentation{Version: &version},
+		})
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,212 @@
+package keycloak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy/models"
+)
+
+// GroupDescriptionAttribute is the group attribute that holds GroupExtra.Description, Keycloak
+// groups have no description of their own
+const GroupDescriptionAttribute = "description"
+
+var ErrGroupNotFound = errors.New("group not found")
+
+// DefaultGroupAttributeSchema passes every group attribute through as is. Use a schema with
+// UnknownAttributesDrop or UnknownAttributesReject to limit groups to known attributes
+func DefaultGroupAttributeSchema() *AttributeSchema {
+	return &AttributeSchema{UnknownAttributes: UnknownAttributesPreserve}
+}
+
+// GroupToCloudy converts a Keycloak group. Extra is a *GroupExtra with the group's place in
+// the hierarchy, its description and the attributes the schema allows
+func (s *AttributeSchema) GroupToCloudy(g *gocloak.Group) *models.Group {
+	path := str(g.Path, "")
+	extra := &GroupExtra{
+		Path:       path,
+		ParentPath: ParentGroupPath(path),
+		Depth:      groupDepth(path),
+		Attributes: make(map[string]string),
+		Group:      g,
+	}
+	if g.SubGroups != nil {
+		extra.SubGroupCount = len(*g.SubGroups)
+	}
+	if g.Attributes != nil {
+		for name, values := range *g.Attributes {
+			if name == GroupDescriptionAttribute {
+				extra.Description = first(g.Attributes, name)
+				continue
+			}
+			attr := s.Find(name)
+			if s.UnknownAttributes != UnknownAttributesPreserve && attr == nil {
+				continue
+			}
+			if val := attributeToCloudy(attr, values); val != "" {
+				extra.Attributes[name] = val
+			}
+		}
+	}
+
+	return &models.Group{
+		ID:     str(g.ID, ""),
+		Name:   str(g.Name, ""),
+		Source: "Keycloak",
+		Type:   "security",
+		Extra:  extra,
+	}
+}
+
+// GroupToKeycloak converts a cloudy group. The description, path and attributes are taken
+// from Extra when it is a *GroupExtra. Under UnknownAttributesReject any attribute outside
+// the schema fails with ErrUnknownAttribute
+func (s *AttributeSchema) GroupToKeycloak(g *models.Group) (*gocloak.Group, error) {
+	group := &gocloak.Group{}
+	if g.ID != "" {
+		group.ID = &g.ID
+	}
+	if g.Name != "" {
+		group.Name = &g.Name
+	}
+
+	extra := GetGroupExtra(g)
+	if extra == nil {
+		return group, nil
+	}
+	if extra.Path != "" {
+		group.Path = &extra.Path
+	}
+	attrs, _, err := s.groupAttributes(extra)
+	if err != nil {
+		return nil, err
+	}
+	if len(attrs) > 0 {
+		group.Attributes = &attrs
+	}
+	return group, nil
+}
+
+// groupAttributes returns the attributes of a group to set and those to remove, the ones
+// with empty values. An empty Description keeps the description, it is only removed by an
+// empty GroupDescriptionAttribute in Attributes
+func (s *AttributeSchema) groupAttributes(extra *GroupExtra) (map[string][]string, []string, error) {
+	attrs := make(map[string][]string)
+	var removed []string
+	var unknown []string
+	for name, val := range extra.Attributes {
+		if name == GroupDescriptionAttribute {
+			if val == "" {
+				removed = append(removed, name)
+			}
+			continue
+		}
+		attr := s.Find(name)
+		if attr == nil {
+			switch s.UnknownAttributes {
+			case UnknownAttributesPreserve:
+			case UnknownAttributesReject:
+				unknown = append(unknown, name)
+				continue
+			default:
+				continue
+			}
+		}
+		if val == "" {
+			removed = append(removed, name)
+			continue
+		}
+		attrs[name] = attributeToKeycloak(attr, val)
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, nil, fmt.Errorf("%w: %v", ErrUnknownAttribute, strings.Join(unknown, ", "))
+	}
+
+	if extra.Description != "" {
+		attrs[GroupDescriptionAttribute] = []string{extra.Description}
+	}
+	return attrs, removed, nil
+}
+
+// mergeGroup applies a cloudy group to the group Keycloak has, keeping the attributes the
+// update does not mention
+func (s *AttributeSchema) mergeGroup(current *gocloak.Group, g *models.Group) (*gocloak.Group, error) {
+	merged := &gocloak.Group{
+		ID:         current.ID,
+		Name:       current.Name,
+		Attributes: current.Attributes,
+	}
+	if g.Name != "" {
+		merged.Name = &g.Name
+	}
+
+	extra := GetGroupExtra(g)
+	if extra == nil {
+		return merged, nil
+	}
+	set, removed, err := s.groupAttributes(extra)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make(map[string][]string)
+	if current.Attributes != nil {
+		for name, values := range *current.Attributes {
+			attrs[name] = values
+		}
+	}
+	for name, values := range set {
+		attrs[name] = values
+	}
+	for _, name := range removed {
+		delete(attrs, name)
+	}
+	merged.Attributes = &attrs
+	return merged, nil
+}
+
+// SetAttributeSchema replaces the group attributes this manager maps. A nil schema restores
+// DefaultGroupAttributeSchema
+func (gm *KeycloakGroupManager) SetAttributeSchema(schema *AttributeSchema) {
+	if schema == nil {
+		schema = DefaultGroupAttributeSchema()
+	}
+	gm.schema.Store(schema)
+}
+
+func (gm *KeycloakGroupManager) AttributeSchema() *AttributeSchema {
+	return gm.schema.Load()
+}
+
+// SetUserAttributeSchema replaces the user attributes mapped on group members. Use the
+// schema of the user manager so members look the same as users read there. A nil schema
+// restores DefaultAttributeSchema
+func (gm *KeycloakGroupManager) SetUserAttributeSchema(schema *AttributeSchema) {
+	if schema == nil {
+		schema = DefaultAttributeSchema()
+	}
+	gm.userSchema.Store(schema)
+}
+
+func (gm *KeycloakGroupManager) UserAttributeSchema() *AttributeSchema {
+	return gm.userSchema.Load()
+}
+
+// parentId finds the id of the group with the given path, empty for top level
+func (gm *KeycloakGroupManager) parentId(ctx context.Context, parentPath string) (string, error) {
+	if parentPath == "" {
+		return "", nil
+	}
+	parent, err := gm.GetGroupByPath(ctx, parentPath)
+	if err != nil {
+		return "", err
+	}
+	if parent == nil {
+		return "", fmt.Errorf("%w: %v", ErrGroupNotFound, parentPath)
+	}
+	return parent.ID, nil
+}
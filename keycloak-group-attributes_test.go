@@ -0,0 +1,116 @@
+package keycloak
+
+import (
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroupAttributes(t *testing.T) {
+	kc := &gocloak.Group{
+		ID:   gocloak.StringP("xyz"),
+		Name: gocloak.StringP("XYZ"),
+		Path: gocloak.StringP("/Programs/XYZ"),
+		Attributes: &map[string][]string{
+			"description":        {"The XYZ program"},
+			"CostCenter":         {"CC-100"},
+			"DataClassification": {"CUI"},
+			"Sites":              {"East", "West"},
+		},
+	}
+
+	grp := GroupToCloudy(kc)
+	extra := GetGroupExtra(grp)
+	assert.Equal(t, "The XYZ program", extra.Description)
+	assert.Equal(t, "/Programs/XYZ", extra.Path)
+	assert.Equal(t, "CC-100", extra.Attributes["CostCenter"])
+	assert.Equal(t, []string{"East", "West"}, GetAttributeValues(&models.User{Attributes: extra.Attributes}, "Sites"))
+	assert.NotContains(t, extra.Attributes, "description")
+
+	back := GroupToKeycloak(grp)
+	assert.Equal(t, "/Programs/XYZ", *back.Path)
+	assert.Equal(t, *kc.Attributes, *back.Attributes)
+
+	// A schema limits the attributes that are mapped
+	schema := NewAttributeSchema(&Attribute{Name: "CostCenter"})
+	extra = GetGroupExtra(schema.GroupToCloudy(kc))
+	assert.Equal(t, map[string]string{"CostCenter": "CC-100"}, extra.Attributes)
+	assert.Equal(t, "The XYZ program", extra.Description)
+
+	schema.UnknownAttributes = UnknownAttributesReject
+	_, err := schema.GroupToKeycloak(grp)
+	assert.ErrorIs(t, err, ErrUnknownAttribute)
+
+	// Groups without a GroupExtra only have an id and name
+	plain, err := schema.GroupToKeycloak(&models.Group{ID: "xyz", Name: "XYZ"})
+	assert.NoError(t, err)
+	assert.Nil(t, plain.Attributes)
+}
+
+func TestMergeGroup(t *testing.T) {
+	current := &gocloak.Group{
+		ID:   gocloak.StringP("xyz"),
+		Name: gocloak.StringP("XYZ"),
+		Attributes: &map[string][]string{
+			"description":        {"The XYZ program"},
+			"CostCenter":         {"CC-100"},
+			"DataClassification": {"CUI"},
+		},
+	}
+	schema := DefaultGroupAttributeSchema()
+
+	// A plain rename keeps every attribute
+	merged, err := schema.mergeGroup(current, &models.Group{ID: "xyz", Name: "XYZ 2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "XYZ 2", *merged.Name)
+	assert.Equal(t, *current.Attributes, *merged.Attributes)
+
+	// Attributes not given are kept, empty values are removed
+	merged, err = schema.mergeGroup(current, &models.Group{
+		ID:   "xyz",
+		Name: "XYZ",
+		Extra: &GroupExtra{
+			Description: "The XYZ program",
+			Attributes:  map[string]string{"CostCenter": "CC-200", "DataClassification": ""},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"description": {"The XYZ program"},
+		"CostCenter":  {"CC-200"},
+	}, *merged.Attributes)
+	assert.Equal(t, []string{"CC-100"}, (*current.Attributes)["CostCenter"])
+}
+
+func TestMergeGroupDescription(t *testing.T) {
+	current := &gocloak.Group{
+		ID:   gocloak.StringP("xyz"),
+		Name: gocloak.StringP("XYZ"),
+		Attributes: &map[string][]string{
+			"description": {"The XYZ program"},
+			"CostCenter":  {"CC-100"},
+		},
+	}
+	schema := DefaultGroupAttributeSchema()
+
+	// Updating attributes alone keeps the description
+	merged, err := schema.mergeGroup(current, &models.Group{
+		ID:    "xyz",
+		Extra: &GroupExtra{Attributes: map[string]string{"CostCenter": "CC-200"}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"description": {"The XYZ program"},
+		"CostCenter":  {"CC-200"},
+	}, *merged.Attributes)
+
+	// It is only removed when cleared on purpose
+	merged, err = schema.mergeGroup(current, &models.Group{
+		ID:    "xyz",
+		Extra: &GroupExtra{Attributes: map[string]string{GroupDescriptionAttribute: ""}},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{"CostCenter": {"CC-100"}}, *merged.Attributes)
+}
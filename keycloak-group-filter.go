@@ -0,0 +1,158 @@
+package keycloak
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// GroupFilter is the parsed form of the filter passed to ListGroups
+type GroupFilter struct {
+	// Part of the group name, or the whole name when Exact is set
+	Search string
+	Exact  *bool
+	// Brief leaves out the description and attributes, which is faster for large realms
+	Brief bool
+	// Group attributes, sent as Keycloak's q=name:value search
+	Attributes map[string]string
+}
+
+// ParseGroupFilter parses a ListGroups filter. A filter without an '=' is a search on the
+// group name. Anything else is a query string such as "search=Team&exact=true" or
+// "CostCenter=CC-100".
+//
+// The keys search and exact map to the Keycloak parameters of the same name, brief (or
+// briefRepresentation) leaves out attributes, q takes Keycloak's "name:value" syntax and
+// any other key is matched as a group attribute.
+func ParseGroupFilter(filter string) (*GroupFilter, error) {
+	f := &GroupFilter{}
+	filter = strings.TrimSpace(filter)
+	if filter == "" {
+		return f, nil
+	}
+	if !strings.Contains(filter, "=") {
+		f.Search = filter
+		return f, nil
+	}
+
+	values, err := url.ParseQuery(filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid group filter %q: %w", filter, err)
+	}
+
+	for key, vals := range values {
+		val := vals[len(vals)-1]
+		switch key {
+		case "search":
+			f.Search = val
+		case "exact":
+			f.Exact, err = parseFilterBool(key, val)
+		case "brief", "briefRepresentation":
+			var brief *bool
+			brief, err = parseFilterBool(key, val)
+			if brief != nil {
+				f.Brief = *brief
+			}
+		case "q":
+			for _, v := range vals {
+				var attrs map[string]string
+				attrs, err = parseAttributeQuery(v)
+				if err != nil {
+					break
+				}
+				for name, value := range attrs {
+					f.SetAttribute(name, value)
+				}
+			}
+		default:
+			f.SetAttribute(key, val)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Attributes Keycloak can not search for fail here rather than when listing
+	if _, err := f.Params(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *GroupFilter) SetAttribute(name string, value string) {
+	if f.Attributes == nil {
+		f.Attributes = make(map[string]string)
+	}
+	f.Attributes[name] = value
+}
+
+// Params converts the filter to the Keycloak query parameters. Attribute searches always
+// read the attributes, they are needed to pick the matches out of the result. It fails when
+// an attribute can not be written in Keycloak's q syntax, see AttributeQuery
+func (f *GroupFilter) Params() (gocloak.GetGroupsParams, error) {
+	params := gocloak.GetGroupsParams{
+		Exact:               f.Exact,
+		BriefRepresentation: gocloak.BoolP(f.Brief && len(f.Attributes) == 0),
+	}
+	if f.Search != "" {
+		params.Search = &f.Search
+	}
+	if len(f.Attributes) > 0 {
+		q, err := AttributeQuery(f.Attributes)
+		if err != nil {
+			return params, err
+		}
+		params.Q = &q
+	}
+	return params, nil
+}
+
+// searches is true when Keycloak answers with the matching groups inside their parents
+func (f *GroupFilter) searches() bool {
+	return f.Search != "" || len(f.Attributes) > 0
+}
+
+// Matches checks a group against the filter the way Keycloak does, ignoring case unless
+// the search is exact
+func (f *GroupFilter) Matches(g *gocloak.Group) bool {
+	name := str(g.Name, "")
+	if f.Search != "" {
+		if f.Exact != nil && *f.Exact {
+			if name != f.Search {
+				return false
+			}
+		} else if !strings.Contains(strings.ToLower(name), strings.ToLower(f.Search)) {
+			return false
+		}
+	}
+	for attr, value := range f.Attributes {
+		if g.Attributes == nil || !slices.Contains((*g.Attributes)[attr], value) {
+			return false
+		}
+	}
+	return true
+}
+
+// flatten returns the groups matching the filter from a search result, where Keycloak
+// nests each match inside its parents
+func (f *GroupFilter) flatten(groups []*gocloak.Group) []*gocloak.Group {
+	var rtn []*gocloak.Group
+	var visit func(g *gocloak.Group)
+	visit = func(g *gocloak.Group) {
+		if f.Matches(g) {
+			rtn = append(rtn, g)
+		}
+		if g.SubGroups != nil {
+			for i := range *g.SubGroups {
+				visit(&(*g.SubGroups)[i])
+			}
+		}
+	}
+	for _, g := range groups {
+		visit(g)
+	}
+	return rtn
+}
@@ -0,0 +1,67 @@
+package keycloak
+
+import (
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGroupFilter(t *testing.T) {
+	f, err := ParseGroupFilter("")
+	assert.NoError(t, err)
+	assert.Equal(t, &GroupFilter{}, f)
+	params, err := f.Params()
+	assert.NoError(t, err)
+	assert.False(t, *params.BriefRepresentation)
+
+	f, err = ParseGroupFilter("All Staff")
+	assert.NoError(t, err)
+	assert.Equal(t, "All Staff", f.Search)
+
+	f, err = ParseGroupFilter("search=Team&exact=true&brief=true")
+	assert.NoError(t, err)
+	params, err = f.Params()
+	assert.NoError(t, err)
+	assert.Equal(t, "Team", *params.Search)
+	assert.True(t, *params.Exact)
+	assert.True(t, *params.BriefRepresentation)
+
+	// Attribute searches read the attributes to match them
+	f, err = ParseGroupFilter("CostCenter=CC-100&brief=true")
+	assert.NoError(t, err)
+	params, err = f.Params()
+	assert.NoError(t, err)
+	assert.Equal(t, "CostCenter:CC-100", *params.Q)
+	assert.False(t, *params.BriefRepresentation)
+
+	_, err = ParseGroupFilter("brief=maybe")
+	assert.ErrorContains(t, err, "brief")
+
+	_, err = ParseGroupFilter(`CostCenter=CC-"100"`)
+	assert.ErrorContains(t, err, "double quote")
+}
+
+func TestGroupFilterFlatten(t *testing.T) {
+	team := gocloak.Group{Name: gocloak.StringP("Team"), Attributes: &map[string][]string{"CostCenter": {"CC-100"}}}
+	teams := gocloak.Group{Name: gocloak.StringP("Teams")}
+	xyz := gocloak.Group{Name: gocloak.StringP("XYZ"), SubGroups: &[]gocloak.Group{team, teams}}
+	programs := &gocloak.Group{Name: gocloak.StringP("Programs"), SubGroups: &[]gocloak.Group{xyz}}
+	names := func(gs []*gocloak.Group) []string {
+		var rtn []string
+		for _, g := range gs {
+			rtn = append(rtn, *g.Name)
+		}
+		return rtn
+	}
+
+	f := &GroupFilter{Search: "team"}
+	assert.Equal(t, []string{"Team", "Teams"}, names(f.flatten([]*gocloak.Group{programs})))
+
+	f.Exact = gocloak.BoolP(true)
+	f.Search = "Team"
+	assert.Equal(t, []string{"Team"}, names(f.flatten([]*gocloak.Group{programs})))
+
+	f = &GroupFilter{Attributes: map[string]string{"CostCenter": "CC-100"}}
+	assert.Equal(t, []string{"Team"}, names(f.flatten([]*gocloak.Group{programs})))
+}
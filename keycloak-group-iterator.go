@@ -0,0 +1,192 @@
+package keycloak
+
+import (
+	"context"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/models"
+)
+
+// GroupIterator walks the groups matching a filter one page at a time, the same way
+// UserIterator walks users.
+//
+//	it, err := gm.IterateGroups(ctx, "search=Team", nil, 500)
+//	if err != nil { ... }
+//	defer it.Close()
+//	for it.Next() {
+//		grp := it.Group()
+//	}
+//	if err := it.Err(); err != nil { ... }
+type GroupIterator struct {
+	pager  *pager[*gocloak.Group]
+	schema *AttributeSchema
+	attrs  []string
+	cur    *models.Group
+}
+
+// IterateGroups returns an iterator over the groups matching the filter, see ParseGroupFilter.
+// Without a search only top level groups are returned. A pageSize of 0 uses PageSize
+func (gm *KeycloakGroupManager) IterateGroups(ctx context.Context, filter string, attrs []string, pageSize int) (*GroupIterator, error) {
+	err := gm.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ParseGroupFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GroupIterator{
+		pager: newPager(ctx, pageSize, func(ctx context.Context, page *PageRequest) ([]*gocloak.Group, *PageRequest, error) {
+			return gm.listGroupPage(ctx, f, page)
+		}),
+		schema: gm.schema.Load(),
+		attrs:  attrs,
+	}, nil
+}
+
+// Next advances to the next group, returning false at the end or on error
+func (it *GroupIterator) Next() bool {
+	g, ok := it.pager.next()
+	if !ok {
+		it.cur = nil
+		return false
+	}
+	it.cur = it.schema.GroupToCloudy(g)
+	trimGroupAttributes(it.cur, it.attrs)
+	return true
+}
+
+// Group is the current group
+func (it *GroupIterator) Group() *models.Group {
+	return it.cur
+}
+
+// Err returns the error that ended the iteration, if any
+func (it *GroupIterator) Err() error {
+	return it.pager.err
+}
+
+// Close stops the iteration and the background fetch. It is safe to call more than once
+func (it *GroupIterator) Close() {
+	it.cur = nil
+	it.pager.close()
+}
+
+// IterateGroupMembers returns an iterator over the direct members of a group. Brief members
+// only have their id, username, names, email and enabled flag. A pageSize of 0 uses PageSize
+func (gm *KeycloakGroupManager) IterateGroupMembers(ctx context.Context, groupId string, brief bool, pageSize int) (*UserIterator, error) {
+	err := gm.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserIterator{
+		pager: newPager(ctx, pageSize, func(ctx context.Context, page *PageRequest) ([]*gocloak.User, *PageRequest, error) {
+			return gm.listMemberPage(ctx, groupId, brief, page)
+		}),
+		schema: gm.userSchema.Load(),
+	}, nil
+}
+
+// ListGroupsPage returns one page of the groups matching the filter, see ParseGroupFilter
+func (gm *KeycloakGroupManager) ListGroupsPage(ctx context.Context, filter string, attrs []string, page *PageRequest) ([]*models.Group, *PageRequest, error) {
+	err := gm.connect(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := ParseGroupFilter(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	if page == nil {
+		page = &PageRequest{First: 0, Max: PageSize}
+	}
+
+	found, next, err := gm.listGroupPage(ctx, f, page)
+	if err != nil {
+		return nil, nil, err
+	}
+	rtn := make([]*models.Group, len(found))
+	for i, g := range found {
+		rtn[i] = gm.schema.Load().GroupToCloudy(g)
+		trimGroupAttributes(rtn[i], attrs)
+	}
+	return rtn, next, nil
+}
+
+// ListGroupMembersPage returns one page of the direct members of a group
+func (gm *KeycloakGroupManager) ListGroupMembersPage(ctx context.Context, groupId string, brief bool, page *PageRequest) ([]*models.User, *PageRequest, error) {
+	err := gm.connect(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if page == nil {
+		page = &PageRequest{First: 0, Max: PageSize}
+	}
+
+	found, next, err := gm.listMemberPage(ctx, groupId, brief, page)
+	if err != nil {
+		return nil, nil, err
+	}
+	rtn := make([]*models.User, len(found))
+	for i, u := range found {
+		rtn[i] = gm.userSchema.Load().ToCloudy(u)
+	}
+	return rtn, next, nil
+}
+
+// listGroupPage reads a page of groups. Keycloak pages searches by their top level group,
+// so a page can hold more or fewer matches than page.Max
+func (gm *KeycloakGroupManager) listGroupPage(ctx context.Context, f *GroupFilter, page *PageRequest) ([]*gocloak.Group, *PageRequest, error) {
+	params, err := f.Params()
+	if err != nil {
+		return nil, nil, err
+	}
+	params.First = cloudy.IntP(page.First)
+	params.Max = cloudy.IntP(page.Max)
+
+	found, err := withToken(ctx, gm.session, func(token string) ([]*gocloak.Group, error) {
+		return gm.client.GetGroups(ctx, token, gm.realm, params)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	next := nextGroupPage(page, len(found))
+	if f.searches() {
+		found = f.flatten(found)
+	}
+	return found, next, nil
+}
+
+func (gm *KeycloakGroupManager) listMemberPage(ctx context.Context, groupId string, brief bool, page *PageRequest) ([]*gocloak.User, *PageRequest, error) {
+	params := gocloak.GetGroupsParams{
+		First:               cloudy.IntP(page.First),
+		Max:                 cloudy.IntP(page.Max),
+		BriefRepresentation: cloudy.BoolP(brief),
+	}
+	found, err := withToken(ctx, gm.session, func(token string) ([]*gocloak.User, error) {
+		return gm.client.GetGroupMembers(ctx, token, gm.realm, groupId, params)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return found, nextGroupPage(page, len(found)), nil
+}
+
+// trimGroupAttributes keeps only the requested group attributes. No attributes keeps everything
+func trimGroupAttributes(g *models.Group, attrs []string) {
+	extra := GetGroupExtra(g)
+	if len(attrs) == 0 || extra == nil {
+		return
+	}
+	keep := make(map[string]string, len(attrs))
+	for _, name := range attrs {
+		if val, ok := extra.Attributes[name]; ok {
+			keep[name] = val
+		}
+	}
+	extra.Attributes = keep
+}
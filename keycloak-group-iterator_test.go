@@ -0,0 +1,129 @@
+package keycloak
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeMemberServer(t *testing.T, members int) *KeycloakGroupManager {
+	mux, session := fakeKeycloak(t)
+	mux.HandleFunc("/admin/realms/master/groups/staff/members", func(w http.ResponseWriter, r *http.Request) {
+		first, _ := strconv.Atoi(r.URL.Query().Get("first"))
+		max, _ := strconv.Atoi(r.URL.Query().Get("max"))
+		brief := r.URL.Query().Get("briefRepresentation") == "true"
+		users := []gocloak.User{}
+		for i := first; i < members && i < first+max; i++ {
+			u := gocloak.User{
+				ID:       gocloak.StringP(fmt.Sprintf("id-%v", i)),
+				Username: gocloak.StringP(fmt.Sprintf("user-%v", i)),
+			}
+			if !brief {
+				u.Attributes = &map[string][]string{"Organization": {"ACME"}, "Badge": {"B-7"}}
+			}
+			users = append(users, u)
+		}
+		writeJSON(w, users)
+	})
+	return NewGroupManagerFromSession(session)
+}
+
+func TestGroupMemberPaging(t *testing.T) {
+	ctx := context.Background()
+	gm := newFakeMemberServer(t, 250)
+
+	// Every page is read, not only Keycloak's default first 100
+	members, err := gm.GetGroupMembers(ctx, "staff")
+	assert.NoError(t, err)
+	assert.Len(t, members, 250)
+	assert.Equal(t, "user-249", members[249].Username)
+	assert.Equal(t, "ACME", members[0].Attributes["Organization"])
+
+	count, err := gm.CountGroupMembers(ctx, "staff")
+	assert.NoError(t, err)
+	assert.Equal(t, 250, count)
+
+	it, err := gm.IterateGroupMembers(ctx, "staff", true, 40)
+	assert.NoError(t, err)
+	n := 0
+	for it.Next() {
+		assert.Empty(t, it.User().Attributes)
+		n++
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, 250, n)
+
+	page, next, err := gm.ListGroupMembersPage(ctx, "staff", false, &PageRequest{First: 200, Max: 100})
+	assert.NoError(t, err)
+	assert.Len(t, page, 50)
+	assert.Nil(t, next)
+}
+
+func TestGroupMemberUserSchema(t *testing.T) {
+	ctx := context.Background()
+	gm := newFakeMemberServer(t, 3)
+
+	// Members are mapped with the user schema, which drops attributes it does not know
+	members, err := gm.GetGroupMembers(ctx, "staff")
+	assert.NoError(t, err)
+	assert.NotContains(t, members[0].Attributes, "Badge")
+
+	gm.SetUserAttributeSchema(NewAttributeSchema(&Attribute{Name: "Badge"}))
+	members, err = gm.GetGroupMembers(ctx, "staff")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"Badge": "B-7"}, members[0].Attributes)
+
+	page, _, err := gm.ListGroupMembersPage(ctx, "staff", false, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "B-7", page[0].Attributes["Badge"])
+
+	it, err := gm.IterateGroupMembers(ctx, "staff", false, 0)
+	assert.NoError(t, err)
+	assert.True(t, it.Next())
+	assert.Equal(t, "B-7", it.User().Attributes["Badge"])
+	it.Close()
+}
+
+func TestGroupIterator(t *testing.T) {
+	ctx := context.Background()
+	gm := newFakeGroupServer(t, "24.0.4")
+
+	it, err := gm.IterateGroups(ctx, "", nil, 1)
+	assert.NoError(t, err)
+	var names []string
+	for it.Next() {
+		names = append(names, it.Group().Name)
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, []string{"Admins", "Programs"}, names)
+
+	groups, next, err := gm.ListGroupsPage(ctx, "", nil, &PageRequest{First: 1, Max: 1})
+	assert.NoError(t, err)
+	assert.Len(t, groups, 1)
+	assert.Equal(t, "Programs", groups[0].Name)
+	assert.NotNil(t, next)
+}
+
+func TestGetGroupId(t *testing.T) {
+	ctx := context.Background()
+	gm := newFakeGroupServer(t, "24.0.4")
+
+	// Found by name at any depth, not by attribute
+	for name, id := range map[string]string{"Programs": "programs", "XYZ": "xyz", "Team": "team"} {
+		found, err := gm.GetGroupId(ctx, name)
+		assert.NoError(t, err)
+		assert.Equal(t, id, found, name)
+	}
+
+	// Only the exact name
+	for _, name := range []string{"XY", "team", "Missing"} {
+		found, err := gm.GetGroupId(ctx, name)
+		assert.NoError(t, err)
+		assert.Empty(t, found, name)
+	}
+}
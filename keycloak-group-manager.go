@@ -2,6 +2,8 @@ package keycloak
 
 import (
 	"context"
+	"fmt"
+	"sync/atomic"
 
 	"github.com/Nerzal/gocloak/v13"
 	"github.com/appliedres/cloudy"
@@ -14,117 +16,170 @@ func init() {
 
 type KeycloakGroupManagerFactory struct{}
 
+// Create accepts a *KeycloakConfig, or an already built *KeycloakGroupManager. When the
+// config lists several realms a *KeycloakRealmRouter is returned
 func (umf *KeycloakGroupManagerFactory) Create(cfg interface{}) (cloudy.GroupManager, error) {
-	return cfg.(*KeycloakGroupManager), nil
+	switch c := cfg.(type) {
+	case *KeycloakConfig:
+		session, err := NewKeycloakSessionFromConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		schema, err := c.GroupAttributeSchema()
+		if err != nil {
+			return nil, err
+		}
+		userSchema, err := c.AttributeSchema()
+		if err != nil {
+			return nil, err
+		}
+		if len(c.Realms) > 0 {
+			router := NewKeycloakRealmRouter(session, RestrictRealms(ContextRealmResolver(c.Realm), c.Realms...))
+			router.SetGroupAttributeSchema(schema)
+			router.SetAttributeSchema(userSchema)
+			return router, nil
+		}
+		gm := NewGroupManagerFromSession(session)
+		gm.SetAttributeSchema(schema)
+		gm.SetUserAttributeSchema(userSchema)
+		return gm, nil
+	case *KeycloakGroupManager:
+		return c, nil
+	}
+	return nil, fmt.Errorf("%w: expected *KeycloakConfig, got %T", cloudy.ErrInvalidConfiguration, cfg)
 }
 
 func (umf *KeycloakGroupManagerFactory) FromEnv(env *cloudy.Environment) (interface{}, error) {
-	cfg := NewKeycloakUserManagerFromEnv(context.Background(), env)
-	return cfg, nil
+	return KeycloakConfigFromEnv(env)
 }
 
 type KeycloakGroupManager struct {
-	address string
-	user    string
-	pwd     string
+	session *KeycloakSession
 	realm   string
 	client  *gocloak.GoCloak
-	jwt     *gocloak.JWT
+	// Schemas are swapped atomically, the router may set them while calls are made
+	schema atomic.Pointer[AttributeSchema]
+	// Maps the attributes of group members, like the user manager's schema
+	userSchema atomic.Pointer[AttributeSchema]
 }
 
 func NewKeycloak(address string, user string, pwd string, realm string) *KeycloakGroupManager {
-	return &KeycloakGroupManager{
-		address: address,
-		user:    user,
-		pwd:     pwd,
-		realm:   realm,
+	return NewGroupManagerFromSession(NewKeycloakSession(address, user, pwd, realm))
+}
+
+func NewGroupManagerFromEnv(ctx context.Context, env *cloudy.Environment) (*KeycloakGroupManager, error) {
+	session, err := NewKeycloakSessionFromEnv(env)
+	if err != nil {
+		return nil, err
 	}
+	return NewGroupManagerFromSession(session), nil
 }
 
-func NewGroupManagerFromEnv(ctx context.Context, env *cloudy.Environment) *KeycloakGroupManager {
-	cfg := &KeycloakGroupManager{}
-	cfg.address = env.Force("KEYCLOAK_HOST")
-	cfg.user = env.Force("KEYCLOAK_USER")
-	cfg.pwd = env.Force("KEYCLOAK_PWD")
-	cfg.realm = env.Default("KEYCLOAK_REALM", "master")
-	return cfg
+// NewGroupManagerFromSession creates a group manager that shares the login of the given session
+func NewGroupManagerFromSession(session *KeycloakSession) *KeycloakGroupManager {
+	return NewGroupManagerForRealm(session, session.Realm())
 }
 
-func (um *KeycloakGroupManager) connect() error {
-	//FIXME : CHECK EXPIRED
-	if um.jwt != nil {
-		return nil
+// NewGroupManagerForRealm creates a group manager for any realm the session is allowed to manage
+func NewGroupManagerForRealm(session *KeycloakSession, realm string) *KeycloakGroupManager {
+	gm := &KeycloakGroupManager{
+		session: session,
+		realm:   realm,
+		client:  session.Client(),
 	}
+	gm.schema.Store(DefaultGroupAttributeSchema())
+	gm.userSchema.Store(DefaultAttributeSchema())
+	return gm
+}
 
-	client := gocloak.NewClient(um.address)
-	ctx := context.Background()
-	token, err := client.LoginAdmin(ctx, um.user, um.pwd, um.realm)
-	if err != nil {
-		return err
-	}
-	um.jwt = token
-	um.client = client
-	return nil
+func (gm *KeycloakGroupManager) Realm() string {
+	return gm.realm
+}
+
+func (gm *KeycloakGroupManager) Session() *KeycloakSession {
+	return gm.session
+}
+
+func (gm *KeycloakGroupManager) connect(ctx context.Context) error {
+	return gm.session.Connect(ctx)
 }
 
-// List all the groups available
+// List the groups matching the filter, see ParseGroupFilter. Without a search only top level
+// groups are listed, a search finds groups at any depth. attrs limits the group attributes
+// returned. Use IterateGroups to avoid holding every group in memory
 func (gm *KeycloakGroupManager) ListGroups(ctx context.Context, filter string, attrs []string) (*[]models.Group, error) {
-	err := gm.connect()
+	err := gm.connect(ctx)
 	if err != nil {
 		return nil, err
 	}
-
-	found, err := gm.client.GetGroups(ctx, gm.jwt.AccessToken, gm.realm, gocloak.GetGroupsParams{})
+	f, err := ParseGroupFilter(filter)
 	if err != nil {
 		return nil, err
 	}
-	rtn := make([]models.Group, len(found))
-	for i, g := range found {
-		rtn[i] = *GroupToCloudy(g)
+
+	rtn := []models.Group{}
+	nextPage := &PageRequest{First: 0, Max: PageSize}
+	for nextPage != nil {
+		found, next, err := gm.listGroupPage(ctx, f, nextPage)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range found {
+			grp := gm.schema.Load().GroupToCloudy(g)
+			trimGroupAttributes(grp, attrs)
+			rtn = append(rtn, *grp)
+		}
+		nextPage = next
 	}
 	return &rtn, nil
 }
 
 // Get a specific group by id
 func (gm *KeycloakGroupManager) GetGroup(ctx context.Context, id string) (*models.Group, error) {
-	err := gm.connect()
+	err := gm.connect(ctx)
 	if err != nil {
 		return nil, err
 	}
-	found, err := gm.client.GetGroup(ctx, gm.jwt.AccessToken, gm.realm, id)
+	found, err := withToken(ctx, gm.session, func(token string) (*gocloak.Group, error) {
+		return gm.client.GetGroup(ctx, token, gm.realm, id)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return GroupToCloudy(found), nil
+	return gm.schema.Load().GroupToCloudy(found), nil
 }
 
-// Get a group id from name
+// Get a group id from its exact name, at any depth. Empty when there is no such group
 func (gm *KeycloakGroupManager) GetGroupId(ctx context.Context, name string) (string, error) {
-	err := gm.connect()
-	if err != nil {
-		return "", err
-	}
-	found, err := gm.client.GetGroups(ctx, gm.jwt.AccessToken, gm.realm, gocloak.GetGroupsParams{
-		Exact: cloudy.BoolP(true),
-		Q:     &name,
-	})
+	err := gm.connect(ctx)
 	if err != nil {
 		return "", err
 	}
-	if len(found) == 0 {
-		return "", nil
+	f := &GroupFilter{Search: name, Exact: cloudy.BoolP(true), Brief: true}
+	nextPage := &PageRequest{First: 0, Max: PageSize}
+	for nextPage != nil {
+		found, next, err := gm.listGroupPage(ctx, f, nextPage)
+		if err != nil {
+			return "", err
+		}
+		if len(found) > 0 {
+			return str(found[0].ID, ""), nil
+		}
+		nextPage = next
 	}
-	return *found[0].ID, nil
+	return "", nil
 }
 
 // Get all the groups for a single user
 func (gm *KeycloakGroupManager) GetUserGroups(ctx context.Context, uid string) ([]*models.Group, error) {
-	err := gm.connect()
+	err := gm.connect(ctx)
 	if err != nil {
 		return nil, err
 	}
-	found, err := gm.client.GetUserGroups(ctx, gm.jwt.AccessToken, gm.realm, uid, gocloak.GetGroupsParams{})
+	found, err := withToken(ctx, gm.session, func(token string) ([]*gocloak.Group, error) {
+		return gm.client.GetUserGroups(ctx, token, gm.realm, uid, gocloak.GetGroupsParams{})
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -133,119 +188,154 @@ func (gm *KeycloakGroupManager) GetUserGroups(ctx context.Context, uid string) (
 	}
 	rtn := make([]*models.Group, len(found))
 	for i, g := range found {
-		rtn[i] = GroupToCloudy(g)
+		rtn[i] = gm.schema.Load().GroupToCloudy(g)
 	}
 	return rtn, nil
 }
 
-// Create a new Group
+// Create a new Group. When Extra is a *GroupExtra with a Path the group is created under
+// the parent group of that path
 func (gm *KeycloakGroupManager) NewGroup(ctx context.Context, grp *models.Group) (*models.Group, error) {
-	err := gm.connect()
+	err := gm.connect(ctx)
 	if err != nil {
 		return nil, err
 	}
-	g := GroupToKeycloak(grp)
-	id, err := gm.client.CreateGroup(ctx, gm.jwt.AccessToken, gm.realm, *g)
+	g, err := gm.schema.Load().GroupToKeycloak(grp)
+	if err != nil {
+		return nil, err
+	}
+
+	parentId := ""
+	if extra := GetGroupExtra(grp); extra != nil {
+		parentId, err = gm.parentId(ctx, ParentGroupPath(extra.Path))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if parentId != "" {
+		return gm.NewSubGroup(ctx, parentId, grp)
+	}
+
+	id, err := withToken(ctx, gm.session, func(token string) (string, error) {
+		return gm.client.CreateGroup(ctx, token, gm.realm, *g)
+	})
 	if id != "" {
 		grp.ID = id
 	}
 	return grp, err
 }
 
-// Update a group. This is generally just the name of the group.
+// Update a group's name and, when Extra is a *GroupExtra, its description and attributes.
+// Attributes missing from Extra are kept, an empty value removes one. A Path under another
+// parent moves the group there
 func (gm *KeycloakGroupManager) UpdateGroup(ctx context.Context, grp *models.Group) (bool, error) {
-	err := gm.connect()
+	err := gm.connect(ctx)
+	if err != nil {
+		return false, err
+	}
+	current, err := withToken(ctx, gm.session, func(token string) (*gocloak.Group, error) {
+		return gm.client.GetGroup(ctx, token, gm.realm, grp.ID)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	g, err := gm.schema.Load().mergeGroup(current, grp)
 	if err != nil {
 		return false, err
 	}
-	g := GroupToKeycloak(grp)
-	err = gm.client.UpdateGroup(ctx, gm.jwt.AccessToken, gm.realm, *g)
+	err = gm.session.Do(ctx, func(token string) error {
+		return gm.client.UpdateGroup(ctx, token, gm.realm, *g)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	extra := GetGroupExtra(grp)
+	if extra == nil || extra.Path == "" || ParentGroupPath(extra.Path) == ParentGroupPath(str(current.Path, "")) {
+		return true, nil
+	}
+	parentId, err := gm.parentId(ctx, ParentGroupPath(extra.Path))
+	if err != nil {
+		return false, err
+	}
+	err = gm.MoveGroup(ctx, grp.ID, parentId)
 	if err != nil {
 		return false, err
 	}
 	return true, nil
 }
 
-// Get all the members of a group. This returns partial users only,
-// typically just the user id, name and email fields
+// Get all the members of a group, reading every page. Use IterateGroupMembers for
+// large groups
 func (gm *KeycloakGroupManager) GetGroupMembers(ctx context.Context, grpId string) ([]*models.User, error) {
-	err := gm.connect()
-	if err != nil {
-		return nil, err
-	}
-	found, err := gm.client.GetGroupMembers(ctx, gm.jwt.AccessToken, gm.realm, grpId, gocloak.GetGroupsParams{})
+	err := gm.connect(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if len(found) == 0 {
-		return nil, nil
-	}
-	rtn := make([]*models.User, len(found))
-	for i, u := range found {
-		rtn[i] = UserToCloudy(u)
+
+	var rtn []*models.User
+	nextPage := &PageRequest{First: 0, Max: PageSize}
+	for nextPage != nil {
+		found, next, err := gm.listMemberPage(ctx, grpId, false, nextPage)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range found {
+			rtn = append(rtn, gm.userSchema.Load().ToCloudy(u))
+		}
+		nextPage = next
 	}
 	return rtn, nil
 }
 
-// Remove members from a group
+// Remove members from a group. Keycloak does nothing for users who are not direct members,
+// a missing user is returned as an error for that user. A missing group fails with
+// ErrGroupNotFound before anything is sent
 func (gm *KeycloakGroupManager) RemoveMembers(ctx context.Context, groupId string, userIds []string) error {
-	err := gm.connect()
+	err := gm.connect(ctx)
 	if err != nil {
 		return err
 	}
-	merr := cloudy.MultiError()
-	for _, userId := range userIds {
-		err := gm.client.DeleteUserFromGroup(ctx, gm.jwt.AccessToken, gm.realm, userId, groupId)
-		if err != nil {
-			merr.Append(err)
-		}
+	// Keycloak answers 404 for a missing user and a missing group alike, so the group is
+	// checked once and the 404s left are the users'
+	_, err = gm.GetGroup(ctx, groupId)
+	if Is404(err) {
+		return fmt.Errorf("%w: %v", ErrGroupNotFound, groupId)
 	}
-	return merr.AsErr()
+	if err != nil {
+		return err
+	}
+	return gm.applyMembership(ctx, groupId, memberResults(userIds, MemberRemoved), 0)
 }
 
-// Add member(s) to a group
+// Add member(s) to a group. Adding an existing member does nothing, a missing user or
+// group is returned as an error for that user
 func (gm *KeycloakGroupManager) AddMembers(ctx context.Context, groupId string, userIds []string) error {
-	err := gm.connect()
+	err := gm.connect(ctx)
 	if err != nil {
 		return err
 	}
-	merr := cloudy.MultiError()
-	for _, userId := range userIds {
-		err := gm.client.AddUserToGroup(ctx, gm.jwt.AccessToken, gm.realm, userId, groupId)
-		if err != nil {
-			merr.Append(err)
-		}
-	}
-	return merr.AsErr()
+	return gm.applyMembership(ctx, groupId, memberResults(userIds, MemberAdded), 0)
 }
 
 func (gm *KeycloakGroupManager) DeleteGroup(ctx context.Context, groupId string) error {
-	err := gm.connect()
+	err := gm.connect(ctx)
 	if err != nil {
 		return err
 	}
-	err = gm.client.DeleteGroup(ctx, gm.jwt.AccessToken, gm.realm, groupId)
-	return err
+	return gm.session.Do(ctx, func(token string) error {
+		return gm.client.DeleteGroup(ctx, token, gm.realm, groupId)
+	})
 }
 
+// GroupToCloudy converts a group using DefaultGroupAttributeSchema
 func GroupToCloudy(g *gocloak.Group) *models.Group {
-	group := &models.Group{
-		ID:     *g.ID,
-		Name:   *g.Name,
-		Source: "Keycloak",
-		Type:   "security",
-		Extra:  g,
-	}
-	return group
+	return DefaultGroupAttributeSchema().GroupToCloudy(g)
 }
 
+// GroupToKeycloak converts a group using DefaultGroupAttributeSchema
 func GroupToKeycloak(g *models.Group) *gocloak.Group {
-	group := &gocloak.Group{}
-	if g.ID != "" {
-		group.ID = &g.ID
-	}
-	if g.Name != "" {
-		group.Name = &g.Name
-	}
+	group, _ := DefaultGroupAttributeSchema().GroupToKeycloak(g)
 	return group
 }
@@ -11,7 +11,8 @@ import (
 func TestGroupManager(t *testing.T) {
 	ctx := cloudy.StartContext()
 	env := startTestKeycloak(ctx)
-	gm := NewGroupManagerFromEnv(ctx, env)
+	gm, err := NewGroupManagerFromEnv(ctx, env)
+	assert.NoError(t, err)
 
 	groups, err := gm.ListGroups(ctx, "", nil)
 	assert.NoError(t, err)
@@ -46,6 +47,21 @@ func TestGroupManager(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, foundUpdated.Name, group.Name)
 
+	// Attributes are written through Extra and survive a rename
+	foundUpdated.Extra = &GroupExtra{
+		Description: "A test group",
+		Attributes:  map[string]string{"CostCenter": "CC-100"},
+	}
+	_, err = gm.UpdateGroup(ctx, foundUpdated)
+	assert.NoError(t, err)
+	_, err = gm.UpdateGroup(ctx, &models.Group{ID: groupId, Name: "Renamed"})
+	assert.NoError(t, err)
+	foundUpdated, err = gm.GetGroup(ctx, groupId)
+	assert.NoError(t, err)
+	assert.Equal(t, "Renamed", foundUpdated.Name)
+	assert.Equal(t, "A test group", GetGroupExtra(foundUpdated).Description)
+	assert.Equal(t, "CC-100", GetGroupExtra(foundUpdated).Attributes["CostCenter"])
+
 	err = gm.DeleteGroup(ctx, groupId)
 	assert.NoError(t, err)
 
@@ -58,8 +74,10 @@ func TestGroupManager(t *testing.T) {
 func TestGroupManagerMembers(t *testing.T) {
 	ctx := cloudy.StartContext()
 	env := startTestKeycloak(ctx)
-	gm := NewGroupManagerFromEnv(ctx, env)
-	um := NewKeycloakUserManagerFromEnv(ctx, env)
+	session, err := NewKeycloakSessionFromEnv(env)
+	assert.NoError(t, err)
+	gm := NewGroupManagerFromSession(session)
+	um := NewKeycloakUserManagerFromSession(session)
 
 	groups, err := gm.ListGroups(ctx, "", nil)
 	assert.NoError(t, err)
@@ -97,6 +115,10 @@ func TestGroupManagerMembers(t *testing.T) {
 	assert.NoError(t, err)
 	assert.NotEmpty(t, members)
 
+	counts, err := gm.GroupMemberCounts(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{group.ID: 1}, counts)
+
 	userGroups, err = gm.GetUserGroups(ctx, user.UID)
 	assert.NoError(t, err)
 	assert.NotEmpty(t, userGroups)
@@ -112,4 +134,61 @@ func TestGroupManagerMembers(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Empty(t, userGroups)
 
+	report, err := gm.SyncMembers(ctx, group.ID, []string{user.UID})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{user.UID}, report.Changed(MemberAdded))
+	report, err = gm.SyncMembers(ctx, group.ID, []string{user.UID})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{user.UID}, report.Changed(MemberUnchanged))
+	report, err = gm.SyncMembers(ctx, group.ID, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{user.UID}, report.Changed(MemberRemoved))
+}
+
+func TestGroupManagerSubGroups(t *testing.T) {
+	ctx := cloudy.StartContext()
+	env := startTestKeycloak(ctx)
+	gm, err := NewGroupManagerFromEnv(ctx, env)
+	assert.NoError(t, err)
+
+	programs, err := gm.NewGroup(ctx, &models.Group{Name: "Programs"})
+	assert.NoError(t, err)
+	xyz, err := gm.NewSubGroup(ctx, programs.ID, &models.Group{Name: "XYZ"})
+	assert.NoError(t, err)
+	team, err := gm.NewSubGroup(ctx, xyz.ID, &models.Group{Name: "Team"})
+	assert.NoError(t, err)
+
+	found, err := gm.GetGroupByPath(ctx, "/Programs/XYZ/Team")
+	assert.NoError(t, err)
+	assert.Equal(t, team.ID, found.ID)
+	assert.Equal(t, "/Programs/XYZ", GetGroupExtra(found).ParentPath)
+
+	subs, _, err := gm.ListSubGroups(ctx, programs.ID, nil)
+	assert.NoError(t, err)
+	assert.Len(t, subs, 1)
+	assert.Equal(t, xyz.ID, subs[0].ID)
+
+	// Team moves up next to XYZ
+	err = gm.MoveGroup(ctx, team.ID, programs.ID)
+	assert.NoError(t, err)
+	found, err = gm.GetGroupByPath(ctx, "/Programs/Team")
+	assert.NoError(t, err)
+	assert.Equal(t, team.ID, found.ID)
+
+	var paths []string
+	err = gm.WalkGroups(ctx, func(g *models.Group) error {
+		paths = append(paths, GetGroupExtra(g).Path)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"/Programs", "/Programs/Team", "/Programs/XYZ"}, paths)
+
+	// Searches find subgroups too
+	groups, err := gm.ListGroups(ctx, "search=Team&exact=true", nil)
+	assert.NoError(t, err)
+	assert.Len(t, *groups, 1)
+	assert.Equal(t, team.ID, (*groups)[0].ID)
+
+	err = gm.DeleteGroup(ctx, programs.ID)
+	assert.NoError(t, err)
 }
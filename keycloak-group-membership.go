@@ -0,0 +1,230 @@
+package keycloak
+
+import (
+	"context"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/models"
+)
+
+// MembershipOptions control the effective membership calls
+type MembershipOptions struct {
+	// Explain fills in the Path of every membership
+	Explain bool
+}
+
+// EffectiveGroup is a group a user belongs to directly or through one of its subgroups
+type EffectiveGroup struct {
+	Group  *models.Group
+	Direct bool
+	// Groups from the one the user is a direct member of up to Group, when explained
+	Path []*models.Group
+}
+
+// EffectiveMember is a user who belongs to a group directly or through one of its subgroups
+type EffectiveMember struct {
+	User   *models.User
+	Direct bool
+	// Groups from the one the user is a direct member of up to the group asked about, when explained
+	Path []*models.Group
+}
+
+// GetEffectiveUserGroups returns every group a user belongs to: the groups they are a direct
+// member of and all of their ancestors, each listed once
+func (gm *KeycloakGroupManager) GetEffectiveUserGroups(ctx context.Context, uid string, opts *MembershipOptions) ([]*EffectiveGroup, error) {
+	err := gm.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &MembershipOptions{}
+	}
+
+	direct, err := gm.directUserGroups(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	var rtn []*EffectiveGroup
+	seen := make(map[string]*EffectiveGroup)
+	byPath := make(map[string]*models.Group)
+	for _, g := range direct {
+		seen[g.ID] = &EffectiveGroup{Group: g, Direct: true, Path: explain(opts, nil, g)}
+		byPath[GetGroupExtra(g).Path] = g
+		rtn = append(rtn, seen[g.ID])
+	}
+
+	// Walk up from every direct group. A group reached twice keeps the shorter path
+	for _, g := range direct {
+		via := explain(opts, nil, g)
+		visited := map[string]bool{g.ID: true}
+		for parentPath := ParentGroupPath(GetGroupExtra(g).Path); parentPath != ""; {
+			parent, ok := byPath[parentPath]
+			if !ok {
+				parent, err = gm.GetGroupByPath(ctx, parentPath)
+				if err != nil {
+					return nil, err
+				}
+				if parent == nil {
+					break
+				}
+				byPath[parentPath] = parent
+			}
+			if visited[parent.ID] {
+				break
+			}
+			visited[parent.ID] = true
+
+			via = explain(opts, via, parent)
+			if found, ok := seen[parent.ID]; !ok {
+				seen[parent.ID] = &EffectiveGroup{Group: parent, Path: via}
+				rtn = append(rtn, seen[parent.ID])
+			} else if !found.Direct && len(via) < len(found.Path) {
+				found.Path = via
+			}
+			parentPath = ParentGroupPath(GetGroupExtra(parent).Path)
+		}
+	}
+	return rtn, nil
+}
+
+// GetEffectiveGroupMembers returns every user in a group or any of its subgroups, each listed
+// once. Members are read in their brief form
+func (gm *KeycloakGroupManager) GetEffectiveGroupMembers(ctx context.Context, groupId string, opts *MembershipOptions) ([]*EffectiveMember, error) {
+	err := gm.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &MembershipOptions{}
+	}
+
+	root, err := gm.GetGroup(ctx, groupId)
+	if err != nil {
+		return nil, err
+	}
+
+	type step struct {
+		group *models.Group
+		// From root down to group
+		down []*models.Group
+	}
+
+	// Breadth first, so a user in several subgroups keeps the shortest path
+	var rtn []*EffectiveMember
+	seen := make(map[string]bool)
+	visited := map[string]bool{root.ID: true}
+	queue := []step{{group: root, down: explain(opts, nil, root)}}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		nextPage := &PageRequest{First: 0, Max: PageSize}
+		for nextPage != nil {
+			found, next, err := gm.listMemberPage(ctx, cur.group.ID, true, nextPage)
+			if err != nil {
+				return nil, err
+			}
+			for _, u := range found {
+				uid := str(u.ID, "")
+				if seen[uid] {
+					continue
+				}
+				seen[uid] = true
+				rtn = append(rtn, &EffectiveMember{
+					User:   gm.userSchema.Load().ToCloudy(u),
+					Direct: cur.group.ID == root.ID,
+					Path:   reversed(cur.down),
+				})
+			}
+			nextPage = next
+		}
+
+		children, err := gm.allSubGroups(ctx, cur.group.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, child := range children {
+			if visited[child.ID] {
+				continue
+			}
+			visited[child.ID] = true
+			queue = append(queue, step{group: child, down: explain(opts, cur.down, child)})
+		}
+	}
+	return rtn, nil
+}
+
+// IsEffectiveMember checks whether a user belongs to a group directly or through a subgroup.
+// The path explains the membership when it is found
+func (gm *KeycloakGroupManager) IsEffectiveMember(ctx context.Context, uid string, groupId string) (bool, []*models.Group, error) {
+	groups, err := gm.GetEffectiveUserGroups(ctx, uid, &MembershipOptions{Explain: true})
+	if err != nil {
+		return false, nil, err
+	}
+	for _, g := range groups {
+		if g.Group.ID == groupId {
+			return true, g.Path, nil
+		}
+	}
+	return false, nil, nil
+}
+
+// directUserGroups reads every page of a user's direct groups
+func (gm *KeycloakGroupManager) directUserGroups(ctx context.Context, uid string) ([]*models.Group, error) {
+	var rtn []*models.Group
+	nextPage := &PageRequest{First: 0, Max: PageSize}
+	for nextPage != nil {
+		params := gocloak.GetGroupsParams{
+			First:               cloudy.IntP(nextPage.First),
+			Max:                 cloudy.IntP(nextPage.Max),
+			BriefRepresentation: cloudy.BoolP(false),
+		}
+		found, err := withToken(ctx, gm.session, func(token string) ([]*gocloak.Group, error) {
+			return gm.client.GetUserGroups(ctx, token, gm.realm, uid, params)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range found {
+			rtn = append(rtn, gm.schema.Load().GroupToCloudy(g))
+		}
+		nextPage = nextGroupPage(nextPage, len(found))
+	}
+	return rtn, nil
+}
+
+// allSubGroups reads every page of a group's direct subgroups
+func (gm *KeycloakGroupManager) allSubGroups(ctx context.Context, parentId string) ([]*models.Group, error) {
+	var rtn []*models.Group
+	nextPage := &PageRequest{First: 0, Max: PageSize}
+	for nextPage != nil {
+		found, next, err := gm.ListSubGroups(ctx, parentId, nextPage)
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, found...)
+		nextPage = next
+	}
+	return rtn, nil
+}
+
+// explain extends a membership path when paths are asked for
+func explain(opts *MembershipOptions, path []*models.Group, g *models.Group) []*models.Group {
+	if !opts.Explain {
+		return nil
+	}
+	return append(path[:len(path):len(path)], g)
+}
+
+func reversed(path []*models.Group) []*models.Group {
+	if path == nil {
+		return nil
+	}
+	rtn := make([]*models.Group, len(path))
+	for i, g := range path {
+		rtn[len(path)-1-i] = g
+	}
+	return rtn
+}
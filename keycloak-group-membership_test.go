@@ -0,0 +1,85 @@
+package keycloak
+
+import (
+	"context"
+	"testing"
+
+	"github.com/appliedres/cloudy/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func groupIDs(groups []*models.Group) []string {
+	var rtn []string
+	for _, g := range groups {
+		rtn = append(rtn, g.ID)
+	}
+	return rtn
+}
+
+func TestEffectiveUserGroups(t *testing.T) {
+	ctx := context.Background()
+	gm := newFakeGroupServer(t, "24.0.4")
+
+	groups, err := gm.GetEffectiveUserGroups(ctx, "dave", &MembershipOptions{Explain: true})
+	assert.NoError(t, err)
+	assert.Len(t, groups, 3)
+	assert.Equal(t, "team", groups[0].Group.ID)
+	assert.True(t, groups[0].Direct)
+	assert.Equal(t, "programs", groups[2].Group.ID)
+	assert.False(t, groups[2].Direct)
+	assert.Equal(t, []string{"team", "xyz", "programs"}, groupIDs(groups[2].Path))
+
+	// Alice is directly in XYZ as well as Team, so XYZ is direct and Programs is one step away
+	groups, err = gm.GetEffectiveUserGroups(ctx, "alice", &MembershipOptions{Explain: true})
+	assert.NoError(t, err)
+	assert.Len(t, groups, 3)
+	for _, g := range groups {
+		switch g.Group.ID {
+		case "xyz":
+			assert.True(t, g.Direct)
+		case "programs":
+			assert.Equal(t, []string{"xyz", "programs"}, groupIDs(g.Path))
+		}
+	}
+
+	// Paths are only filled in when asked for
+	groups, err = gm.GetEffectiveUserGroups(ctx, "dave", nil)
+	assert.NoError(t, err)
+	assert.Nil(t, groups[2].Path)
+
+	ok, path, err := gm.IsEffectiveMember(ctx, "dave", "programs")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"team", "xyz", "programs"}, groupIDs(path))
+	ok, _, err = gm.IsEffectiveMember(ctx, "carol", "xyz")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestEffectiveGroupMembers(t *testing.T) {
+	for _, version := range []string{"24.0.4", "22.0.5"} {
+		t.Run(version, func(t *testing.T) {
+			ctx := context.Background()
+			gm := newFakeGroupServer(t, version)
+
+			members, err := gm.GetEffectiveGroupMembers(ctx, "programs", &MembershipOptions{Explain: true})
+			assert.NoError(t, err)
+			byUser := map[string]*EffectiveMember{}
+			for _, m := range members {
+				byUser[m.User.UID] = m
+			}
+			assert.Len(t, byUser, 4)
+			assert.Len(t, members, 4)
+			assert.True(t, byUser["carol"].Direct)
+			assert.Equal(t, []string{"programs"}, groupIDs(byUser["carol"].Path))
+			assert.False(t, byUser["alice"].Direct)
+			assert.Equal(t, []string{"xyz", "programs"}, groupIDs(byUser["alice"].Path))
+			assert.Equal(t, []string{"team", "xyz", "programs"}, groupIDs(byUser["dave"].Path))
+
+			members, err = gm.GetEffectiveGroupMembers(ctx, "team", nil)
+			assert.NoError(t, err)
+			assert.Len(t, members, 2)
+			assert.Nil(t, members[0].Path)
+		})
+	}
+}
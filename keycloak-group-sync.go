@@ -0,0 +1,191 @@
+package keycloak
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/appliedres/cloudy"
+)
+
+// MembershipConcurrency is the default number of membership changes sent to Keycloak at once
+const MembershipConcurrency = 8
+
+// Actions of a MemberResult
+const (
+	MemberAdded     = "added"
+	MemberRemoved   = "removed"
+	MemberUnchanged = "unchanged"
+)
+
+// SyncOptions control SyncMembersWithOptions
+type SyncOptions struct {
+	// Changes sent at once, MembershipConcurrency when 0
+	Concurrency int
+	// DryRun reports the changes without making them
+	DryRun bool
+}
+
+// MemberResult is what happened to one user during a sync
+type MemberResult struct {
+	UserID string
+	// MemberAdded, MemberRemoved or MemberUnchanged. A failed change keeps the action it tried
+	Action string
+	Err    error
+}
+
+// SyncReport lists the outcome for every user in the desired or current membership
+type SyncReport struct {
+	Results []*MemberResult
+}
+
+// Changed returns the ids of the users that were successfully given the action
+func (r *SyncReport) Changed(action string) []string {
+	var rtn []string
+	for _, res := range r.Results {
+		if res.Action == action && res.Err == nil {
+			rtn = append(rtn, res.UserID)
+		}
+	}
+	return rtn
+}
+
+// Failed returns the results whose change failed
+func (r *SyncReport) Failed() []*MemberResult {
+	var rtn []*MemberResult
+	for _, res := range r.Results {
+		if res.Err != nil {
+			rtn = append(rtn, res)
+		}
+	}
+	return rtn
+}
+
+// SyncMembers makes the direct members of a group exactly the desired users, see SyncMembersWithOptions
+func (gm *KeycloakGroupManager) SyncMembers(ctx context.Context, groupId string, desiredUserIds []string) (*SyncReport, error) {
+	return gm.SyncMembersWithOptions(ctx, groupId, desiredUserIds, nil)
+}
+
+// SyncMembersWithOptions adds the desired users who are not members and removes the members
+// who are not desired, a few at a time. Running it again with the same users changes nothing.
+// The report is always returned, the error is a cloudy.MultiError of the failed changes
+func (gm *KeycloakGroupManager) SyncMembersWithOptions(ctx context.Context, groupId string, desiredUserIds []string, opts *SyncOptions) (*SyncReport, error) {
+	err := gm.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &SyncOptions{}
+	}
+
+	current, err := gm.directMemberIds(ctx, groupId)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &SyncReport{}
+	desired := make(map[string]bool)
+	for _, uid := range desiredUserIds {
+		if uid == "" || desired[uid] {
+			continue
+		}
+		desired[uid] = true
+		action := MemberUnchanged
+		if !current[uid] {
+			action = MemberAdded
+		}
+		report.Results = append(report.Results, &MemberResult{UserID: uid, Action: action})
+	}
+	var removed []string
+	for uid := range current {
+		if !desired[uid] {
+			removed = append(removed, uid)
+		}
+	}
+	sort.Strings(removed)
+	report.Results = append(report.Results, memberResults(removed, MemberRemoved)...)
+
+	if opts.DryRun {
+		return report, nil
+	}
+	return report, gm.applyMembership(ctx, groupId, report.Results, opts.Concurrency)
+}
+
+// directMemberIds reads the ids of the direct members of a group
+func (gm *KeycloakGroupManager) directMemberIds(ctx context.Context, groupId string) (map[string]bool, error) {
+	current := make(map[string]bool)
+	nextPage := &PageRequest{First: 0, Max: PageSize}
+	for nextPage != nil {
+		found, next, err := gm.listMemberPage(ctx, groupId, true, nextPage)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range found {
+			current[str(u.ID, "")] = true
+		}
+		nextPage = next
+	}
+	return current, nil
+}
+
+// applyMembership sends the changes of the results with bounded concurrency and records
+// their errors. Every error, including a missing user or group, fails that user's change
+func (gm *KeycloakGroupManager) applyMembership(ctx context.Context, groupId string, results []*MemberResult, concurrency int) error {
+	if concurrency <= 0 {
+		concurrency = MembershipConcurrency
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, res := range results {
+		if res.Action == MemberUnchanged {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			res.Err = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func(res *MemberResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			res.Err = gm.changeMembership(ctx, groupId, res)
+		}(res)
+	}
+	wg.Wait()
+
+	merr := cloudy.MultiError()
+	for _, res := range results {
+		if res.Err != nil {
+			merr.Append(fmt.Errorf("could not %v %v: %w", actionVerb(res.Action), res.UserID, res.Err))
+		}
+	}
+	return merr.AsErr()
+}
+
+func (gm *KeycloakGroupManager) changeMembership(ctx context.Context, groupId string, res *MemberResult) error {
+	return gm.session.Do(ctx, func(token string) error {
+		if res.Action == MemberAdded {
+			return gm.client.AddUserToGroup(ctx, token, gm.realm, res.UserID, groupId)
+		}
+		return gm.client.DeleteUserFromGroup(ctx, token, gm.realm, res.UserID, groupId)
+	})
+}
+
+func memberResults(userIds []string, action string) []*MemberResult {
+	rtn := make([]*MemberResult, len(userIds))
+	for i, uid := range userIds {
+		rtn[i] = &MemberResult{UserID: uid, Action: action}
+	}
+	return rtn
+}
+
+func actionVerb(action string) string {
+	if action == MemberAdded {
+		return "add"
+	}
+	return "remove"
+}
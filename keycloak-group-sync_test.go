@@ -0,0 +1,149 @@
+package keycloak
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMembership struct {
+	mu       sync.Mutex
+	members  map[string]bool
+	calls    int
+	inFlight int
+	maxIn    int
+}
+
+func (f *fakeMembership) sorted() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var rtn []string
+	for uid := range f.members {
+		rtn = append(rtn, uid)
+	}
+	sort.Strings(rtn)
+	return rtn
+}
+
+func newFakeMembershipServer(t *testing.T, members ...string) (*KeycloakGroupManager, *fakeMembership) {
+	fake := &fakeMembership{members: map[string]bool{}}
+	for _, uid := range members {
+		fake.members[uid] = true
+	}
+
+	mux, session := fakeKeycloak(t)
+	mux.HandleFunc("/admin/realms/master/groups/staff", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, gocloak.Group{ID: gocloak.StringP("staff"), Name: gocloak.StringP("Staff"), Path: gocloak.StringP("/Staff")})
+	})
+	mux.HandleFunc("/admin/realms/master/groups/staff/members", func(w http.ResponseWriter, r *http.Request) {
+		users := []gocloak.User{}
+		if r.URL.Query().Get("first") == "0" {
+			for _, uid := range fake.sorted() {
+				users = append(users, gocloak.User{ID: gocloak.StringP(uid)})
+			}
+		}
+		writeJSON(w, users)
+	})
+	mux.HandleFunc("/admin/realms/master/users/", func(w http.ResponseWriter, r *http.Request) {
+		uid, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/realms/master/users/"), "/")
+		fake.mu.Lock()
+		fake.calls++
+		fake.inFlight++
+		fake.maxIn = max(fake.maxIn, fake.inFlight)
+		fake.mu.Unlock()
+
+		time.Sleep(5 * time.Millisecond)
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		fake.inFlight--
+		if strings.HasPrefix(uid, "missing") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodPut {
+			fake.members[uid] = true
+		} else {
+			delete(fake.members, uid)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return NewGroupManagerFromSession(session), fake
+}
+
+func TestSyncMembers(t *testing.T) {
+	ctx := context.Background()
+	gm, fake := newFakeMembershipServer(t, "alice", "bob", "carol")
+
+	desired := []string{"alice", "dave", "erin", "frank", "dave"}
+	report, err := gm.SyncMembersWithOptions(ctx, "staff", desired, &SyncOptions{DryRun: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dave", "erin", "frank"}, report.Changed(MemberAdded))
+	assert.Equal(t, []string{"bob", "carol"}, report.Changed(MemberRemoved))
+	assert.Equal(t, 0, fake.calls)
+
+	report, err = gm.SyncMembersWithOptions(ctx, "staff", desired, &SyncOptions{Concurrency: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alice"}, report.Changed(MemberUnchanged))
+	assert.Equal(t, []string{"alice", "dave", "erin", "frank"}, fake.sorted())
+	assert.Equal(t, 5, fake.calls)
+	assert.LessOrEqual(t, fake.maxIn, 2)
+
+	// Nothing left to do the second time
+	report, err = gm.SyncMembers(ctx, "staff", desired)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alice", "dave", "erin", "frank"}, report.Changed(MemberUnchanged))
+	assert.Equal(t, 5, fake.calls)
+
+	// A user that does not exist fails on its own
+	report, err = gm.SyncMembers(ctx, "staff", []string{"alice", "missing-1"})
+	assert.Error(t, err)
+	assert.ErrorContains(t, err, "missing-1")
+	assert.Len(t, report.Failed(), 1)
+	assert.Equal(t, "missing-1", report.Failed()[0].UserID)
+	assert.Equal(t, []string{"dave", "erin", "frank"}, report.Changed(MemberRemoved))
+	assert.Equal(t, []string{"alice"}, fake.sorted())
+}
+
+func TestAddRemoveMembersIdempotent(t *testing.T) {
+	ctx := context.Background()
+	gm, fake := newFakeMembershipServer(t, "alice")
+
+	assert.NoError(t, gm.AddMembers(ctx, "staff", []string{"alice", "bob"}))
+	assert.Equal(t, []string{"alice", "bob"}, fake.sorted())
+
+	// Removing someone who is not a member does nothing
+	assert.NoError(t, gm.RemoveMembers(ctx, "staff", []string{"bob", "carol"}))
+	assert.Equal(t, []string{"alice"}, fake.sorted())
+
+	// Keycloak not finding the user is a failure, not a change
+	err := gm.AddMembers(ctx, "staff", []string{"missing-1"})
+	assert.ErrorContains(t, err, "missing-1")
+	assert.Equal(t, []string{"alice"}, fake.sorted())
+}
+
+func TestRemoveMembersFailsOnNotFound(t *testing.T) {
+	ctx := context.Background()
+	gm, fake := newFakeMembershipServer(t, "alice", "missing-2")
+
+	err := gm.RemoveMembers(ctx, "staff", []string{"alice", "missing-2"})
+	assert.ErrorContains(t, err, "missing-2")
+	assert.Equal(t, []string{"missing-2"}, fake.sorted())
+
+	// A user Keycloak does not know fails even when they are not a member
+	err = gm.RemoveMembers(ctx, "staff", []string{"missing-3"})
+	assert.ErrorContains(t, err, "could not remove missing-3")
+
+	// A missing group fails once, before any user is sent
+	calls := fake.calls
+	err = gm.RemoveMembers(ctx, "no-such-group", []string{"missing-2"})
+	assert.ErrorIs(t, err, ErrGroupNotFound)
+	assert.Equal(t, calls, fake.calls)
+}
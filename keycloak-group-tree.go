@@ -0,0 +1,365 @@
+package keycloak
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy/models"
+)
+
+// GroupChildrenAPIVersion is the first Keycloak version that pages subgroups through
+// /groups/{id}/children instead of returning them inside their parent
+const GroupChildrenAPIVersion = 23
+
+// SkipSubGroups can be returned by a WalkGroups function to skip the subgroups of a group
+var SkipSubGroups = errors.New("skip subgroups")
+
+// GroupExtra is the Extra of groups returned by the group manager
+type GroupExtra struct {
+	// Full path such as /Programs/XYZ/Team
+	Path string
+	// Path of the parent group, empty for top level groups
+	ParentPath string
+	// Id of the parent group, known on Keycloak 23+ and for groups read as subgroups
+	ParentID string
+	// 0 for top level groups
+	Depth int
+	// Number of direct subgroups, when Keycloak returned them. Keycloak 23+ no longer nests
+	// subgroups, so groups from ListGroups and ListGroupsPage report 0 there. Groups from
+	// WalkGroups, GroupTree and ListSubGroups carry the count on every version
+	SubGroupCount int
+	// Left empty on update the description is kept, clear it with an empty
+	// GroupDescriptionAttribute in Attributes
+	Description string
+	// Attributes allowed by the group attribute schema. Values are encoded like user
+	// attributes, see GetAttributeValues
+	Attributes map[string]string
+	Group      *gocloak.Group
+}
+
+// GetGroupExtra returns the hierarchy information of a group, nil when it did not come from Keycloak
+func GetGroupExtra(g *models.Group) *GroupExtra {
+	extra, _ := g.Extra.(*GroupExtra)
+	return extra
+}
+
+// ParentGroupPath returns the path of the parent of a group path, empty for top level groups
+func ParentGroupPath(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return ""
+	}
+	return path[:i]
+}
+
+func groupDepth(path string) int {
+	return strings.Count(strings.Trim(path, "/"), "/")
+}
+
+// GroupNode is a group with its subgroups, see GroupTree
+type GroupNode struct {
+	Group    *models.Group
+	Children []*GroupNode
+}
+
+// keycloakGroup adds the fields Keycloak 23 added to groups, which gocloak does not read
+type keycloakGroup struct {
+	gocloak.Group
+	ParentID      *string `json:"parentId,omitempty"`
+	SubGroupCount *int    `json:"subGroupCount,omitempty"`
+}
+
+func (g *keycloakGroup) toCloudy(schema *AttributeSchema, parentID string) *models.Group {
+	group := schema.GroupToCloudy(&g.Group)
+	extra := GetGroupExtra(group)
+	extra.ParentID = str(g.ParentID, parentID)
+	if g.SubGroupCount != nil {
+		extra.SubGroupCount = *g.SubGroupCount
+	}
+	return group
+}
+
+// subGroups wraps the subgroups of a group from a Keycloak older than 23
+func (g *keycloakGroup) subGroups() []*keycloakGroup {
+	if g.SubGroups == nil {
+		return nil
+	}
+	rtn := make([]*keycloakGroup, len(*g.SubGroups))
+	for i := range *g.SubGroups {
+		rtn[i] = &keycloakGroup{Group: (*g.SubGroups)[i]}
+	}
+	return rtn
+}
+
+// NewSubGroup creates a group under the parent group
+func (gm *KeycloakGroupManager) NewSubGroup(ctx context.Context, parentId string, grp *models.Group) (*models.Group, error) {
+	err := gm.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	g, err := gm.schema.Load().GroupToKeycloak(grp)
+	if err != nil {
+		return nil, err
+	}
+	id, err := withToken(ctx, gm.session, func(token string) (string, error) {
+		return gm.client.CreateChildGroup(ctx, token, gm.realm, parentId, *g)
+	})
+	if id != "" {
+		grp.ID = id
+	}
+	return grp, err
+}
+
+// MoveGroup moves a group, along with its subgroups and members, under another group. An
+// empty parentId makes it a top level group
+func (gm *KeycloakGroupManager) MoveGroup(ctx context.Context, groupId string, parentId string) error {
+	err := gm.connect(ctx)
+	if err != nil {
+		return err
+	}
+	found, err := withToken(ctx, gm.session, func(token string) (*gocloak.Group, error) {
+		return gm.client.GetGroup(ctx, token, gm.realm, groupId)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Posting an existing group moves it. Only the id and name are sent so nothing else changes
+	g := gocloak.Group{ID: found.ID, Name: found.Name}
+	return gm.session.Do(ctx, func(token string) error {
+		if parentId == "" {
+			_, err := gm.client.CreateGroup(ctx, token, gm.realm, g)
+			return err
+		}
+		_, err := gm.client.CreateChildGroup(ctx, token, gm.realm, parentId, g)
+		return err
+	})
+}
+
+// GetGroupByPath returns the group with a path such as /Programs/XYZ/Team, nil when there is none
+func (gm *KeycloakGroupManager) GetGroupByPath(ctx context.Context, path string) (*models.Group, error) {
+	err := gm.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	segments := []string{"group-by-path"}
+	segments = append(segments, strings.Split(strings.Trim(path, "/"), "/")...)
+
+	found, err := withToken(ctx, gm.session, func(token string) (*keycloakGroup, error) {
+		var g keycloakGroup
+		resp, err := gm.client.GetRequestWithBearerAuth(ctx, token).
+			SetResult(&g).
+			Get(gm.session.adminURL(gm.realm, segments...))
+		if err := checkResponse(resp, err, "could not get group by path"); err != nil {
+			return nil, err
+		}
+		return &g, nil
+	})
+	if Is404(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return found.toCloudy(gm.schema.Load(), ""), nil
+}
+
+// ListSubGroups returns a page of the direct subgroups of a group. Keycloak 23+ pages them on
+// the server, older versions return them all inside the parent and are paged here
+func (gm *KeycloakGroupManager) ListSubGroups(ctx context.Context, parentId string, page *PageRequest) ([]*models.Group, *PageRequest, error) {
+	err := gm.connect(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if page == nil {
+		page = &PageRequest{First: 0, Max: PageSize}
+	}
+
+	useAPI, err := gm.usesChildrenAPI(ctx, parentId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var found []*keycloakGroup
+	if useAPI {
+		found, err = gm.childrenPage(ctx, parentId, page)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		parent, err := gm.legacyGroup(ctx, parentId)
+		if err != nil {
+			return nil, nil, err
+		}
+		all := parent.subGroups()
+		start := min(page.First, len(all))
+		found = all[start:min(start+page.Max, len(all))]
+	}
+
+	nextPage := nextGroupPage(page, len(found))
+	rtn := make([]*models.Group, len(found))
+	for i, g := range found {
+		rtn[i] = g.toCloudy(gm.schema.Load(), parentId)
+	}
+	return rtn, nextPage, nil
+}
+
+// WalkGroups calls fn for every group in the realm, parents before their subgroups. Returning
+// SkipSubGroups skips the subgroups of that group, any other error stops the walk
+func (gm *KeycloakGroupManager) WalkGroups(ctx context.Context, fn func(g *models.Group) error) error {
+	err := gm.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	nextPage := &PageRequest{First: 0, Max: PageSize}
+	for nextPage != nil {
+		found, err := gm.topGroupsPage(ctx, nextPage)
+		if err != nil {
+			return err
+		}
+		err = gm.walk(ctx, found, "", fn)
+		if err != nil {
+			return err
+		}
+		nextPage = nextGroupPage(nextPage, len(found))
+	}
+	return nil
+}
+
+func (gm *KeycloakGroupManager) walk(ctx context.Context, groups []*keycloakGroup, parentId string, fn func(g *models.Group) error) error {
+	for _, g := range groups {
+		group := g.toCloudy(gm.schema.Load(), parentId)
+		err := fn(group)
+		if errors.Is(err, SkipSubGroups) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		// Keycloak 23+ reports a count and pages the subgroups, older versions nest them all
+		if g.SubGroupCount == nil {
+			err = gm.walk(ctx, g.subGroups(), group.ID, fn)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		page := &PageRequest{First: 0, Max: PageSize}
+		for *g.SubGroupCount > 0 && page != nil {
+			children, err := gm.childrenPage(ctx, group.ID, page)
+			if err != nil {
+				return err
+			}
+			err = gm.walk(ctx, children, group.ID, fn)
+			if err != nil {
+				return err
+			}
+			page = nextGroupPage(page, len(children))
+		}
+	}
+	return nil
+}
+
+// GroupTree reads every group in the realm as a tree of top level groups
+func (gm *KeycloakGroupManager) GroupTree(ctx context.Context) ([]*GroupNode, error) {
+	var roots []*GroupNode
+	nodes := make(map[string]*GroupNode)
+	err := gm.WalkGroups(ctx, func(g *models.Group) error {
+		node := &GroupNode{Group: g}
+		nodes[g.ID] = node
+		if parent, ok := nodes[GetGroupExtra(g).ParentID]; ok {
+			parent.Children = append(parent.Children, node)
+		} else {
+			roots = append(roots, node)
+		}
+		return nil
+	})
+	return roots, err
+}
+
+// usesChildrenAPI decides from the server version, or by trying the children endpoint when
+// the version can not be read
+func (gm *KeycloakGroupManager) usesChildrenAPI(ctx context.Context, groupId string) (bool, error) {
+	s := gm.session
+	s.mu.Lock()
+	known := s.childrenAPI
+	s.mu.Unlock()
+	if known != nil {
+		return *known, nil
+	}
+
+	var useAPI bool
+	version, err := s.ServerVersion(ctx)
+	if major := MajorVersion(version); err == nil && major > 0 {
+		useAPI = major >= GroupChildrenAPIVersion
+	} else {
+		_, err = gm.childrenPage(ctx, groupId, &PageRequest{First: 0, Max: 1})
+		switch {
+		case err == nil:
+			useAPI = true
+		case Is404(err) || isStatus(err, 405):
+			// The group may be missing rather than the endpoint
+			_, err = gm.legacyGroup(ctx, groupId)
+			if err != nil {
+				return false, err
+			}
+			useAPI = false
+		default:
+			return false, err
+		}
+	}
+
+	s.mu.Lock()
+	s.childrenAPI = &useAPI
+	s.mu.Unlock()
+	return useAPI, nil
+}
+
+// nextGroupPage follows page when it came back full
+func nextGroupPage(page *PageRequest, found int) *PageRequest {
+	if found < page.Max {
+		return nil
+	}
+	return &PageRequest{First: page.First + page.Max, Max: page.Max}
+}
+
+func (gm *KeycloakGroupManager) topGroupsPage(ctx context.Context, page *PageRequest) ([]*keycloakGroup, error) {
+	return gm.getGroups(ctx, page, "could not get groups", "groups")
+}
+
+func (gm *KeycloakGroupManager) childrenPage(ctx context.Context, parentId string, page *PageRequest) ([]*keycloakGroup, error) {
+	return gm.getGroups(ctx, page, "could not get subgroups", "groups", parentId, "children")
+}
+
+func (gm *KeycloakGroupManager) getGroups(ctx context.Context, page *PageRequest, errMessage string, path ...string) ([]*keycloakGroup, error) {
+	return withToken(ctx, gm.session, func(token string) ([]*keycloakGroup, error) {
+		var found []*keycloakGroup
+		resp, err := gm.client.GetRequestWithBearerAuth(ctx, token).
+			SetQueryParams(map[string]string{
+				"first":               strconv.Itoa(page.First),
+				"max":                 strconv.Itoa(page.Max),
+				"briefRepresentation": "false",
+			}).
+			SetResult(&found).
+			Get(gm.session.adminURL(gm.realm, path...))
+		if err := checkResponse(resp, err, errMessage); err != nil {
+			return nil, err
+		}
+		return found, nil
+	})
+}
+
+func (gm *KeycloakGroupManager) legacyGroup(ctx context.Context, groupId string) (*keycloakGroup, error) {
+	found, err := withToken(ctx, gm.session, func(token string) (*gocloak.Group, error) {
+		return gm.client.GetGroup(ctx, token, gm.realm, groupId)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &keycloakGroup{Group: *found}, nil
+}
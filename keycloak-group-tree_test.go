@@ -0,0 +1,235 @@
+package keycloak
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy/models"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeGroup struct {
+	ID       string
+	Name     string
+	Path     string
+	Children []*fakeGroup
+}
+
+// representation is how Keycloak returns the group, nested before 23 and with a count after
+func (g *fakeGroup) representation(parentID string, modern bool) map[string]interface{} {
+	rep := map[string]interface{}{"id": g.ID, "name": g.Name, "path": g.Path}
+	if modern {
+		rep["subGroupCount"] = len(g.Children)
+		rep["subGroups"] = []interface{}{}
+		if parentID != "" {
+			rep["parentId"] = parentID
+		}
+		return rep
+	}
+	subs := []interface{}{}
+	for _, c := range g.Children {
+		subs = append(subs, c.representation(g.ID, modern))
+	}
+	rep["subGroups"] = subs
+	return rep
+}
+
+// searchRepresentation is how Keycloak returns the group in a search, with only the subgroups
+// leading to a match. Nil when nothing in it matches
+func (g *fakeGroup) searchRepresentation(search string, exact bool) map[string]interface{} {
+	subs := []interface{}{}
+	for _, c := range g.Children {
+		if rep := c.searchRepresentation(search, exact); rep != nil {
+			subs = append(subs, rep)
+		}
+	}
+	matches := strings.Contains(strings.ToLower(g.Name), strings.ToLower(search))
+	if exact {
+		matches = g.Name == search
+	}
+	if !matches && len(subs) == 0 {
+		return nil
+	}
+	return map[string]interface{}{"id": g.ID, "name": g.Name, "path": g.Path, "subGroups": subs}
+}
+
+// Direct members of the fake groups
+var fakeGroupMembers = map[string][]string{
+	"programs": {"carol"},
+	"xyz":      {"bob", "alice"},
+	"team":     {"alice", "dave"},
+}
+
+func newFakeGroupServer(t *testing.T, version string) *KeycloakGroupManager {
+	team := &fakeGroup{ID: "team", Name: "Team", Path: "/Programs/XYZ/Team"}
+	xyz := &fakeGroup{ID: "xyz", Name: "XYZ", Path: "/Programs/XYZ", Children: []*fakeGroup{team}}
+	abc := &fakeGroup{ID: "abc", Name: "ABC", Path: "/Programs/ABC"}
+	programs := &fakeGroup{ID: "programs", Name: "Programs", Path: "/Programs", Children: []*fakeGroup{abc, xyz}}
+	admins := &fakeGroup{ID: "admins", Name: "Admins", Path: "/Admins"}
+	top := []*fakeGroup{admins, programs}
+	modern := MajorVersion(version) >= GroupChildrenAPIVersion
+
+	byID := map[string]*fakeGroup{}
+	parents := map[string]string{}
+	var index func(gs []*fakeGroup, parent string)
+	index = func(gs []*fakeGroup, parent string) {
+		for _, g := range gs {
+			byID[g.ID] = g
+			parents[g.ID] = parent
+			index(g.Children, g.ID)
+		}
+	}
+	index(top, "")
+
+	page := func(r *http.Request, gs []*fakeGroup, parent string) []interface{} {
+		first, _ := strconv.Atoi(r.URL.Query().Get("first"))
+		max, _ := strconv.Atoi(r.URL.Query().Get("max"))
+		rtn := []interface{}{}
+		for i := first; i < len(gs) && i < first+max; i++ {
+			rtn = append(rtn, gs[i].representation(parent, modern))
+		}
+		return rtn
+	}
+
+	mux, session := fakeKeycloak(t)
+	fakeServerInfo(mux, version)
+	mux.HandleFunc("/admin/realms/master/groups", func(w http.ResponseWriter, r *http.Request) {
+		if search := r.URL.Query().Get("search"); search != "" {
+			exact := r.URL.Query().Get("exact") == "true"
+			found := []interface{}{}
+			for _, g := range top {
+				if rep := g.searchRepresentation(search, exact); rep != nil {
+					found = append(found, rep)
+				}
+			}
+			if r.URL.Query().Get("first") != "0" {
+				found = found[:0]
+			}
+			writeJSON(w, found)
+			return
+		}
+		writeJSON(w, page(r, top, ""))
+	})
+	mux.HandleFunc("/admin/realms/master/groups/", func(w http.ResponseWriter, r *http.Request) {
+		id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/realms/master/groups/"), "/")
+		g, ok := byID[id]
+		if !ok || (sub == "children" && !modern) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch sub {
+		case "children":
+			writeJSON(w, page(r, g.Children, g.ID))
+		case "members":
+			users := []gocloak.User{}
+			for _, uid := range fakeGroupMembers[id] {
+				users = append(users, gocloak.User{ID: gocloak.StringP(uid), Username: gocloak.StringP(uid)})
+			}
+			writeJSON(w, users)
+		default:
+			writeJSON(w, g.representation(parents[id], modern))
+		}
+	})
+	mux.HandleFunc("/admin/realms/master/users/", func(w http.ResponseWriter, r *http.Request) {
+		uid := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/realms/master/users/"), "/groups")
+		groups := []interface{}{}
+		for id, members := range fakeGroupMembers {
+			if slices.Contains(members, uid) {
+				groups = append(groups, map[string]interface{}{"id": id, "name": byID[id].Name, "path": byID[id].Path})
+			}
+		}
+		sort.Slice(groups, func(i, j int) bool {
+			return groups[i].(map[string]interface{})["path"].(string) < groups[j].(map[string]interface{})["path"].(string)
+		})
+		writeJSON(w, groups)
+	})
+	mux.HandleFunc("/admin/realms/master/group-by-path/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/admin/realms/master/group-by-path")
+		for id, g := range byID {
+			if g.Path == path {
+				writeJSON(w, g.representation(parents[id], modern))
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+	return NewGroupManagerFromSession(session)
+}
+
+func TestGroupTree(t *testing.T) {
+	for _, version := range []string{"24.0.4", "22.0.5"} {
+		t.Run(version, func(t *testing.T) {
+			ctx := context.Background()
+			gm := newFakeGroupServer(t, version)
+
+			var paths []string
+			err := gm.WalkGroups(ctx, func(g *models.Group) error {
+				paths = append(paths, GetGroupExtra(g).Path)
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"/Admins", "/Programs", "/Programs/ABC", "/Programs/XYZ", "/Programs/XYZ/Team"}, paths)
+
+			// Skipping the subgroups of Programs, the sentinel may be wrapped
+			paths = nil
+			err = gm.WalkGroups(ctx, func(g *models.Group) error {
+				paths = append(paths, GetGroupExtra(g).Path)
+				if g.Name == "Programs" {
+					return fmt.Errorf("done with %v: %w", g.Name, SkipSubGroups)
+				}
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"/Admins", "/Programs"}, paths)
+
+			tree, err := gm.GroupTree(ctx)
+			assert.NoError(t, err)
+			assert.Len(t, tree, 2)
+			assert.Equal(t, "Programs", tree[1].Group.Name)
+			assert.Len(t, tree[1].Children, 2)
+			team := tree[1].Children[1].Children[0].Group
+			extra := GetGroupExtra(team)
+			assert.Equal(t, "Team", team.Name)
+			assert.Equal(t, "xyz", extra.ParentID)
+			assert.Equal(t, "/Programs/XYZ", extra.ParentPath)
+			assert.Equal(t, 2, extra.Depth)
+
+			subs, next, err := gm.ListSubGroups(ctx, "programs", &PageRequest{First: 0, Max: 1})
+			assert.NoError(t, err)
+			assert.Len(t, subs, 1)
+			assert.Equal(t, "ABC", subs[0].Name)
+			assert.Equal(t, "programs", GetGroupExtra(subs[0]).ParentID)
+			subs, next, err = gm.ListSubGroups(ctx, "programs", next)
+			assert.NoError(t, err)
+			assert.Equal(t, "XYZ", subs[0].Name)
+			assert.Equal(t, 1, GetGroupExtra(subs[0]).SubGroupCount)
+			subs, next, err = gm.ListSubGroups(ctx, "programs", next)
+			assert.NoError(t, err)
+			assert.Empty(t, subs)
+			assert.Nil(t, next)
+
+			found, err := gm.GetGroupByPath(ctx, "/Programs/XYZ/Team")
+			assert.NoError(t, err)
+			assert.Equal(t, "team", found.ID)
+			assert.Equal(t, "/Programs/XYZ", GetGroupExtra(found).ParentPath)
+			found, err = gm.GetGroupByPath(ctx, "/Programs/Missing")
+			assert.NoError(t, err)
+			assert.Nil(t, found)
+		})
+	}
+}
+
+func TestParentGroupPath(t *testing.T) {
+	assert.Equal(t, "/Programs/XYZ", ParentGroupPath("/Programs/XYZ/Team"))
+	assert.Equal(t, "", ParentGroupPath("/Programs"))
+	assert.Equal(t, "", ParentGroupPath(""))
+	assert.Equal(t, 0, groupDepth("/Programs"))
+	assert.Equal(t, 2, groupDepth("/Programs/XYZ/Team"))
+}
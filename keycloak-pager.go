@@ -0,0 +1,95 @@
+package keycloak
+
+import "context"
+
+// pageFunc reads one page, returning the request for the next page or nil at the end
+type pageFunc[T any] func(ctx context.Context, page *PageRequest) ([]T, *PageRequest, error)
+
+// pager reads pages in the background for the iterators
+type pager[T any] struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	pages  chan pageOf[T]
+
+	page []T
+	pos  int
+	err  error
+	done bool
+}
+
+type pageOf[T any] struct {
+	items []T
+	err   error
+}
+
+func newPager[T any](ctx context.Context, pageSize int, read pageFunc[T]) *pager[T] {
+	if pageSize <= 0 {
+		pageSize = PageSize
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	p := &pager[T]{
+		ctx:    ctx,
+		cancel: cancel,
+		pages:  make(chan pageOf[T]),
+	}
+	go p.fetch(ctx, read, pageSize)
+	return p
+}
+
+// fetch sends pages until there are no more. The channel is unbuffered so at most
+// one page is read ahead of the consumer
+func (p *pager[T]) fetch(ctx context.Context, read pageFunc[T], pageSize int) {
+	defer close(p.pages)
+
+	nextPage := &PageRequest{First: 0, Max: pageSize}
+	for nextPage != nil {
+		some, next, err := read(ctx, nextPage)
+		if ctx.Err() != nil {
+			// Report the cancellation rather than the failed request it caused
+			err = ctx.Err()
+		}
+		select {
+		case p.pages <- pageOf[T]{items: some, err: err}:
+		case <-ctx.Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		nextPage = next
+	}
+}
+
+// next returns the next item, false at the end or on error
+func (p *pager[T]) next() (T, bool) {
+	var zero T
+	if p.done {
+		return zero, false
+	}
+	for p.pos >= len(p.page) {
+		page, ok := <-p.pages
+		if !ok {
+			// The fetch stops early only when the context is done
+			p.err = p.ctx.Err()
+			p.close()
+			return zero, false
+		}
+		if page.err != nil {
+			p.err = page.err
+			p.close()
+			return zero, false
+		}
+		p.page = page.items
+		p.pos = 0
+	}
+
+	item := p.page[p.pos]
+	p.pos++
+	return item, true
+}
+
+func (p *pager[T]) close() {
+	p.done = true
+	p.page = nil
+	p.cancel()
+}
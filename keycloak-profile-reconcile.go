@@ -0,0 +1,268 @@
+package keycloak
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	ProfileChangeAdd    = "add"
+	ProfileChangeUpdate = "update"
+	ProfileChangeRemove = "remove"
+)
+
+// ProfileChange is one step of a ProfilePlan
+type ProfileChange struct {
+	Action string
+	Name   string
+	// Current is nil when adding, Desired is nil when removing. When updating, Desired is
+	// the current attribute with the desired settings laid over it
+	Current *Attribute
+	Desired *Attribute
+	// Settings an update changes, such as displayName or validations.length
+	Fields []string
+}
+
+// ProfilePlan is the difference between a realm's user profile and the desired attributes
+type ProfilePlan struct {
+	Changes []*ProfileChange
+}
+
+// ReconcileOptions control ReconcileUserProfile
+type ReconcileOptions struct {
+	// Remove custom attributes that are not desired, and the validators and annotations
+	// of desired attributes they do not name. The built in username, email, firstName and
+	// lastName are never removed
+	Prune bool
+	// Only compute the plan
+	DryRun bool
+}
+
+// PlanUserProfile compares the current profile with the desired attributes. An attribute
+// changes when any setting the desired attribute specifies differs, not only when it is
+// missing. Settings the desired attribute leaves empty, such as a group, annotations or a
+// selector the realm added, are kept, as are validators and annotations it does not name
+// unless pruning. Permissions are only changed when the desired attribute has some
+func PlanUserProfile(current *UserProfileConfig, desired []*Attribute, prune bool) (*ProfilePlan, error) {
+	plan := &ProfilePlan{}
+	wanted := make(map[string]bool, len(desired))
+	for _, attr := range desired {
+		wanted[attr.Name] = true
+		existing := current.FindAttributeByName(attr.Name)
+		if existing == nil {
+			plan.Changes = append(plan.Changes, &ProfileChange{Action: ProfileChangeAdd, Name: attr.Name, Desired: attr})
+			continue
+		}
+		merged, fields, err := mergeAttribute(existing, attr, prune)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) > 0 {
+			plan.Changes = append(plan.Changes, &ProfileChange{Action: ProfileChangeUpdate, Name: attr.Name, Current: existing, Desired: merged, Fields: fields})
+		}
+	}
+
+	if prune {
+		for _, attr := range current.Attributes {
+			if wanted[attr.Name] || isBuiltInAttribute(attr.Name) {
+				continue
+			}
+			plan.Changes = append(plan.Changes, &ProfileChange{Action: ProfileChangeRemove, Name: attr.Name, Current: attr})
+		}
+	}
+	return plan, nil
+}
+
+// mergeAttribute lays the settings the desired attribute specifies over the current one,
+// comparing them the way Keycloak stores them. Validators and annotations are merged one by
+// one, pruning drops those the desired attribute does not name. It returns the merged
+// attribute and the settings that changed
+func mergeAttribute(current *Attribute, desired *Attribute, prune bool) (*Attribute, []string, error) {
+	cur, err := jsonFields(current)
+	if err != nil {
+		return nil, nil, err
+	}
+	want, err := jsonFields(desired)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	merged := make(map[string]json.RawMessage, len(cur)+len(want))
+	for key, raw := range cur {
+		merged[key] = raw
+	}
+	if want == nil {
+		want = make(map[string]json.RawMessage)
+	}
+	for _, key := range []string{"validations", "annotations"} {
+		if _, ok := want[key]; prune && !ok && cur[key] != nil {
+			want[key] = json.RawMessage("{}")
+		}
+	}
+	var changed []string
+	for key, raw := range want {
+		switch key {
+		case "validations", "annotations":
+			inner, innerChanged, err := mergeJSONFields(cur[key], raw, prune)
+			if err != nil {
+				return nil, nil, err
+			}
+			merged[key] = inner
+			for _, name := range innerChanged {
+				changed = append(changed, key+"."+name)
+			}
+			continue
+		case "permissions":
+			if desired.Permissions.View == nil && desired.Permissions.Edit == nil {
+				continue
+			}
+		}
+		if !bytes.Equal(cur[key], raw) {
+			changed = append(changed, key)
+		}
+		merged[key] = raw
+	}
+	sort.Strings(changed)
+
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return nil, nil, err
+	}
+	rtn := &Attribute{}
+	err = json.Unmarshal(data, rtn)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rtn, changed, nil
+}
+
+// mergeJSONFields lays the fields of one JSON object over another, returning the fields
+// that changed. Pruning removes the current fields the desired object does not have
+func mergeJSONFields(current json.RawMessage, desired json.RawMessage, prune bool) (json.RawMessage, []string, error) {
+	cur, err := jsonFields(current)
+	if err != nil {
+		return nil, nil, err
+	}
+	want, err := jsonFields(desired)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cur == nil {
+		cur = make(map[string]json.RawMessage)
+	}
+	var changed []string
+	for key, raw := range want {
+		if !bytes.Equal(cur[key], raw) {
+			changed = append(changed, key)
+		}
+		cur[key] = raw
+	}
+	if prune {
+		for key := range cur {
+			if _, ok := want[key]; !ok {
+				changed = append(changed, key)
+				delete(cur, key)
+			}
+		}
+	}
+	data, err := json.Marshal(cur)
+	return data, changed, err
+}
+
+// jsonFields splits a JSON object, or a value marshalled to one, into its fields
+func jsonFields(v interface{}) (map[string]json.RawMessage, error) {
+	data, ok := v.(json.RawMessage)
+	if !ok {
+		var err error
+		data, err = json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var fields map[string]json.RawMessage
+	if len(data) == 0 {
+		return fields, nil
+	}
+	err := json.Unmarshal(data, &fields)
+	return fields, err
+}
+
+// Empty is true when the profile is already as desired
+func (p *ProfilePlan) Empty() bool {
+	return len(p.Changes) == 0
+}
+
+// Apply makes the changes to cfg
+func (p *ProfilePlan) Apply(cfg *UserProfileConfig) {
+	for _, change := range p.Changes {
+		switch change.Action {
+		case ProfileChangeAdd:
+			cfg.Attributes = append(cfg.Attributes, change.Desired)
+		case ProfileChangeUpdate:
+			for i, existing := range cfg.Attributes {
+				if existing.Name == change.Name {
+					cfg.Attributes[i] = change.Desired
+				}
+			}
+		case ProfileChangeRemove:
+			for i, existing := range cfg.Attributes {
+				if existing.Name == change.Name {
+					cfg.Attributes = append(cfg.Attributes[:i], cfg.Attributes[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+}
+
+func (p *ProfilePlan) String() string {
+	if p.Empty() {
+		return "no changes"
+	}
+	lines := make([]string, len(p.Changes))
+	for i, change := range p.Changes {
+		lines[i] = fmt.Sprintf("%v %v", change.Action, change.Name)
+		if len(change.Fields) > 0 {
+			lines[i] += fmt.Sprintf(" (%v)", strings.Join(change.Fields, ", "))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ReconcileUserProfile brings the realm's user profile to the desired attributes and returns
+// the plan it applied. Running it again with the same attributes changes nothing
+func (um *KeycloakUserManager) ReconcileUserProfile(ctx context.Context, desired []*Attribute, opts ReconcileOptions) (*ProfilePlan, error) {
+	err := um.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return um.reconcileUserProfile(ctx, desired, opts)
+}
+
+func (um *KeycloakUserManager) reconcileUserProfile(ctx context.Context, desired []*Attribute, opts ReconcileOptions) (*ProfilePlan, error) {
+	cfg, err := um.getUserProfile(ctx)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := PlanUserProfile(cfg, desired, opts.Prune)
+	if err != nil {
+		return nil, err
+	}
+	if opts.DryRun || plan.Empty() {
+		return plan, nil
+	}
+
+	plan.Apply(cfg)
+	return plan, um.putUserProfile(ctx, cfg)
+}
+
+// ReconcileAttributeSchema reconciles the user profile with the manager's AttributeSchema.
+// Call it once at startup, managers only change the profile on their own after
+// SetReconcileOnConnect
+func (um *KeycloakUserManager) ReconcileAttributeSchema(ctx context.Context, opts ReconcileOptions) (*ProfilePlan, error) {
+	return um.ReconcileUserProfile(ctx, um.schema.Load().ProfileAttributes(), opts)
+}
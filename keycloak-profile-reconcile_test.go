@@ -0,0 +1,108 @@
+package keycloak
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanUserProfile(t *testing.T) {
+	current := &UserProfileConfig{
+		Attributes: []*Attribute{
+			AttrUsername,
+			{Name: "Organization", DisplayName: "Organization"},
+			{Name: "Legacy"},
+		},
+	}
+	desired := []*Attribute{
+		{Name: "Organization", DisplayName: "Organization"},
+		{Name: "Project", DisplayName: "Project"},
+	}
+
+	plan, err := PlanUserProfile(current, desired, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "add Project", plan.String())
+
+	desired[0] = &Attribute{
+		Name:        "Organization",
+		DisplayName: "Organization",
+		Validations: Validation{Length: &ValidationLength{Max: 100}},
+	}
+	plan, err = PlanUserProfile(current, desired, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "update Organization (validations.length)\nadd Project\nremove Legacy", plan.String())
+
+	plan.Apply(current)
+	assert.Equal(t, []*Attribute{AttrUsername, desired[0], desired[1]}, current.Attributes)
+
+	// Applying is idempotent
+	plan, err = PlanUserProfile(current, desired, true)
+	assert.NoError(t, err)
+	assert.True(t, plan.Empty())
+}
+
+func TestPlanUserProfileKeepsRealmSettings(t *testing.T) {
+	realm := &Attribute{
+		Name:        "Organization",
+		DisplayName: "Org",
+		Group:       "company",
+		Annotations: map[string]interface{}{"inputType": "select", "inputHelperTextBefore": "Pick one"},
+		Selector:    &Selector{Scopes: []string{"profile"}},
+		Permissions: Permissions{View: []string{AttributePermissionAdmin}, Edit: []string{AttributePermissionAdmin}},
+		Validations: Validation{
+			Length: &ValidationLength{Max: 50},
+			Other:  map[string]json.RawMessage{"my-validator": json.RawMessage(`{"flag":true}`)},
+		},
+	}
+	current := &UserProfileConfig{Attributes: []*Attribute{realm}}
+	desired := []*Attribute{{
+		Name:        "Organization",
+		DisplayName: "Organization",
+		Annotations: map[string]interface{}{"inputType": "text"},
+		Validations: Validation{Pattern: &ValidationPattern{Pattern: "[A-Z]+"}},
+	}}
+
+	plan, err := PlanUserProfile(current, desired, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "update Organization (annotations.inputType, displayName, validations.pattern)", plan.String())
+
+	plan.Apply(current)
+	merged := current.Attributes[0]
+	assert.Equal(t, "Organization", merged.DisplayName)
+	assert.Equal(t, "company", merged.Group)
+	assert.Equal(t, map[string]interface{}{"inputType": "text", "inputHelperTextBefore": "Pick one"}, merged.Annotations)
+	assert.Equal(t, []string{"profile"}, merged.Selector.Scopes)
+	assert.Equal(t, realm.Permissions, merged.Permissions)
+	assert.Equal(t, 50, merged.Validations.Length.Max)
+	assert.Equal(t, "[A-Z]+", merged.Validations.Pattern.Pattern)
+	assert.JSONEq(t, `{"flag":true}`, string(merged.Validations.Other["my-validator"]))
+
+	plan, err = PlanUserProfile(current, desired, false)
+	assert.NoError(t, err)
+	assert.True(t, plan.Empty())
+
+	// Pruning drops the validators and annotations the desired attribute does not name
+	plan, err = PlanUserProfile(current, desired, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "update Organization (annotations.inputHelperTextBefore, validations.length, validations.my-validator)", plan.String())
+	plan.Apply(current)
+	merged = current.Attributes[0]
+	assert.Equal(t, map[string]interface{}{"inputType": "text"}, merged.Annotations)
+	assert.Nil(t, merged.Validations.Length)
+	assert.Empty(t, merged.Validations.Other)
+	assert.Equal(t, "[A-Z]+", merged.Validations.Pattern.Pattern)
+	assert.Equal(t, "company", merged.Group)
+
+	// Including all of them when the desired attribute has none
+	desired[0].Annotations = nil
+	plan, err = PlanUserProfile(current, desired, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "update Organization (annotations.inputType)", plan.String())
+	plan.Apply(current)
+	assert.Empty(t, current.Attributes[0].Annotations)
+
+	plan, err = PlanUserProfile(current, desired, true)
+	assert.NoError(t, err)
+	assert.True(t, plan.Empty())
+}
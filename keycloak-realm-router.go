@@ -0,0 +1,417 @@
+package keycloak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/models"
+)
+
+var ErrNoRealm = errors.New("no keycloak realm could be resolved")
+var ErrRealmNotAllowed = errors.New("keycloak realm is not allowed")
+
+var _ cloudy.UserManager = (*KeycloakRealmRouter)(nil)
+var _ cloudy.GroupManager = (*KeycloakRealmRouter)(nil)
+
+type realmContextKey struct{}
+
+// WithRealm returns a context that routes KeycloakRealmRouter calls to the given realm
+func WithRealm(ctx context.Context, realm string) context.Context {
+	return context.WithValue(ctx, realmContextKey{}, realm)
+}
+
+// RealmFromContext returns the realm set by WithRealm
+func RealmFromContext(ctx context.Context) (string, bool) {
+	realm, ok := ctx.Value(realmContextKey{}).(string)
+	return realm, ok && realm != ""
+}
+
+// RealmResolver picks the realm a call should be made against, for example from the
+// tenant of the current request
+type RealmResolver func(ctx context.Context) (string, error)
+
+// ContextRealmResolver uses the realm from WithRealm and falls back to the given
+// default. When the default is empty calls without a realm fail with ErrNoRealm
+func ContextRealmResolver(defaultRealm string) RealmResolver {
+	return func(ctx context.Context) (string, error) {
+		if realm, ok := RealmFromContext(ctx); ok {
+			return realm, nil
+		}
+		if defaultRealm == "" {
+			return "", ErrNoRealm
+		}
+		return defaultRealm, nil
+	}
+}
+
+// RestrictRealms wraps a resolver so that only the given realms can be used
+func RestrictRealms(resolver RealmResolver, realms ...string) RealmResolver {
+	return func(ctx context.Context) (string, error) {
+		realm, err := resolver(ctx)
+		if err != nil {
+			return "", err
+		}
+		if !slices.Contains(realms, realm) {
+			return "", fmt.Errorf("%w: %v", ErrRealmNotAllowed, realm)
+		}
+		return realm, nil
+	}
+}
+
+// Realms whose managers a router keeps by default, see SetMaxCachedRealms
+const DefaultMaxCachedRealms = 100
+
+// KeycloakRealmRouter is a user and group manager that serves many realms through one
+// session. Every call is routed to the realm picked by the resolver.
+type KeycloakRealmRouter struct {
+	session  *KeycloakSession
+	resolver RealmResolver
+
+	mu          sync.Mutex
+	maxRealms   int
+	schema      *AttributeSchema
+	groupSchema *AttributeSchema
+	reconcile   *ReconcileOptions
+	users       map[string]*KeycloakUserManager
+	groups      map[string]*KeycloakGroupManager
+	roles       map[string]*KeycloakRoleManager
+}
+
+// NewKeycloakRealmRouter creates a router, a nil resolver uses the realm from the context
+// and falls back to the session's realm
+func NewKeycloakRealmRouter(session *KeycloakSession, resolver RealmResolver) *KeycloakRealmRouter {
+	if resolver == nil {
+		resolver = ContextRealmResolver(session.Realm())
+	}
+	return &KeycloakRealmRouter{
+		session:   session,
+		resolver:  resolver,
+		maxRealms: DefaultMaxCachedRealms,
+		users:     make(map[string]*KeycloakUserManager),
+		groups:    make(map[string]*KeycloakGroupManager),
+		roles:     make(map[string]*KeycloakRoleManager),
+	}
+}
+
+func (r *KeycloakRealmRouter) Session() *KeycloakSession {
+	return r.session
+}
+
+// SetMaxCachedRealms limits the realms whose managers are kept between calls. Without a
+// restricted resolver any realm name can be asked for, so managers for realms past the limit
+// are created for each call and not kept. Zero or less keeps none
+func (r *KeycloakRealmRouter) SetMaxCachedRealms(max int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.maxRealms = max
+}
+
+// SetAttributeSchema sets the attribute schema of every realm's user manager, and the
+// one the group and role managers map users with
+func (r *KeycloakRealmRouter) SetAttributeSchema(schema *AttributeSchema) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schema = schema
+	for _, um := range r.users {
+		um.SetAttributeSchema(schema)
+	}
+	for _, gm := range r.groups {
+		gm.SetUserAttributeSchema(schema)
+	}
+	for _, rm := range r.roles {
+		rm.SetUserAttributeSchema(schema)
+	}
+}
+
+// SetReconcileOnConnect makes every realm's user manager reconcile its user profile on its
+// first call, see KeycloakUserManager.SetReconcileOnConnect
+func (r *KeycloakRealmRouter) SetReconcileOnConnect(opts *ReconcileOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reconcile = opts
+	for _, um := range r.users {
+		um.SetReconcileOnConnect(opts)
+	}
+}
+
+// SetGroupAttributeSchema sets the group attribute schema of every realm's group manager,
+// and the one the role managers map groups with
+func (r *KeycloakRealmRouter) SetGroupAttributeSchema(schema *AttributeSchema) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.groupSchema = schema
+	for _, gm := range r.groups {
+		gm.SetAttributeSchema(schema)
+	}
+	for _, rm := range r.roles {
+		rm.SetGroupAttributeSchema(schema)
+	}
+}
+
+// UserManager returns the user manager for a realm, creating it on first use
+func (r *KeycloakRealmRouter) UserManager(realm string) *KeycloakUserManager {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return cachedManager(r.users, r.maxRealms, realm, func() *KeycloakUserManager {
+		um := NewKeycloakUserManagerForRealm(r.session, realm)
+		um.SetAttributeSchema(r.schema)
+		um.SetReconcileOnConnect(r.reconcile)
+		return um
+	})
+}
+
+// GroupManager returns the group manager for a realm, creating it on first use
+func (r *KeycloakRealmRouter) GroupManager(realm string) *KeycloakGroupManager {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return cachedManager(r.groups, r.maxRealms, realm, func() *KeycloakGroupManager {
+		gm := NewGroupManagerForRealm(r.session, realm)
+		gm.SetAttributeSchema(r.groupSchema)
+		gm.SetUserAttributeSchema(r.schema)
+		return gm
+	})
+}
+
+// RoleManager returns the role manager for a realm, creating it on first use
+func (r *KeycloakRealmRouter) RoleManager(realm string) *KeycloakRoleManager {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return cachedManager(r.roles, r.maxRealms, realm, func() *KeycloakRoleManager {
+		rm := NewRoleManagerForRealm(r.session, realm)
+		rm.SetUserAttributeSchema(r.schema)
+		rm.SetGroupAttributeSchema(r.groupSchema)
+		return rm
+	})
+}
+
+// cachedManager returns the manager kept for a realm, or a new one that is kept while there
+// is room for it
+func cachedManager[M any](cache map[string]M, max int, realm string, create func() M) M {
+	if m, ok := cache[realm]; ok {
+		return m
+	}
+	m := create()
+	if len(cache) < max {
+		cache[realm] = m
+	}
+	return m
+}
+
+// Users returns the user manager for the realm of the call
+func (r *KeycloakRealmRouter) Users(ctx context.Context) (*KeycloakUserManager, error) {
+	realm, err := r.resolver(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.UserManager(realm), nil
+}
+
+// Groups returns the group manager for the realm of the call
+func (r *KeycloakRealmRouter) Groups(ctx context.Context) (*KeycloakGroupManager, error) {
+	realm, err := r.resolver(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.GroupManager(realm), nil
+}
+
+// Roles returns the role manager for the realm of the call
+func (r *KeycloakRealmRouter) Roles(ctx context.Context) (*KeycloakRoleManager, error) {
+	realm, err := r.resolver(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.RoleManager(realm), nil
+}
+
+// ListRealms returns the names of all realms visible to the session
+func (r *KeycloakRealmRouter) ListRealms(ctx context.Context) ([]string, error) {
+	found, err := withToken(ctx, r.session, func(token string) ([]*gocloak.RealmRepresentation, error) {
+		return r.session.Client().GetRealms(ctx, token)
+	})
+	if err != nil {
+		return nil, err
+	}
+	rtn := make([]string, 0, len(found))
+	for _, realm := range found {
+		rtn = append(rtn, str(realm.Realm, ""))
+	}
+	return rtn, nil
+}
+
+/// ------------- USER MANAGER
+
+func (r *KeycloakRealmRouter) ForceUserName(ctx context.Context, name string) (string, bool, error) {
+	um, err := r.Users(ctx)
+	if err != nil {
+		return name, false, err
+	}
+	return um.ForceUserName(ctx, name)
+}
+
+func (r *KeycloakRealmRouter) ListUsers(ctx context.Context, filter string, attrs []string) (*[]models.User, error) {
+	um, err := r.Users(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return um.ListUsers(ctx, filter, attrs)
+}
+
+func (r *KeycloakRealmRouter) GetUser(ctx context.Context, uid string) (*models.User, error) {
+	um, err := r.Users(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return um.GetUser(ctx, uid)
+}
+
+func (r *KeycloakRealmRouter) GetUserByEmail(ctx context.Context, email string, opts *cloudy.UserOptions) (*models.User, error) {
+	um, err := r.Users(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return um.GetUserByEmail(ctx, email, opts)
+}
+
+func (r *KeycloakRealmRouter) GetUserWithAttributes(ctx context.Context, uid string, attrs []string) (*models.User, error) {
+	um, err := r.Users(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return um.GetUserWithAttributes(ctx, uid, attrs)
+}
+
+func (r *KeycloakRealmRouter) NewUser(ctx context.Context, newUser *models.User) (*models.User, error) {
+	um, err := r.Users(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return um.NewUser(ctx, newUser)
+}
+
+func (r *KeycloakRealmRouter) UpdateUser(ctx context.Context, usr *models.User) error {
+	um, err := r.Users(ctx)
+	if err != nil {
+		return err
+	}
+	return um.UpdateUser(ctx, usr)
+}
+
+func (r *KeycloakRealmRouter) Enable(ctx context.Context, uid string) error {
+	um, err := r.Users(ctx)
+	if err != nil {
+		return err
+	}
+	return um.Enable(ctx, uid)
+}
+
+func (r *KeycloakRealmRouter) Disable(ctx context.Context, uid string) error {
+	um, err := r.Users(ctx)
+	if err != nil {
+		return err
+	}
+	return um.Disable(ctx, uid)
+}
+
+func (r *KeycloakRealmRouter) DeleteUser(ctx context.Context, uid string) error {
+	um, err := r.Users(ctx)
+	if err != nil {
+		return err
+	}
+	return um.DeleteUser(ctx, uid)
+}
+
+func (r *KeycloakRealmRouter) SetUserPassword(ctx context.Context, uid string, pwd string, mustChange bool) error {
+	um, err := r.Users(ctx)
+	if err != nil {
+		return err
+	}
+	return um.SetUserPassword(ctx, uid, pwd, mustChange)
+}
+
+/// ------------- GROUP MANAGER
+
+func (r *KeycloakRealmRouter) ListGroups(ctx context.Context, filter string, attrs []string) (*[]models.Group, error) {
+	gm, err := r.Groups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return gm.ListGroups(ctx, filter, attrs)
+}
+
+func (r *KeycloakRealmRouter) GetGroup(ctx context.Context, id string) (*models.Group, error) {
+	gm, err := r.Groups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return gm.GetGroup(ctx, id)
+}
+
+func (r *KeycloakRealmRouter) GetGroupId(ctx context.Context, name string) (string, error) {
+	gm, err := r.Groups(ctx)
+	if err != nil {
+		return "", err
+	}
+	return gm.GetGroupId(ctx, name)
+}
+
+func (r *KeycloakRealmRouter) GetUserGroups(ctx context.Context, uid string) ([]*models.Group, error) {
+	gm, err := r.Groups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return gm.GetUserGroups(ctx, uid)
+}
+
+func (r *KeycloakRealmRouter) NewGroup(ctx context.Context, grp *models.Group) (*models.Group, error) {
+	gm, err := r.Groups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return gm.NewGroup(ctx, grp)
+}
+
+func (r *KeycloakRealmRouter) UpdateGroup(ctx context.Context, grp *models.Group) (bool, error) {
+	gm, err := r.Groups(ctx)
+	if err != nil {
+		return false, err
+	}
+	return gm.UpdateGroup(ctx, grp)
+}
+
+func (r *KeycloakRealmRouter) GetGroupMembers(ctx context.Context, grpId string) ([]*models.User, error) {
+	gm, err := r.Groups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return gm.GetGroupMembers(ctx, grpId)
+}
+
+func (r *KeycloakRealmRouter) RemoveMembers(ctx context.Context, groupId string, userIds []string) error {
+	gm, err := r.Groups(ctx)
+	if err != nil {
+		return err
+	}
+	return gm.RemoveMembers(ctx, groupId, userIds)
+}
+
+func (r *KeycloakRealmRouter) AddMembers(ctx context.Context, groupId string, userIds []string) error {
+	gm, err := r.Groups(ctx)
+	if err != nil {
+		return err
+	}
+	return gm.AddMembers(ctx, groupId, userIds)
+}
+
+func (r *KeycloakRealmRouter) DeleteGroup(ctx context.Context, groupId string) error {
+	gm, err := r.Groups(ctx)
+	if err != nil {
+		return err
+	}
+	return gm.DeleteGroup(ctx, groupId)
+}
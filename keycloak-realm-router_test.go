@@ -0,0 +1,78 @@
+package keycloak
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRealmRouterResolve(t *testing.T) {
+	ctx := context.Background()
+	session := NewKeycloakSession("http://localhost:8080", "adminuser", "admin", "master")
+	router := NewKeycloakRealmRouter(session, nil)
+
+	um, err := router.Users(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "master", um.Realm())
+
+	um, err = router.Users(WithRealm(ctx, "acme"))
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", um.Realm())
+	assert.Same(t, um, router.UserManager("acme"))
+	assert.Same(t, session, um.Session())
+
+	gm, err := router.Groups(WithRealm(ctx, "acme"))
+	assert.NoError(t, err)
+	assert.Equal(t, "acme", gm.Realm())
+
+	// Managers of realms past the limit are not kept
+	router.SetMaxCachedRealms(3)
+	um, err = router.Users(WithRealm(ctx, "other"))
+	assert.NoError(t, err)
+	assert.Equal(t, "other", um.Realm())
+	assert.Same(t, um, router.UserManager("other"))
+	um, err = router.Users(WithRealm(ctx, "random"))
+	assert.NoError(t, err)
+	assert.Equal(t, "random", um.Realm())
+	assert.NotSame(t, um, router.UserManager("random"))
+	assert.Len(t, router.users, 3)
+	assert.Same(t, router.UserManager("acme"), router.UserManager("acme"))
+
+	strict := NewKeycloakRealmRouter(session, ContextRealmResolver(""))
+	_, err = strict.Users(ctx)
+	assert.ErrorIs(t, err, ErrNoRealm)
+	_, err = strict.GetUser(ctx, "some-id")
+	assert.ErrorIs(t, err, ErrNoRealm)
+}
+
+func TestRealmRouterSchemas(t *testing.T) {
+	session := NewKeycloakSession("http://localhost:8080", "adminuser", "admin", "master")
+	router := NewKeycloakRealmRouter(session, nil)
+	um := router.UserManager("acme")
+	gm := router.GroupManager("acme")
+	rm := router.RoleManager("acme")
+
+	// Managers in use pick up new schemas, run with -race to check it is safe
+	schema := NewAttributeSchema(&Attribute{Name: "Badge"})
+	groupSchema := NewAttributeSchema(&Attribute{Name: "Code"})
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			_ = um.AttributeSchema().Names()
+			_ = gm.AttributeSchema().Names()
+			_ = rm.userSchema.Load().Names()
+		}
+		close(done)
+	}()
+	router.SetAttributeSchema(schema)
+	router.SetGroupAttributeSchema(groupSchema)
+	<-done
+
+	assert.Same(t, schema, um.AttributeSchema())
+	assert.Same(t, schema, gm.UserAttributeSchema())
+	assert.Same(t, schema, rm.userSchema.Load())
+	assert.Same(t, groupSchema, gm.AttributeSchema())
+	assert.Same(t, groupSchema, rm.groupSchema.Load())
+	assert.Same(t, schema, router.UserManager("other").AttributeSchema())
+}
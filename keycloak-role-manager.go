@@ -0,0 +1,558 @@
+package keycloak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/models"
+)
+
+var ErrRoleNotFound = errors.New("role not found")
+
+// Role is a realm role, shaped like the cloudy user and group models
+type Role struct {
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Composite roles grant the roles they are made of, see GetCompositeRoles
+	Composite bool `json:"composite,omitempty"`
+	// Values are encoded like user attributes, see GetAttributeValues
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	// The *gocloak.Role the role was read from
+	Extra interface{} `json:"extra,omitempty"`
+}
+
+// KeycloakRoleManager manages the realm roles of one realm. It shares the session of the
+// user and group managers
+type KeycloakRoleManager struct {
+	session *KeycloakSession
+	realm   string
+	client  *gocloak.GoCloak
+	// Maps the attributes of the users holding a role, like the user manager's schema
+	userSchema atomic.Pointer[AttributeSchema]
+	// Maps the attributes of the groups holding a role, like the group manager's schema
+	groupSchema atomic.Pointer[AttributeSchema]
+}
+
+// NewRoleManagerFromSession creates a role manager that shares the login of the given session
+func NewRoleManagerFromSession(session *KeycloakSession) *KeycloakRoleManager {
+	return NewRoleManagerForRealm(session, session.Realm())
+}
+
+// NewRoleManagerForRealm creates a role manager for any realm the session is allowed to manage
+func NewRoleManagerForRealm(session *KeycloakSession, realm string) *KeycloakRoleManager {
+	rm := &KeycloakRoleManager{
+		session: session,
+		realm:   realm,
+		client:  session.Client(),
+	}
+	rm.userSchema.Store(DefaultAttributeSchema())
+	rm.groupSchema.Store(DefaultGroupAttributeSchema())
+	return rm
+}
+
+func (rm *KeycloakRoleManager) Realm() string {
+	return rm.realm
+}
+
+func (rm *KeycloakRoleManager) Session() *KeycloakSession {
+	return rm.session
+}
+
+// SetUserAttributeSchema replaces the user attributes mapped by GetRoleUsers. Use the
+// schema of the user manager. A nil schema restores DefaultAttributeSchema
+func (rm *KeycloakRoleManager) SetUserAttributeSchema(schema *AttributeSchema) {
+	if schema == nil {
+		schema = DefaultAttributeSchema()
+	}
+	rm.userSchema.Store(schema)
+}
+
+// SetGroupAttributeSchema replaces the group attributes mapped by GetRoleGroups. Use the
+// schema of the group manager. A nil schema restores DefaultGroupAttributeSchema
+func (rm *KeycloakRoleManager) SetGroupAttributeSchema(schema *AttributeSchema) {
+	if schema == nil {
+		schema = DefaultGroupAttributeSchema()
+	}
+	rm.groupSchema.Store(schema)
+}
+
+func (rm *KeycloakRoleManager) connect(ctx context.Context) error {
+	return rm.session.Connect(ctx)
+}
+
+/// ------------- ROLES
+
+// ListRoles lists the realm roles whose name contains search, an empty search lists them all
+func (rm *KeycloakRoleManager) ListRoles(ctx context.Context, search string) ([]*Role, error) {
+	err := rm.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rtn []*Role
+	nextPage := &PageRequest{First: 0, Max: PageSize}
+	for nextPage != nil {
+		params := gocloak.GetRoleParams{
+			First:               cloudy.IntP(nextPage.First),
+			Max:                 cloudy.IntP(nextPage.Max),
+			BriefRepresentation: cloudy.BoolP(false),
+		}
+		if search != "" {
+			params.Search = &search
+		}
+		found, err := withToken(ctx, rm.session, func(token string) ([]*gocloak.Role, error) {
+			return rm.client.GetRealmRoles(ctx, token, rm.realm, params)
+		})
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, rolesToCloudy(found)...)
+		nextPage = nextGroupPage(nextPage, len(found))
+	}
+	return rtn, nil
+}
+
+// GetRole returns a realm role by name, nil when there is none
+func (rm *KeycloakRoleManager) GetRole(ctx context.Context, name string) (*Role, error) {
+	err := rm.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	found, err := rm.getRole(ctx, name)
+	if Is404(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return RoleToCloudy(found), nil
+}
+
+// NewRole creates a realm role, returning it with its id
+func (rm *KeycloakRoleManager) NewRole(ctx context.Context, role *Role) (*Role, error) {
+	err := rm.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = rm.session.Do(ctx, func(token string) error {
+		_, err := rm.client.CreateRealmRole(ctx, token, rm.realm, *RoleToKeycloak(role))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Keycloak answers with the role's name, not its id
+	found, err := rm.getRole(ctx, role.Name)
+	if err != nil {
+		return nil, err
+	}
+	return RoleToCloudy(found), nil
+}
+
+// UpdateRole updates the realm role called name. The role may have a new name. An empty
+// name or description keeps the current one, and only the attributes the role lists are
+// changed, an empty value removes one. Composites are changed with AddCompositeRoles
+func (rm *KeycloakRoleManager) UpdateRole(ctx context.Context, name string, role *Role) error {
+	err := rm.connect(ctx)
+	if err != nil {
+		return err
+	}
+	current, err := rm.getRole(ctx, name)
+	if err != nil {
+		return err
+	}
+	merged := mergeRole(current, role)
+	return rm.session.Do(ctx, func(token string) error {
+		return rm.client.UpdateRealmRole(ctx, token, rm.realm, name, *merged)
+	})
+}
+
+func (rm *KeycloakRoleManager) DeleteRole(ctx context.Context, name string) error {
+	err := rm.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return rm.session.Do(ctx, func(token string) error {
+		return rm.client.DeleteRealmRole(ctx, token, rm.realm, name)
+	})
+}
+
+/// ------------- COMPOSITES
+
+// GetCompositeRoles returns the realm roles a composite role is made of
+func (rm *KeycloakRoleManager) GetCompositeRoles(ctx context.Context, name string) ([]*Role, error) {
+	err := rm.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	found, err := withToken(ctx, rm.session, func(token string) ([]*gocloak.Role, error) {
+		return rm.client.GetCompositeRealmRoles(ctx, token, rm.realm, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rolesToCloudy(found), nil
+}
+
+// AddCompositeRoles makes the role grant the given roles as well, turning it into a composite
+func (rm *KeycloakRoleManager) AddCompositeRoles(ctx context.Context, name string, roles ...string) error {
+	return rm.withRoles(ctx, roles, func(token string, found []gocloak.Role) error {
+		return rm.client.AddRealmRoleComposite(ctx, token, rm.realm, name, found)
+	})
+}
+
+func (rm *KeycloakRoleManager) RemoveCompositeRoles(ctx context.Context, name string, roles ...string) error {
+	return rm.withRoles(ctx, roles, func(token string, found []gocloak.Role) error {
+		return rm.client.DeleteRealmRoleComposite(ctx, token, rm.realm, name, found)
+	})
+}
+
+/// ------------- ASSIGNMENTS
+
+// AssignUserRoles grants realm roles to a user. Roles the user already has are kept as is
+func (rm *KeycloakRoleManager) AssignUserRoles(ctx context.Context, uid string, roles ...string) error {
+	return rm.withRoles(ctx, roles, func(token string, found []gocloak.Role) error {
+		return rm.client.AddRealmRoleToUser(ctx, token, rm.realm, uid, found)
+	})
+}
+
+func (rm *KeycloakRoleManager) UnassignUserRoles(ctx context.Context, uid string, roles ...string) error {
+	return rm.withRoles(ctx, roles, func(token string, found []gocloak.Role) error {
+		return rm.client.DeleteRealmRoleFromUser(ctx, token, rm.realm, uid, found)
+	})
+}
+
+// AssignGroupRoles grants realm roles to every member of a group and its subgroups
+func (rm *KeycloakRoleManager) AssignGroupRoles(ctx context.Context, groupId string, roles ...string) error {
+	return rm.withRoles(ctx, roles, func(token string, found []gocloak.Role) error {
+		return rm.client.AddRealmRoleToGroup(ctx, token, rm.realm, groupId, found)
+	})
+}
+
+func (rm *KeycloakRoleManager) UnassignGroupRoles(ctx context.Context, groupId string, roles ...string) error {
+	return rm.withRoles(ctx, roles, func(token string, found []gocloak.Role) error {
+		return rm.client.DeleteRealmRoleFromGroup(ctx, token, rm.realm, groupId, found)
+	})
+}
+
+// GetUserRoles returns the realm roles assigned to the user directly
+func (rm *KeycloakRoleManager) GetUserRoles(ctx context.Context, uid string) ([]*Role, error) {
+	return rm.listRoles(ctx, func(token string) ([]*gocloak.Role, error) {
+		return rm.client.GetRealmRolesByUserID(ctx, token, rm.realm, uid)
+	})
+}
+
+// GetEffectiveUserRoles returns every realm role the user has, directly, through their
+// groups or through composite roles
+func (rm *KeycloakRoleManager) GetEffectiveUserRoles(ctx context.Context, uid string) ([]*Role, error) {
+	return rm.listRoles(ctx, func(token string) ([]*gocloak.Role, error) {
+		return rm.client.GetCompositeRealmRolesByUserID(ctx, token, rm.realm, uid)
+	})
+}
+
+// GetGroupRoles returns the realm roles assigned to the group directly
+func (rm *KeycloakRoleManager) GetGroupRoles(ctx context.Context, groupId string) ([]*Role, error) {
+	return rm.listRoles(ctx, func(token string) ([]*gocloak.Role, error) {
+		return rm.client.GetRealmRolesByGroupID(ctx, token, rm.realm, groupId)
+	})
+}
+
+// GetRoleUsers returns the users the role is assigned to directly. Users who get it from a
+// group or a composite role are not included, see GetEffectiveRoleUsers
+func (rm *KeycloakRoleManager) GetRoleUsers(ctx context.Context, name string) ([]*models.User, error) {
+	err := rm.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var rtn []*models.User
+	nextPage := &PageRequest{First: 0, Max: PageSize}
+	for nextPage != nil {
+		params := gocloak.GetUsersByRoleParams{
+			First: cloudy.IntP(nextPage.First),
+			Max:   cloudy.IntP(nextPage.Max),
+		}
+		found, err := withToken(ctx, rm.session, func(token string) ([]*gocloak.User, error) {
+			return rm.client.GetUsersByRoleName(ctx, token, rm.realm, name, params)
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range found {
+			rtn = append(rtn, rm.userSchema.Load().ToCloudy(u))
+		}
+		nextPage = nextGroupPage(nextPage, len(found))
+	}
+	return rtn, nil
+}
+
+// GetRoleGroups returns the groups the role is assigned to directly
+func (rm *KeycloakRoleManager) GetRoleGroups(ctx context.Context, name string) ([]*models.Group, error) {
+	err := rm.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// gocloak's GetGroupsByRole sends no paging, so Keycloak returns only its first page
+	var rtn []*models.Group
+	nextPage := &PageRequest{First: 0, Max: PageSize}
+	for nextPage != nil {
+		page := nextPage
+		found, err := withToken(ctx, rm.session, func(token string) ([]*gocloak.Group, error) {
+			var found []*gocloak.Group
+			resp, err := rm.client.GetRequestWithBearerAuth(ctx, token).
+				SetQueryParams(map[string]string{
+					"first":               strconv.Itoa(page.First),
+					"max":                 strconv.Itoa(page.Max),
+					"briefRepresentation": "false",
+				}).
+				SetResult(&found).
+				Get(rm.session.adminURL(rm.realm, "roles", name, "groups"))
+			if err := checkResponse(resp, err, "could not get groups by role"); err != nil {
+				return nil, err
+			}
+			return found, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range found {
+			rtn = append(rtn, rm.groupSchema.Load().GroupToCloudy(g))
+		}
+		nextPage = nextGroupPage(nextPage, len(found))
+	}
+	return rtn, nil
+}
+
+// GetEffectiveRoleUsers returns every user holding the role: directly, as a member of a group
+// it is assigned to or of one of that group's subgroups, or through a composite role that
+// includes it. Each user is listed once, group members in their brief form
+func (rm *KeycloakRoleManager) GetEffectiveRoleUsers(ctx context.Context, name string) ([]*models.User, error) {
+	holders, err := rm.grantingRoles(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	gm := NewGroupManagerForRealm(rm.session, rm.realm)
+	gm.SetAttributeSchema(rm.groupSchema.Load())
+	gm.SetUserAttributeSchema(rm.userSchema.Load())
+
+	var rtn []*models.User
+	seen := make(map[string]bool)
+	add := func(u *models.User) {
+		if !seen[u.UID] {
+			seen[u.UID] = true
+			rtn = append(rtn, u)
+		}
+	}
+	visited := make(map[string]bool)
+	for _, holder := range holders {
+		users, err := rm.GetRoleUsers(ctx, holder)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range users {
+			add(u)
+		}
+
+		groups, err := rm.GetRoleGroups(ctx, holder)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			if visited[g.ID] {
+				continue
+			}
+			visited[g.ID] = true
+			members, err := gm.GetEffectiveGroupMembers(ctx, g.ID, nil)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range members {
+				add(m.User)
+			}
+		}
+	}
+	return rtn, nil
+}
+
+// grantingRoles returns the role and every composite realm role that includes it, directly
+// or through other composites. Roles are matched by id, so client roles of the same name
+// are not mistaken for it
+func (rm *KeycloakRoleManager) grantingRoles(ctx context.Context, name string) ([]string, error) {
+	err := rm.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	role, err := rm.getRole(ctx, name)
+	if Is404(err) {
+		return nil, fmt.Errorf("%w: %v", ErrRoleNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	roles, err := rm.ListRoles(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	// Composite roles by the id of each role they include
+	parents := make(map[string][]*Role)
+	for _, r := range roles {
+		if !r.Composite {
+			continue
+		}
+		parts, err := rm.GetCompositeRoles(ctx, r.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range parts {
+			parents[part.ID] = append(parents[part.ID], r)
+		}
+	}
+
+	rtn := []string{str(role.Name, name)}
+	seen := map[string]bool{str(role.ID, ""): true}
+	queue := []string{str(role.ID, "")}
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		for _, parent := range parents[id] {
+			if seen[parent.ID] {
+				continue
+			}
+			seen[parent.ID] = true
+			rtn = append(rtn, parent.Name)
+			queue = append(queue, parent.ID)
+		}
+	}
+	return rtn, nil
+}
+
+func (rm *KeycloakRoleManager) getRole(ctx context.Context, name string) (*gocloak.Role, error) {
+	return withToken(ctx, rm.session, func(token string) (*gocloak.Role, error) {
+		return rm.client.GetRealmRole(ctx, token, rm.realm, name)
+	})
+}
+
+func (rm *KeycloakRoleManager) listRoles(ctx context.Context, fn func(token string) ([]*gocloak.Role, error)) ([]*Role, error) {
+	err := rm.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	found, err := withToken(ctx, rm.session, fn)
+	if err != nil {
+		return nil, err
+	}
+	return rolesToCloudy(found), nil
+}
+
+// withRoles looks up the named roles, which Keycloak needs with their ids, and calls fn
+// with them. Unknown names fail with ErrRoleNotFound before anything is changed
+func (rm *KeycloakRoleManager) withRoles(ctx context.Context, names []string, fn func(token string, roles []gocloak.Role) error) error {
+	err := rm.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	roles := make([]gocloak.Role, len(names))
+	for i, name := range names {
+		found, err := rm.getRole(ctx, name)
+		if Is404(err) {
+			return fmt.Errorf("%w: %v", ErrRoleNotFound, name)
+		}
+		if err != nil {
+			return err
+		}
+		roles[i] = gocloak.Role{ID: found.ID, Name: found.Name}
+	}
+	return rm.session.Do(ctx, func(token string) error {
+		return fn(token, roles)
+	})
+}
+
+func RoleToCloudy(r *gocloak.Role) *Role {
+	role := &Role{
+		ID:          str(r.ID, ""),
+		Name:        str(r.Name, ""),
+		Description: str(r.Description, ""),
+		Composite:   r.Composite != nil && *r.Composite,
+		Source:      "Keycloak",
+		Extra:       r,
+	}
+	if r.Attributes != nil && len(*r.Attributes) > 0 {
+		role.Attributes = make(map[string]string)
+		for name, values := range *r.Attributes {
+			if val := attributeToCloudy(nil, values); val != "" {
+				role.Attributes[name] = val
+			}
+		}
+	}
+	return role
+}
+
+func RoleToKeycloak(r *Role) *gocloak.Role {
+	role := &gocloak.Role{
+		Name:        &r.Name,
+		Description: &r.Description,
+	}
+	if r.ID != "" {
+		role.ID = &r.ID
+	}
+	if r.Attributes != nil {
+		attrs := make(map[string][]string, len(r.Attributes))
+		for name, val := range r.Attributes {
+			attrs[name] = attributeToKeycloak(nil, val)
+		}
+		role.Attributes = &attrs
+	}
+	return role
+}
+
+// mergeRole applies a role to the role Keycloak has, keeping what the update leaves empty
+func mergeRole(current *gocloak.Role, r *Role) *gocloak.Role {
+	merged := *current
+	if r.Name != "" {
+		merged.Name = &r.Name
+	}
+	if r.Description != "" {
+		merged.Description = &r.Description
+	}
+	if len(r.Attributes) == 0 {
+		return &merged
+	}
+	attrs := make(map[string][]string)
+	if current.Attributes != nil {
+		for name, values := range *current.Attributes {
+			attrs[name] = values
+		}
+	}
+	for name, val := range r.Attributes {
+		if val == "" {
+			delete(attrs, name)
+			continue
+		}
+		attrs[name] = attributeToKeycloak(nil, val)
+	}
+	merged.Attributes = &attrs
+	return &merged
+}
+
+func rolesToCloudy(found []*gocloak.Role) []*Role {
+	rtn := make([]*Role, len(found))
+	for i, r := range found {
+		rtn[i] = RoleToCloudy(r)
+	}
+	return rtn
+}
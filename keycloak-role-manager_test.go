@@ -0,0 +1,342 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRoles struct {
+	mu    sync.Mutex
+	roles map[string]*gocloak.Role
+	// Realm roles of each user, by name
+	users map[string]map[string]bool
+	// Roles making up each composite role
+	composites map[string][]string
+	// Groups each role is assigned to, and the members and subgroups of each group
+	groups   map[string][]string
+	members  map[string][]string
+	children map[string][]string
+}
+
+func (f *fakeRoles) userRoles(uid string, effective bool) []*gocloak.Role {
+	rtn := []*gocloak.Role{}
+	seen := map[string]bool{}
+	var add func(name string)
+	add = func(name string) {
+		if seen[name] {
+			return
+		}
+		seen[name] = true
+		rtn = append(rtn, f.roles[name])
+		if effective {
+			for _, c := range f.composites[name] {
+				add(c)
+			}
+		}
+	}
+	for _, name := range sortedKeys(f.users[uid]) {
+		add(name)
+	}
+	return rtn
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	var rtn []string
+	for k := range m {
+		rtn = append(rtn, k)
+	}
+	sort.Strings(rtn)
+	return rtn
+}
+
+func newFakeRoleServer(t *testing.T) (*KeycloakRoleManager, *fakeRoles) {
+	fake := &fakeRoles{
+		roles: map[string]*gocloak.Role{
+			"viewer": {ID: gocloak.StringP("id-viewer"), Name: gocloak.StringP("viewer")},
+			"editor": {ID: gocloak.StringP("id-editor"), Name: gocloak.StringP("editor"), Composite: gocloak.BoolP(true)},
+			"owner":  {ID: gocloak.StringP("id-owner"), Name: gocloak.StringP("owner"), Composite: gocloak.BoolP(true)},
+			"crowd":  {ID: gocloak.StringP("id-crowd"), Name: gocloak.StringP("crowd")},
+		},
+		users:      map[string]map[string]bool{"alice": {}, "bob": {"editor": true}},
+		composites: map[string][]string{"editor": {"viewer"}, "owner": {"editor"}},
+		groups:     map[string][]string{"viewer": {"readers"}, "owner": {"owners"}},
+		members:    map[string][]string{"readers": {"carol"}, "interns": {"dave", "carol"}, "owners": {"erin"}},
+		children:   map[string][]string{"readers": {"interns"}},
+	}
+
+	mux, session := fakeKeycloak(t)
+	fakeServerInfo(mux, "24.0.4")
+	mux.HandleFunc("/admin/realms/master/roles", func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		if r.Method == http.MethodGet {
+			roles := []*gocloak.Role{}
+			if r.URL.Query().Get("first") == "0" {
+				for _, name := range sortedKeys(fake.roles) {
+					roles = append(roles, fake.roles[name])
+				}
+			}
+			writeJSON(w, roles)
+			return
+		}
+		var role gocloak.Role
+		_ = json.NewDecoder(r.Body).Decode(&role)
+		role.ID = gocloak.StringP("id-" + *role.Name)
+		fake.roles[*role.Name] = &role
+		w.Header().Set("Location", r.URL.String()+"/"+*role.Name)
+		w.WriteHeader(http.StatusCreated)
+	})
+	mux.HandleFunc("/admin/realms/master/roles/", func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/realms/master/roles/"), "/")
+		role, ok := fake.roles[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if rest == "users" {
+			users := []gocloak.User{}
+			if r.URL.Query().Get("first") == "0" {
+				for _, uid := range sortedKeys(fake.users) {
+					if fake.users[uid][name] {
+						users = append(users, gocloak.User{
+							ID:         gocloak.StringP(uid),
+							Username:   gocloak.StringP(uid),
+							Attributes: &map[string][]string{"Badge": {"B-" + uid}},
+						})
+					}
+				}
+			}
+			writeJSON(w, users)
+			return
+		}
+		if rest == "composites" {
+			roles := []*gocloak.Role{}
+			for _, c := range fake.composites[name] {
+				roles = append(roles, fake.roles[c])
+			}
+			writeJSON(w, roles)
+			return
+		}
+		if rest == "groups" && name != "crowd" {
+			groups := []gocloak.Group{}
+			if r.URL.Query().Get("first") == "0" {
+				for _, id := range fake.groups[name] {
+					groups = append(groups, fakeRoleGroup(id))
+				}
+			}
+			writeJSON(w, groups)
+			return
+		}
+		if rest == "groups" {
+			// More groups than fit on one page
+			first, _ := strconv.Atoi(r.URL.Query().Get("first"))
+			max, _ := strconv.Atoi(r.URL.Query().Get("max"))
+			groups := []gocloak.Group{}
+			for i := first; i < 150 && i < first+max; i++ {
+				groups = append(groups, gocloak.Group{
+					ID:         gocloak.StringP(fmt.Sprintf("group-%v", i)),
+					Attributes: &map[string][]string{"Code": {fmt.Sprintf("G%v", i)}, "Secret": {"s"}},
+				})
+			}
+			writeJSON(w, groups)
+			return
+		}
+		if r.Method == http.MethodPut {
+			var updated gocloak.Role
+			_ = json.NewDecoder(r.Body).Decode(&updated)
+			delete(fake.roles, name)
+			fake.roles[*updated.Name] = &updated
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, role)
+	})
+	mux.HandleFunc("/admin/realms/master/users/", func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		uid, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/realms/master/users/"), "/")
+		switch {
+		case rest == "role-mappings/realm/composite":
+			writeJSON(w, fake.userRoles(uid, true))
+		case rest == "role-mappings/realm" && r.Method == http.MethodGet:
+			writeJSON(w, fake.userRoles(uid, false))
+		case rest == "role-mappings/realm":
+			var roles []gocloak.Role
+			_ = json.NewDecoder(r.Body).Decode(&roles)
+			for _, role := range roles {
+				if r.Method == http.MethodPost {
+					fake.users[uid][*role.Name] = true
+				} else {
+					delete(fake.users[uid], *role.Name)
+				}
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	mux.HandleFunc("/admin/realms/master/groups/", func(w http.ResponseWriter, r *http.Request) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		id, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/realms/master/groups/"), "/")
+		firstPage := r.URL.Query().Get("first") == "0"
+		switch rest {
+		case "":
+			writeJSON(w, fakeRoleGroup(id))
+		case "members":
+			users := []gocloak.User{}
+			for _, uid := range fake.members[id] {
+				users = append(users, gocloak.User{ID: gocloak.StringP(uid), Username: gocloak.StringP(uid)})
+			}
+			if !firstPage {
+				users = users[:0]
+			}
+			writeJSON(w, users)
+		case "children":
+			groups := []gocloak.Group{}
+			for _, child := range fake.children[id] {
+				groups = append(groups, fakeRoleGroup(child))
+			}
+			if !firstPage {
+				groups = groups[:0]
+			}
+			writeJSON(w, groups)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	return NewRoleManagerFromSession(session), fake
+}
+
+func fakeRoleGroup(id string) gocloak.Group {
+	return gocloak.Group{ID: gocloak.StringP(id), Name: gocloak.StringP(id), Path: gocloak.StringP("/" + id)}
+}
+
+func TestRoleManager(t *testing.T) {
+	ctx := context.Background()
+	rm, fake := newFakeRoleServer(t)
+
+	role, err := rm.GetRole(ctx, "missing")
+	assert.NoError(t, err)
+	assert.Nil(t, role)
+
+	role, err = rm.NewRole(ctx, &Role{Name: "auditor", Description: "Reads the logs"})
+	assert.NoError(t, err)
+	assert.Equal(t, "id-auditor", role.ID)
+	assert.Equal(t, "Reads the logs", role.Description)
+
+	// Renaming keeps the description and attributes
+	fake.roles["auditor"].Attributes = &map[string][]string{"level": {"2"}, "team": {"ops"}}
+	err = rm.UpdateRole(ctx, "auditor", &Role{Name: "log-auditor"})
+	assert.NoError(t, err)
+	role, err = rm.GetRole(ctx, "log-auditor")
+	assert.NoError(t, err)
+	assert.Equal(t, "id-auditor", role.ID)
+	assert.Equal(t, "Reads the logs", role.Description)
+	assert.Equal(t, map[string]string{"level": "2", "team": "ops"}, role.Attributes)
+
+	err = rm.UpdateRole(ctx, "log-auditor", &Role{Name: "auditor", Attributes: map[string]string{"level": "3", "team": ""}})
+	assert.NoError(t, err)
+	role, err = rm.GetRole(ctx, "auditor")
+	assert.NoError(t, err)
+	assert.Equal(t, "Reads the logs", role.Description)
+	assert.Equal(t, map[string]string{"level": "3"}, role.Attributes)
+
+	err = rm.UpdateRole(ctx, "missing", &Role{Description: "Nothing"})
+	assert.True(t, Is404(err))
+
+	assert.NoError(t, rm.AssignUserRoles(ctx, "alice", "viewer", "auditor"))
+	assert.Equal(t, map[string]bool{"viewer": true, "auditor": true}, fake.users["alice"])
+
+	// Nothing is assigned when a role is unknown
+	err = rm.AssignUserRoles(ctx, "alice", "editor", "missing")
+	assert.ErrorIs(t, err, ErrRoleNotFound)
+	assert.ErrorContains(t, err, "missing")
+	assert.False(t, fake.users["alice"]["editor"])
+
+	assert.NoError(t, rm.UnassignUserRoles(ctx, "alice", "auditor"))
+	assert.Equal(t, map[string]bool{"viewer": true}, fake.users["alice"])
+
+	// Bob only holds editor, which grants viewer as well
+	direct, err := rm.GetUserRoles(ctx, "bob")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"editor"}, roleNames(direct))
+	assert.True(t, direct[0].Composite)
+	effective, err := rm.GetEffectiveUserRoles(ctx, "bob")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"editor", "viewer"}, roleNames(effective))
+
+	users, err := rm.GetRoleUsers(ctx, "viewer")
+	assert.NoError(t, err)
+	assert.Len(t, users, 1)
+	assert.Equal(t, "alice", users[0].UID)
+	assert.NotContains(t, users[0].Attributes, "Badge")
+
+	// Users are mapped with the user schema
+	rm.SetUserAttributeSchema(NewAttributeSchema(&Attribute{Name: "Badge"}))
+	users, err = rm.GetRoleUsers(ctx, "viewer")
+	assert.NoError(t, err)
+	assert.Equal(t, "B-alice", users[0].Attributes["Badge"])
+
+	// Viewer is granted through groups and subgroups, editor and owner, which includes editor
+	users, err = rm.GetEffectiveRoleUsers(ctx, "viewer")
+	assert.NoError(t, err)
+	var uids []string
+	for _, u := range users {
+		uids = append(uids, u.UID)
+	}
+	assert.Equal(t, []string{"alice", "carol", "dave", "bob", "erin"}, uids)
+	assert.Equal(t, "B-alice", users[0].Attributes["Badge"])
+	_, err = rm.GetEffectiveRoleUsers(ctx, "missing")
+	assert.ErrorIs(t, err, ErrRoleNotFound)
+
+	groups, err := rm.GetRoleGroups(ctx, "crowd")
+	assert.NoError(t, err)
+	assert.Len(t, groups, 150)
+	assert.Equal(t, "group-149", groups[149].ID)
+	assert.Contains(t, GetGroupExtra(groups[0]).Attributes, "Secret")
+
+	// Groups are mapped with the group schema
+	rm.SetGroupAttributeSchema(NewAttributeSchema(&Attribute{Name: "Code"}))
+	groups, err = rm.GetRoleGroups(ctx, "crowd")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"Code": "G7"}, GetGroupExtra(groups[7]).Attributes)
+}
+
+func TestRoleConversion(t *testing.T) {
+	attrs := map[string][]string{"level": {"2"}, "tags": {"a", "b"}, "empty": {}}
+	role := RoleToCloudy(&gocloak.Role{
+		ID:         gocloak.StringP("id-1"),
+		Name:       gocloak.StringP("viewer"),
+		Attributes: &attrs,
+	})
+	assert.Equal(t, "viewer", role.Name)
+	assert.False(t, role.Composite)
+	assert.Equal(t, "2", role.Attributes["level"])
+	assert.NotContains(t, role.Attributes, "empty")
+
+	back := RoleToKeycloak(role)
+	assert.Equal(t, "id-1", *back.ID)
+	assert.Equal(t, []string{"2"}, (*back.Attributes)["level"])
+	assert.Equal(t, []string{"a", "b"}, (*back.Attributes)["tags"])
+}
+
+func roleNames(roles []*Role) []string {
+	rtn := make([]string, len(roles))
+	for i, r := range roles {
+		rtn[i] = r.Name
+	}
+	return rtn
+}
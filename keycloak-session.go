@@ -0,0 +1,171 @@
+package keycloak
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy"
+	"github.com/go-resty/resty/v2"
+)
+
+// KeycloakSession is an authenticated connection to a Keycloak server. It owns the
+// gocloak client and the admin token and is safe for concurrent use, so a single
+// session can be shared by the user, group and realm managers of a service.
+//
+// The session logs in to its auth realm and by default manages its realm. The two
+// differ when a master realm admin or service account manages another realm.
+type KeycloakSession struct {
+	address   string
+	authRealm string
+	realm     string
+	client    *gocloak.GoCloak
+	tokens    *TokenSource
+
+	mu          sync.Mutex
+	version     string
+	profileAPI  *bool
+	childrenAPI *bool
+}
+
+// NewKeycloakSession creates a session for an admin user that lives in the realm being managed
+func NewKeycloakSession(address string, user string, pwd string, realm string) *KeycloakSession {
+	return NewKeycloakSessionWithCredentials(address, &AdminCredentials{User: user, Password: pwd}, realm, realm)
+}
+
+// NewKeycloakSessionWithCredentials creates a session that logs in to authRealm with the
+// given credentials, for example a service account's ClientCredentials, and manages realm
+func NewKeycloakSessionWithCredentials(address string, creds Credentials, authRealm string, realm string) *KeycloakSession {
+	if authRealm == "" {
+		authRealm = "master"
+	}
+	if realm == "" {
+		realm = authRealm
+	}
+	client := gocloak.NewClient(address)
+	return &KeycloakSession{
+		address:   address,
+		authRealm: authRealm,
+		realm:     realm,
+		client:    client,
+		tokens:    NewTokenSource(client, creds, authRealm),
+	}
+}
+
+// NewKeycloakSessionFromEnv creates a session from KeycloakConfigFromEnv
+func NewKeycloakSessionFromEnv(env *cloudy.Environment) (*KeycloakSession, error) {
+	cfg, err := KeycloakConfigFromEnv(env)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keycloak configuration: %w", err)
+	}
+	return NewKeycloakSessionFromConfig(cfg)
+}
+
+// Connect logs in if there is no valid token yet. Calling it is optional, every
+// operation obtains a token on demand, but it is useful to verify credentials early.
+func (s *KeycloakSession) Connect(ctx context.Context) error {
+	_, err := s.tokens.Token(ctx)
+	return err
+}
+
+func (s *KeycloakSession) Address() string {
+	return s.address
+}
+
+// Realm is the default realm managed through this session
+func (s *KeycloakSession) Realm() string {
+	return s.realm
+}
+
+// AuthRealm is the realm the session logs in to
+func (s *KeycloakSession) AuthRealm() string {
+	return s.authRealm
+}
+
+func (s *KeycloakSession) Client() *gocloak.GoCloak {
+	return s.client
+}
+
+// Token returns a valid access token for direct use with the gocloak client
+func (s *KeycloakSession) Token(ctx context.Context) (string, error) {
+	return s.tokens.Token(ctx)
+}
+
+// Do calls fn with a valid access token, retrying once if the token is rejected
+func (s *KeycloakSession) Do(ctx context.Context, fn func(token string) error) error {
+	return s.tokens.Do(ctx, fn)
+}
+
+// withToken runs fn through the session, returning its result
+func withToken[T any](ctx context.Context, s *KeycloakSession, fn func(token string) (T, error)) (T, error) {
+	var rtn T
+	err := s.Do(ctx, func(token string) error {
+		var err error
+		rtn, err = fn(token)
+		return err
+	})
+	return rtn, err
+}
+
+// ServerVersion returns the Keycloak version, such as 24.0.4. It is read once per session
+func (s *KeycloakSession) ServerVersion(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.version != "" {
+		return s.version, nil
+	}
+
+	info, err := withToken(ctx, s, func(token string) (*gocloak.ServerInfoRepresentation, error) {
+		return s.client.GetServerInfo(ctx, token)
+	})
+	if err != nil {
+		return "", err
+	}
+	if info.SystemInfo != nil {
+		s.version = str(info.SystemInfo.Version, "")
+	}
+	return s.version, nil
+}
+
+// MajorVersion returns the major part of a Keycloak version, 0 when it can not be parsed
+func MajorVersion(version string) int {
+	major, _, _ := strings.Cut(version, ".")
+	n, err := strconv.Atoi(major)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// adminURL builds the url of an admin API path in a realm
+func (s *KeycloakSession) adminURL(realm string, path ...string) string {
+	parts := []string{strings.TrimRight(s.address, "/"), "admin", "realms", url.PathEscape(realm)}
+	for _, p := range path {
+		parts = append(parts, url.PathEscape(p))
+	}
+	return strings.Join(parts, "/")
+}
+
+// checkResponse turns a failed request into a *gocloak.APIError, the way gocloak reports errors
+func checkResponse(resp *resty.Response, err error, errMessage string) error {
+	if err != nil {
+		return &gocloak.APIError{
+			Message: fmt.Sprintf("%v: %v", errMessage, err),
+		}
+	}
+	if resp.IsError() {
+		msg := resp.Status()
+		if body := strings.TrimSpace(resp.String()); body != "" {
+			msg = fmt.Sprintf("%v: %v", msg, body)
+		}
+		return &gocloak.APIError{
+			Code:    resp.StatusCode(),
+			Message: fmt.Sprintf("%v: %v", errMessage, msg),
+		}
+	}
+	return nil
+}
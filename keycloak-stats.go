@@ -0,0 +1,167 @@
+package keycloak
+
+import (
+	"context"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy"
+	"github.com/appliedres/cloudy/models"
+)
+
+// UserStats are user totals for a realm
+type UserStats struct {
+	Total    int
+	Enabled  int
+	Disabled int
+}
+
+// CountUsers counts the users matching the filter without listing them, see ParseUserFilter
+func (um *KeycloakUserManager) CountUsers(ctx context.Context, filter string) (int, error) {
+	err := um.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := ParseUserFilter(filter)
+	if err != nil {
+		return 0, err
+	}
+	params, err := f.Params()
+	if err != nil {
+		return 0, err
+	}
+	return um.countUsers(ctx, params)
+}
+
+func (um *KeycloakUserManager) countUsers(ctx context.Context, params gocloak.GetUsersParams) (int, error) {
+	return withToken(ctx, um.session, func(token string) (int, error) {
+		return um.client.GetUserCount(ctx, token, um.realm, params)
+	})
+}
+
+// UserStats returns the total, enabled and disabled counts of the users matching the filter
+func (um *KeycloakUserManager) UserStats(ctx context.Context, filter string) (*UserStats, error) {
+	err := um.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ParseUserFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := f.Params()
+	if err != nil {
+		return nil, err
+	}
+	total, err := um.countUsers(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &UserStats{Total: total}
+	if f.Enabled != nil {
+		// The filter already decided
+		if *f.Enabled {
+			stats.Enabled = total
+		} else {
+			stats.Disabled = total
+		}
+		return stats, nil
+	}
+
+	params.Enabled = cloudy.BoolP(true)
+	stats.Enabled, err = um.countUsers(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	stats.Disabled = total - stats.Enabled
+	return stats, nil
+}
+
+// CountUsersByAttribute counts the users matching the filter per value of each of the
+// given attributes, e.g. rtn["Organization"]["ACME"]. Without names every attribute in
+// the manager's AttributeSchema is counted. Keycloak has no aggregation so this walks every user.
+func (um *KeycloakUserManager) CountUsersByAttribute(ctx context.Context, filter string, names ...string) (map[string]map[string]int, error) {
+	if len(names) == 0 {
+		names = um.schema.Load().Names()
+	}
+
+	rtn := make(map[string]map[string]int, len(names))
+	for _, name := range names {
+		rtn[name] = make(map[string]int)
+	}
+
+	it, err := um.IterateUsers(ctx, filter, names, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	for it.Next() {
+		usr := it.User()
+		for name := range usr.Attributes {
+			// A user counts once towards each value of a multivalued attribute
+			for _, val := range GetAttributeValues(usr, name) {
+				rtn[name][val]++
+			}
+		}
+	}
+	return rtn, it.Err()
+}
+
+// CountGroups counts the groups whose name contains search, an empty search counts all groups
+func (gm *KeycloakGroupManager) CountGroups(ctx context.Context, search string) (int, error) {
+	err := gm.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	params := gocloak.GetGroupsParams{}
+	if search != "" {
+		params.Search = &search
+	}
+	return withToken(ctx, gm.session, func(token string) (int, error) {
+		return gm.client.GetGroupsCount(ctx, token, gm.realm, params)
+	})
+}
+
+// CountGroupMembers counts the direct members of a group. Keycloak has no member count
+// endpoint so the members are read a page at a time in their brief form
+func (gm *KeycloakGroupManager) CountGroupMembers(ctx context.Context, groupId string) (int, error) {
+	err := gm.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	nextPage := &PageRequest{First: 0, Max: PageSize}
+	for nextPage != nil {
+		found, next, err := gm.listMemberPage(ctx, groupId, true, nextPage)
+		if err != nil {
+			return count, err
+		}
+		count += len(found)
+		nextPage = next
+	}
+	return count, nil
+}
+
+// GroupMemberCounts returns the number of direct members of every group, including
+// subgroups at any depth, keyed by group id
+func (gm *KeycloakGroupManager) GroupMemberCounts(ctx context.Context) (map[string]int, error) {
+	rtn := make(map[string]int)
+	err := gm.WalkGroups(ctx, func(g *models.Group) error {
+		count, err := gm.CountGroupMembers(ctx, g.ID)
+		if err != nil {
+			return err
+		}
+		rtn[g.ID] = count
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rtn, nil
+}
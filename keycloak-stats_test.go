@@ -0,0 +1,75 @@
+package keycloak
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserStats(t *testing.T) {
+	ctx := context.Background()
+
+	// 10 users, every third one disabled, alternating organizations
+	var users []gocloak.User
+	for i := 0; i < 10; i++ {
+		users = append(users, gocloak.User{
+			ID:       gocloak.StringP(fmt.Sprintf("id-%v", i)),
+			Username: gocloak.StringP(fmt.Sprintf("user-%v", i)),
+			Enabled:  gocloak.BoolP(i%3 != 0),
+			Attributes: &map[string][]string{
+				"Organization": {[]string{"ACME", "Umbrella"}[i%2]},
+			},
+		})
+	}
+
+	mux, session := fakeKeycloak(t)
+	mux.HandleFunc("/admin/realms/master/users/count", func(w http.ResponseWriter, r *http.Request) {
+		count := 0
+		for _, u := range users {
+			if enabled := r.URL.Query().Get("enabled"); enabled == "" || enabled == strconv.FormatBool(*u.Enabled) {
+				count++
+			}
+		}
+		writeJSON(w, count)
+	})
+	mux.HandleFunc("/admin/realms/master/users", func(w http.ResponseWriter, r *http.Request) {
+		first, _ := strconv.Atoi(r.URL.Query().Get("first"))
+		max, _ := strconv.Atoi(r.URL.Query().Get("max"))
+		writeJSON(w, users[min(first, len(users)):min(first+max, len(users))])
+	})
+	um := NewKeycloakUserManagerFromSession(session)
+
+	count, err := um.CountUsers(ctx, "")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, count)
+
+	stats, err := um.UserStats(ctx, "")
+	assert.NoError(t, err)
+	assert.Equal(t, &UserStats{Total: 10, Enabled: 6, Disabled: 4}, stats)
+
+	stats, err = um.UserStats(ctx, "enabled=false")
+	assert.NoError(t, err)
+	assert.Equal(t, &UserStats{Total: 4, Disabled: 4}, stats)
+
+	byAttr, err := um.CountUsersByAttribute(ctx, "", "Organization")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]map[string]int{
+		"Organization": {"ACME": 5, "Umbrella": 5},
+	}, byAttr)
+}
+
+func TestGroupMemberCounts(t *testing.T) {
+	for _, version := range []string{"24.0.4", "21.1.2"} {
+		t.Run("version "+version, func(t *testing.T) {
+			gm := newFakeGroupServer(t, version)
+			counts, err := gm.GroupMemberCounts(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]int{"admins": 0, "programs": 1, "abc": 0, "xyz": 2, "team": 2}, counts)
+		})
+	}
+}
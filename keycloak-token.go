@@ -0,0 +1,139 @@
+package keycloak
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// Tokens are refreshed this long before Keycloak says they expire
+const TokenExpiryLeeway = 10 * time.Second
+
+// TokenSource hands out admin access tokens. It keeps track of when the access
+// and refresh tokens expire, refreshes ahead of expiry and falls back to a full
+// login once the refresh token is no longer usable.
+type TokenSource struct {
+	client *gocloak.GoCloak
+	creds  Credentials
+	realm  string
+
+	mu             sync.Mutex
+	jwt            *gocloak.JWT
+	expires        time.Time
+	refreshExpires time.Time
+	now            func() time.Time
+}
+
+func NewTokenSource(client *gocloak.GoCloak, creds Credentials, realm string) *TokenSource {
+	return &TokenSource{
+		client: client,
+		creds:  creds,
+		realm:  realm,
+		now:    time.Now,
+	}
+}
+
+// Token returns a valid access token, refreshing or logging in again as needed
+func (ts *TokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	now := ts.now()
+	if ts.jwt != nil && now.Before(ts.expires) {
+		return ts.jwt.AccessToken, nil
+	}
+
+	if ts.canRefresh(now) {
+		token, err := ts.creds.Refresh(ctx, ts.client, ts.realm, ts.jwt.RefreshToken)
+		if err == nil {
+			ts.set(token, now)
+			return token.AccessToken, nil
+		}
+		// The refresh token is dead (session expired, revoked, ...). Log in again
+	}
+
+	token, err := ts.creds.Login(ctx, ts.client, ts.realm)
+	if err != nil {
+		ts.jwt = nil
+		return "", err
+	}
+	ts.set(token, now)
+	return token.AccessToken, nil
+}
+
+// current returns the token Token last handed out, making sure it is still valid
+func (ts *TokenSource) current(ctx context.Context) (*gocloak.JWT, error) {
+	_, err := ts.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.jwt, nil
+}
+
+// last returns the token Token last handed out, without checking it
+func (ts *TokenSource) last() *gocloak.JWT {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.jwt
+}
+
+// Invalidate marks the given access token as expired so the next call to Token
+// will refresh it. Tokens other than the current one are ignored so that a
+// stale rejection does not throw away a token another caller just obtained.
+func (ts *TokenSource) Invalidate(accessToken string) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.jwt != nil && ts.jwt.AccessToken == accessToken {
+		ts.expires = time.Time{}
+	}
+}
+
+// Do calls fn with a valid access token. If Keycloak rejects the token with a
+// 401 the token is invalidated and fn is retried once with a fresh token.
+func (ts *TokenSource) Do(ctx context.Context, fn func(token string) error) error {
+	token, err := ts.Token(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = fn(token)
+	if !Is401(err) {
+		return err
+	}
+
+	ts.Invalidate(token)
+	token, err = ts.Token(ctx)
+	if err != nil {
+		return err
+	}
+	return fn(token)
+}
+
+func (ts *TokenSource) canRefresh(now time.Time) bool {
+	if ts.jwt == nil || ts.jwt.RefreshToken == "" {
+		return false
+	}
+	// A refresh lifetime of 0 means the refresh token does not expire (offline tokens)
+	return ts.jwt.RefreshExpiresIn == 0 || now.Before(ts.refreshExpires)
+}
+
+func (ts *TokenSource) set(token *gocloak.JWT, now time.Time) {
+	ts.jwt = token
+	ts.expires = now.Add(lifetime(token.ExpiresIn))
+	ts.refreshExpires = now.Add(lifetime(token.RefreshExpiresIn))
+}
+
+// lifetime converts an expires_in value to a duration, less the leeway. Very short
+// lifetimes use half their duration instead so they are still usable.
+func lifetime(seconds int) time.Duration {
+	d := time.Duration(seconds) * time.Second
+	if d <= 2*TokenExpiryLeeway {
+		return d / 2
+	}
+	return d - TokenExpiryLeeway
+}
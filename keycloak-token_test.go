@@ -0,0 +1,199 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTokenServer counts the grants it sees and issues numbered tokens
+type fakeTokenServer struct {
+	mu       sync.Mutex
+	grants   map[string]int
+	issued   int
+	failNext string
+}
+
+func (f *fakeTokenServer) handler(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_ = r.ParseForm()
+	grant := r.PostForm.Get("grant_type")
+	f.grants[grant]++
+	if f.failNext == grant {
+		f.failNext = ""
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	f.issued++
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(gocloak.JWT{
+		AccessToken:      fmt.Sprintf("access-%v", f.issued),
+		RefreshToken:     fmt.Sprintf("refresh-%v", f.issued),
+		ExpiresIn:        60,
+		RefreshExpiresIn: 1800,
+	})
+}
+
+func newFakeTokenSource(t *testing.T) (*TokenSource, *fakeTokenServer, *time.Time) {
+	fake := &fakeTokenServer{grants: map[string]int{}}
+	srv := httptest.NewServer(http.HandlerFunc(fake.handler))
+	t.Cleanup(srv.Close)
+
+	now := time.Now()
+	ts := NewTokenSource(gocloak.NewClient(srv.URL), &AdminCredentials{User: "admin", Password: "pwd"}, "master")
+	ts.now = func() time.Time { return now }
+	return ts, fake, &now
+}
+
+func TestTokenSourceRefresh(t *testing.T) {
+	ctx := context.Background()
+	ts, fake, now := newFakeTokenSource(t)
+
+	token, err := ts.Token(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "access-1", token)
+
+	// Still valid, no new request
+	*now = now.Add(30 * time.Second)
+	token, err = ts.Token(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "access-1", token)
+	assert.Equal(t, 1, fake.grants["password"])
+
+	// Inside the leeway, refreshed ahead of expiry
+	*now = now.Add(25 * time.Second)
+	token, err = ts.Token(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "access-2", token)
+	assert.Equal(t, 1, fake.grants["refresh_token"])
+
+	// Refresh token rejected, falls back to a full login
+	*now = now.Add(time.Minute)
+	fake.failNext = "refresh_token"
+	token, err = ts.Token(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "access-3", token)
+	assert.Equal(t, 2, fake.grants["password"])
+
+	// Refresh token expired, not even attempted
+	*now = now.Add(time.Hour)
+	token, err = ts.Token(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "access-4", token)
+	assert.Equal(t, 2, fake.grants["refresh_token"])
+	assert.Equal(t, 3, fake.grants["password"])
+}
+
+func TestTokenSourceRetryOn401(t *testing.T) {
+	ctx := context.Background()
+	ts, _, _ := newFakeTokenSource(t)
+
+	var seen []string
+	err := ts.Do(ctx, func(token string) error {
+		seen = append(seen, token)
+		if len(seen) == 1 {
+			return &gocloak.APIError{Code: 401, Message: "401 Unauthorized"}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"access-1", "access-2"}, seen)
+
+	// Only retried once
+	calls := 0
+	err = ts.Do(ctx, func(token string) error {
+		calls++
+		return &gocloak.APIError{Code: 401, Message: "401 Unauthorized"}
+	})
+	assert.True(t, Is401(err))
+	assert.Equal(t, 2, calls)
+}
+
+func TestTokenSourceConcurrentLogin(t *testing.T) {
+	ctx := context.Background()
+	ts, fake, _ := newFakeTokenSource(t)
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := ts.Token(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, "access-1", token)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, fake.grants["password"])
+}
+
+func TestTokenSourceClientCredentials(t *testing.T) {
+	ctx := context.Background()
+	ts, fake, now := newFakeTokenSource(t)
+	ts.creds = &ClientCredentials{ClientID: "svc", ClientSecret: "secret"}
+
+	token, err := ts.Token(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "access-1", token)
+	assert.Equal(t, 1, fake.grants["client_credentials"])
+	assert.Equal(t, 0, fake.grants["password"])
+
+	*now = now.Add(time.Minute)
+	token, err = ts.Token(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "access-2", token)
+	assert.Equal(t, 1, fake.grants["refresh_token"])
+}
+
+func TestKeyCloakConnToken(t *testing.T) {
+	fake := &fakeTokenServer{grants: map[string]int{}}
+	srv := httptest.NewServer(http.HandlerFunc(fake.handler))
+	t.Cleanup(srv.Close)
+
+	ctx := context.Background()
+	key := NewKeyCloakConnFromSession(NewKeycloakSession(srv.URL, "admin", "pwd", "master"))
+	token, err := key.CurrentToken(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "access-1", token.AccessToken)
+	assert.Same(t, token, key.Token)
+
+	// Follows the session as it refreshes
+	key.Session.tokens.Invalidate("access-1")
+	token, err = key.CurrentToken(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "access-2", token.AccessToken)
+	assert.Equal(t, "access-2", key.Token.AccessToken)
+
+	_, err = (&KeyCloakConn{}).CurrentToken(ctx)
+	assert.ErrorIs(t, err, ErrNotConnected)
+
+	// A refresh can be cancelled
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	key.Session.tokens.Invalidate("access-2")
+	_, err = key.CurrentToken(cancelled)
+	assert.ErrorContains(t, err, "context canceled")
+	assert.Equal(t, "access-2", key.Token.AccessToken)
+
+	// Connect logs in and fills in the token
+	key = &KeyCloakConn{Address: srv.URL, User: "admin", Pwd: "pwd"}
+	assert.NoError(t, key.Connect(ctx))
+	assert.Equal(t, "access-3", key.Token.AccessToken)
+
+	// A connection sharing the session starts out with its token
+	shared := NewKeyCloakConnFromSession(key.Session)
+	assert.Same(t, key.Token, shared.Token)
+	assert.Nil(t, NewKeyCloakConnFromSession(NewKeycloakSession(srv.URL, "admin", "pwd", "master")).Token)
+}
@@ -0,0 +1,254 @@
+package keycloak
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/appliedres/cloudy/models"
+)
+
+var countryCode = regexp.MustCompile(`^[A-Z]{2,3}$`)
+var phoneChars = regexp.MustCompile(`^\+?[0-9 ().-]+$`)
+
+// UserDetails is a typed view of the custom attributes in AdditionalAttributes
+//
+//	details, err := UserDetailsFromUser(usr)
+//	details.ContractDate = time.Now()
+//	details.Clear(AttrProject.Name)
+//	err = details.ApplyTo(usr)
+type UserDetails struct {
+	AccountType    string
+	Citizenship    CountryCode
+	Company        string
+	ContractDate   time.Time
+	ContractNumber string
+	Department     string
+	DisplayName    string
+	JobTitle       string
+	MobilePhone    PhoneNumber
+	OfficePhone    PhoneNumber
+	Organization   string
+	ProgramRole    string
+	Project        string
+
+	// Attributes ApplyTo removes, see Clear
+	cleared map[string]bool
+}
+
+// CountryCode is an ISO 3166-1 alpha-2 or alpha-3 country code such as US or USA
+type CountryCode string
+
+// ParseCountryCode upper cases the code and checks it has the form of an ISO 3166-1 code
+func ParseCountryCode(s string) (CountryCode, error) {
+	code := strings.ToUpper(strings.TrimSpace(s))
+	if !countryCode.MatchString(code) {
+		return "", fmt.Errorf("%q is not an ISO 3166-1 country code such as US or USA", s)
+	}
+	return CountryCode(code), nil
+}
+
+// PhoneNumber is a phone number of digits with an optional leading + and the usual separators
+type PhoneNumber string
+
+// ParsePhoneNumber checks the number has only digits and separators and at least 7 digits
+func ParsePhoneNumber(s string) (PhoneNumber, error) {
+	s = strings.TrimSpace(s)
+	digits := 0
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			digits++
+		}
+	}
+	if !phoneChars.MatchString(s) || digits < 7 || digits > 15 {
+		return "", fmt.Errorf("%q is not a phone number", s)
+	}
+	return PhoneNumber(s), nil
+}
+
+// Digits is the number without separators, keeping a leading +
+func (p PhoneNumber) Digits() string {
+	var b strings.Builder
+	for i, r := range string(p) {
+		if (r >= '0' && r <= '9') || (r == '+' && i == 0) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// ParseContractDate accepts RFC 3339 times, as stored, and plain dates such as 2024-01-31
+func ParseContractDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date such as 2024-01-31 or 2024-01-31T12:00:00Z", s)
+}
+
+// UserDetailsFromUser reads the custom attributes of a user. Values that do not parse are
+// reported together as ValidationErrors, the rest of the details are still filled in
+func UserDetailsFromUser(u *models.User) (*UserDetails, error) {
+	d := &UserDetails{
+		AccountType:    u.Attributes[AttrAccountType.Name],
+		Company:        u.Attributes[AttrCompany.Name],
+		ContractNumber: u.Attributes[AttrContractNumber.Name],
+		Department:     u.Attributes[AttrDepartment.Name],
+		DisplayName:    u.Attributes[AttrDisplayName.Name],
+		JobTitle:       u.Attributes[AttrJobTitle.Name],
+		Organization:   u.Attributes[AttrOrganization.Name],
+		ProgramRole:    u.Attributes[AttrProgramRole.Name],
+		Project:        u.Attributes[AttrProject.Name],
+	}
+
+	var errs ValidationErrors
+	parse := func(attr *Attribute, fn func(val string) error) {
+		val := u.Attributes[attr.Name]
+		if val == "" {
+			return
+		}
+		if err := fn(val); err != nil {
+			errs = append(errs, &FieldError{Field: attr.Name, Validator: "type", Message: err.Error()})
+		}
+	}
+
+	var err error
+	parse(AttrCitizenship, func(val string) error {
+		d.Citizenship, err = ParseCountryCode(val)
+		return err
+	})
+	parse(AttrContractDate, func(val string) error {
+		d.ContractDate, err = ParseContractDate(val)
+		return err
+	})
+	parse(AttrMobilePhone, func(val string) error {
+		d.MobilePhone, err = ParsePhoneNumber(val)
+		return err
+	})
+	parse(AttrOfficePhone, func(val string) error {
+		d.OfficePhone, err = ParsePhoneNumber(val)
+		return err
+	})
+
+	if len(errs) > 0 {
+		return d, errs
+	}
+	return d, nil
+}
+
+// Validate checks the typed values, for details that were built in code
+func (d *UserDetails) Validate() error {
+	var errs ValidationErrors
+	check := func(attr *Attribute, val string, fn func(string) error) {
+		if val == "" {
+			return
+		}
+		if err := fn(val); err != nil {
+			errs = append(errs, &FieldError{Field: attr.Name, Validator: "type", Message: err.Error()})
+		}
+	}
+
+	check(AttrCitizenship, string(d.Citizenship), func(s string) error {
+		code, err := ParseCountryCode(s)
+		if err == nil && string(code) != s {
+			err = fmt.Errorf("%q must be upper case", s)
+		}
+		return err
+	})
+	check(AttrMobilePhone, string(d.MobilePhone), func(s string) error {
+		_, err := ParsePhoneNumber(s)
+		return err
+	})
+	check(AttrOfficePhone, string(d.OfficePhone), func(s string) error {
+		_, err := ParsePhoneNumber(s)
+		return err
+	})
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Clear marks attributes, by name, for ApplyTo to remove. Their fields are emptied
+func (d *UserDetails) Clear(names ...string) {
+	if d.cleared == nil {
+		d.cleared = make(map[string]bool)
+	}
+	for _, name := range names {
+		d.cleared[name] = true
+		switch name {
+		case AttrAccountType.Name:
+			d.AccountType = ""
+		case AttrCitizenship.Name:
+			d.Citizenship = ""
+		case AttrCompany.Name:
+			d.Company = ""
+		case AttrContractDate.Name:
+			d.ContractDate = time.Time{}
+		case AttrContractNumber.Name:
+			d.ContractNumber = ""
+		case AttrDepartment.Name:
+			d.Department = ""
+		case AttrDisplayName.Name:
+			d.DisplayName = ""
+		case AttrJobTitle.Name:
+			d.JobTitle = ""
+		case AttrMobilePhone.Name:
+			d.MobilePhone = ""
+		case AttrOfficePhone.Name:
+			d.OfficePhone = ""
+		case AttrOrganization.Name:
+			d.Organization = ""
+		case AttrProgramRole.Name:
+			d.ProgramRole = ""
+		case AttrProject.Name:
+			d.Project = ""
+		}
+	}
+}
+
+// ApplyTo writes the details to the user's attributes. Empty values leave the attribute as
+// it is, so values that did not parse are kept, only attributes passed to Clear are removed.
+// Nothing is written when the details are invalid
+func (d *UserDetails) ApplyTo(u *models.User) error {
+	err := d.Validate()
+	if err != nil {
+		return err
+	}
+
+	if u.Attributes == nil {
+		u.Attributes = make(map[string]string)
+	}
+	set := func(attr *Attribute, val string) {
+		if d.cleared[attr.Name] {
+			delete(u.Attributes, attr.Name)
+		} else if val != "" {
+			u.Attributes[attr.Name] = val
+		}
+	}
+
+	contractDate := ""
+	if !d.ContractDate.IsZero() {
+		contractDate = d.ContractDate.Format(time.RFC3339)
+	}
+
+	set(AttrAccountType, d.AccountType)
+	set(AttrCitizenship, string(d.Citizenship))
+	set(AttrCompany, d.Company)
+	set(AttrContractDate, contractDate)
+	set(AttrContractNumber, d.ContractNumber)
+	set(AttrDepartment, d.Department)
+	set(AttrDisplayName, d.DisplayName)
+	set(AttrJobTitle, d.JobTitle)
+	set(AttrMobilePhone, string(d.MobilePhone))
+	set(AttrOfficePhone, string(d.OfficePhone))
+	set(AttrOrganization, d.Organization)
+	set(AttrProgramRole, d.ProgramRole)
+	set(AttrProject, d.Project)
+	return nil
+}
@@ -0,0 +1,72 @@
+package keycloak
+
+import (
+	"testing"
+	"time"
+
+	"github.com/appliedres/cloudy/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserDetails(t *testing.T) {
+	contract := time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC)
+	usr := &models.User{Username: "bob"}
+
+	details := &UserDetails{
+		Citizenship:  "USA",
+		ContractDate: contract,
+		MobilePhone:  "+1 (555) 010-0100",
+		Organization: "ACME",
+	}
+	err := details.ApplyTo(usr)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"Citizenship":  "USA",
+		"ContractDate": "2024-01-31T12:00:00Z",
+		"MobilePhone":  "+1 (555) 010-0100",
+		"Organization": "ACME",
+	}, usr.Attributes)
+
+	read, err := UserDetailsFromUser(usr)
+	assert.NoError(t, err)
+	assert.Equal(t, details, read)
+	assert.Equal(t, "+15550100100", read.MobilePhone.Digits())
+
+	// Plain dates and lower case codes are accepted when reading
+	usr.Attributes["ContractDate"] = "2024-01-31"
+	usr.Attributes["Citizenship"] = "us"
+	read, err = UserDetailsFromUser(usr)
+	assert.NoError(t, err)
+	assert.Equal(t, CountryCode("US"), read.Citizenship)
+	assert.Equal(t, time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), read.ContractDate)
+
+	// Garbage is reported, not stored
+	usr.Attributes["ContractDate"] = "next tuesday"
+	usr.Attributes["OfficePhone"] = "call me"
+	read, err = UserDetailsFromUser(usr)
+	assert.ErrorIs(t, err, ErrInvalidUser)
+	errs := err.(ValidationErrors)
+	assert.Len(t, errs.Field("ContractDate"), 1)
+	assert.Len(t, errs.Field("OfficePhone"), 1)
+	assert.Equal(t, "ACME", read.Organization)
+
+	bad := &UserDetails{Citizenship: "United States"}
+	err = bad.ApplyTo(usr)
+	assert.ErrorIs(t, err, ErrInvalidUser)
+	assert.Equal(t, "call me", usr.Attributes["OfficePhone"])
+
+	// Values that did not parse are kept when the details are written back
+	read.Organization = "Umbrella"
+	err = read.ApplyTo(usr)
+	assert.NoError(t, err)
+	assert.Equal(t, "next tuesday", usr.Attributes["ContractDate"])
+	assert.Equal(t, "call me", usr.Attributes["OfficePhone"])
+	assert.Equal(t, "Umbrella", usr.Attributes["Organization"])
+
+	// Only cleared attributes are removed
+	cleared := &UserDetails{}
+	cleared.Clear(AttrContractDate.Name, AttrOfficePhone.Name)
+	err = cleared.ApplyTo(usr)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"Citizenship": "US", "MobilePhone": "+1 (555) 010-0100", "Organization": "Umbrella"}, usr.Attributes)
+}
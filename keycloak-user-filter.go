@@ -0,0 +1,242 @@
+package keycloak
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy/models"
+)
+
+// UserFilter is the parsed form of the filter passed to ListUsers
+type UserFilter struct {
+	Search        string
+	Username      string
+	Email         string
+	FirstName     string
+	LastName      string
+	Enabled       *bool
+	EmailVerified *bool
+	Exact         *bool
+	// Custom attributes, sent as Keycloak's q=name:value search
+	Attributes map[string]string
+}
+
+// ParseUserFilter parses a ListUsers filter. A filter without an '=' is a free text
+// search across username, email, first and last name. Anything else is a query string
+// such as "username=bob&enabled=true&Organization=ACME".
+//
+// The keys search, username, email, firstName, lastName, enabled, emailVerified and
+// exact map to the Keycloak parameters of the same name. q takes Keycloak's own
+// "name:value name2:value2" syntax and any other key is matched as a custom attribute.
+func ParseUserFilter(filter string) (*UserFilter, error) {
+	f := &UserFilter{}
+	filter = strings.TrimSpace(filter)
+	if filter == "" {
+		return f, nil
+	}
+	if !strings.Contains(filter, "=") {
+		f.Search = filter
+		return f, nil
+	}
+
+	values, err := url.ParseQuery(filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user filter %q: %w", filter, err)
+	}
+
+	for key, vals := range values {
+		val := vals[len(vals)-1]
+		switch key {
+		case "search":
+			f.Search = val
+		case "username":
+			f.Username = val
+		case "email":
+			f.Email = val
+		case "firstName":
+			f.FirstName = val
+		case "lastName":
+			f.LastName = val
+		case "enabled":
+			f.Enabled, err = parseFilterBool(key, val)
+		case "emailVerified":
+			f.EmailVerified, err = parseFilterBool(key, val)
+		case "exact":
+			f.Exact, err = parseFilterBool(key, val)
+		case "q":
+			for _, v := range vals {
+				var attrs map[string]string
+				attrs, err = parseAttributeQuery(v)
+				if err != nil {
+					break
+				}
+				for name, value := range attrs {
+					f.SetAttribute(name, value)
+				}
+			}
+		default:
+			f.SetAttribute(key, val)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Attributes Keycloak can not search for fail here rather than when listing
+	if _, err := f.Params(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *UserFilter) SetAttribute(name string, value string) {
+	if f.Attributes == nil {
+		f.Attributes = make(map[string]string)
+	}
+	f.Attributes[name] = value
+}
+
+// Params converts the filter to the Keycloak query parameters. It fails when an attribute
+// can not be written in Keycloak's q syntax, see AttributeQuery
+func (f *UserFilter) Params() (gocloak.GetUsersParams, error) {
+	params := gocloak.GetUsersParams{
+		Enabled:       f.Enabled,
+		EmailVerified: f.EmailVerified,
+		Exact:         f.Exact,
+	}
+	if f.Search != "" {
+		params.Search = &f.Search
+	}
+	if f.Username != "" {
+		params.Username = &f.Username
+	}
+	if f.Email != "" {
+		params.Email = &f.Email
+	}
+	if f.FirstName != "" {
+		params.FirstName = &f.FirstName
+	}
+	if f.LastName != "" {
+		params.LastName = &f.LastName
+	}
+	if len(f.Attributes) > 0 {
+		q, err := AttributeQuery(f.Attributes)
+		if err != nil {
+			return params, err
+		}
+		params.Q = &q
+	}
+	return params, nil
+}
+
+// AttributeQuery formats attributes in Keycloak's q syntax, "name:value name2:value2".
+// Values containing spaces or colons are quoted. The syntax has no escape for a double
+// quote and no way to write an empty value, so those are rejected rather than changed
+func AttributeQuery(attrs map[string]string) (string, error) {
+	names := make([]string, 0, len(attrs))
+	for name := range attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, len(names))
+	for i, name := range names {
+		val := attrs[name]
+		if name == "" || val == "" {
+			return "", fmt.Errorf("invalid attribute query: %q:%q needs a name and a value", name, val)
+		}
+		if strings.Contains(name+val, `"`) {
+			return "", fmt.Errorf("invalid attribute query: %q:%q can not contain a double quote", name, val)
+		}
+		parts[i] = quoteQueryValue(name) + ":" + quoteQueryValue(val)
+	}
+	return strings.Join(parts, " "), nil
+}
+
+func quoteQueryValue(v string) string {
+	if strings.ContainsAny(v, " \t:") {
+		return `"` + v + `"`
+	}
+	return v
+}
+
+// parseAttributeQuery is the reverse of AttributeQuery. Quotes may only wrap a whole
+// name or value
+func parseAttributeQuery(q string) (map[string]string, error) {
+	rtn := make(map[string]string)
+	var tokens []string
+	var cur strings.Builder
+	quoted := false
+	// Start of the current name or value, where a quote may open
+	start := true
+	runes := []rune(q)
+	for i, r := range runes {
+		switch {
+		case r == '"' && !quoted:
+			if !start {
+				return nil, fmt.Errorf("invalid attribute query %q: quotes must wrap a whole name or value", q)
+			}
+			quoted = true
+		case r == '"':
+			if i+1 < len(runes) && !strings.ContainsRune(" \t:", runes[i+1]) {
+				return nil, fmt.Errorf("invalid attribute query %q: quotes must wrap a whole name or value", q)
+			}
+			quoted = false
+		case (r == ' ' || r == '\t') && !quoted:
+			if cur.Len() > 0 {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+			}
+			start = true
+			continue
+		case r == ':' && !quoted:
+			cur.WriteRune(0)
+			start = true
+			continue
+		default:
+			cur.WriteRune(r)
+		}
+		start = false
+	}
+	if quoted {
+		return nil, fmt.Errorf("invalid attribute query %q: unterminated quote", q)
+	}
+	if cur.Len() > 0 {
+		tokens = append(tokens, cur.String())
+	}
+
+	for _, token := range tokens {
+		name, value, ok := strings.Cut(token, "\x00")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid attribute query %q: expected name:value", q)
+		}
+		rtn[name] = value
+	}
+	return rtn, nil
+}
+
+func parseFilterBool(key string, val string) (*bool, error) {
+	b, err := strconv.ParseBool(val)
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter: %v must be true or false, got %q", key, val)
+	}
+	return &b, nil
+}
+
+// trimAttributes keeps only the requested attributes. No attributes keeps everything
+func trimAttributes(u *models.User, attrs []string) {
+	if len(attrs) == 0 || u.Attributes == nil {
+		return
+	}
+	keep := make(map[string]string, len(attrs))
+	for _, name := range attrs {
+		if val, ok := u.Attributes[name]; ok {
+			keep[name] = val
+		}
+	}
+	u.Attributes = keep
+}
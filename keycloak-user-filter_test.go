@@ -0,0 +1,71 @@
+package keycloak
+
+import (
+	"testing"
+
+	"github.com/appliedres/cloudy/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUserFilter(t *testing.T) {
+	f, err := ParseUserFilter("")
+	assert.NoError(t, err)
+	assert.Equal(t, &UserFilter{}, f)
+
+	f, err = ParseUserFilter("bob smith")
+	assert.NoError(t, err)
+	assert.Equal(t, "bob smith", f.Search)
+
+	f, err = ParseUserFilter("username=bob&enabled=false&emailVerified=true&Organization=ACME%20Corp&q=Project:X")
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", f.Username)
+	assert.False(t, *f.Enabled)
+	assert.True(t, *f.EmailVerified)
+	assert.Equal(t, map[string]string{"Organization": "ACME Corp", "Project": "X"}, f.Attributes)
+
+	params, err := f.Params()
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", *params.Username)
+	assert.Equal(t, `Organization:"ACME Corp" Project:X`, *params.Q)
+	assert.Nil(t, params.Search)
+
+	_, err = ParseUserFilter("enabled=maybe")
+	assert.ErrorContains(t, err, "enabled")
+
+	_, err = ParseUserFilter("q=Project")
+	assert.Error(t, err)
+
+	// Values Keycloak's q syntax can not express are rejected, not changed
+	for _, filter := range []string{
+		`Company=Acme%20%22East%22`,
+		`q=Company:Acme"East"`,
+		`q=Company:"Acme"East`,
+		`Company=`,
+	} {
+		_, err = ParseUserFilter(filter)
+		assert.ErrorContains(t, err, "invalid attribute query", filter)
+	}
+
+	f = &UserFilter{}
+	f.SetAttribute("Company", `Acme "East"`)
+	_, err = f.Params()
+	assert.ErrorContains(t, err, "double quote")
+}
+
+func TestAttributeQueryRoundTrip(t *testing.T) {
+	attrs := map[string]string{"Organization": "ACME Corp", "Project": "X", "Url": "http://x"}
+	q, err := AttributeQuery(attrs)
+	assert.NoError(t, err)
+	parsed, err := parseAttributeQuery(q)
+	assert.NoError(t, err)
+	assert.Equal(t, attrs, parsed)
+}
+
+func TestTrimAttributes(t *testing.T) {
+	u := &models.User{Attributes: map[string]string{"Organization": "ACME", "Project": "X"}}
+	trimAttributes(u, nil)
+	assert.Len(t, u.Attributes, 2)
+
+	trimAttributes(u, []string{"Project", "Missing"})
+	assert.Equal(t, map[string]string{"Project": "X"}, u.Attributes)
+}
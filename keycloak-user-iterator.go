@@ -0,0 +1,80 @@
+package keycloak
+
+import (
+	"context"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy/models"
+)
+
+// UserIterator walks the users matching a filter one page at a time, so very large
+// realms can be processed without loading every user. The next page is fetched in
+// the background while the current one is consumed.
+//
+//	it, err := um.IterateUsers(ctx, "enabled=true", nil, 500)
+//	if err != nil { ... }
+//	defer it.Close()
+//	for it.Next() {
+//		usr := it.User()
+//	}
+//	if err := it.Err(); err != nil { ... }
+type UserIterator struct {
+	pager  *pager[*gocloak.User]
+	schema *AttributeSchema
+	attrs  []string
+	cur    *models.User
+}
+
+// IterateUsers returns an iterator over the users matching the filter, see ParseUserFilter.
+// A pageSize of 0 uses PageSize. Cancelling ctx stops the iteration
+func (um *KeycloakUserManager) IterateUsers(ctx context.Context, filter string, attrs []string, pageSize int) (*UserIterator, error) {
+	err := um.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := ParseUserFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := f.Params()
+	if err != nil {
+		return nil, err
+	}
+	return &UserIterator{
+		pager: newPager(ctx, pageSize, func(ctx context.Context, page *PageRequest) ([]*gocloak.User, *PageRequest, error) {
+			return um.listUserPage(ctx, params, page)
+		}),
+		schema: um.schema.Load(),
+		attrs:  attrs,
+	}, nil
+}
+
+// Next advances to the next user, returning false at the end or on error
+func (it *UserIterator) Next() bool {
+	u, ok := it.pager.next()
+	if !ok {
+		it.cur = nil
+		return false
+	}
+	it.cur = it.schema.ToCloudy(u)
+	trimAttributes(it.cur, it.attrs)
+	return true
+}
+
+// User is the current user
+func (it *UserIterator) User() *models.User {
+	return it.cur
+}
+
+// Err returns the error that ended the iteration, if any
+func (it *UserIterator) Err() error {
+	return it.pager.err
+}
+
+// Close stops the iteration and the background fetch. It is safe to call more than once
+func (it *UserIterator) Close() {
+	it.cur = nil
+	it.pager.close()
+}
@@ -0,0 +1,90 @@
+package keycloak
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeUserManager serves total users from a fake admin API
+func newFakeUserManager(t *testing.T, total int) (*KeycloakUserManager, *[]string) {
+	var mu sync.Mutex
+	var queries []string
+	mux, session := fakeKeycloak(t)
+	mux.HandleFunc("/admin/realms/master/users", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.RawQuery)
+		mu.Unlock()
+		first, _ := strconv.Atoi(r.URL.Query().Get("first"))
+		max, _ := strconv.Atoi(r.URL.Query().Get("max"))
+		var users []gocloak.User
+		for i := first; i < total && i < first+max; i++ {
+			users = append(users, gocloak.User{
+				ID:       gocloak.StringP(fmt.Sprintf("id-%v", i)),
+				Username: gocloak.StringP(fmt.Sprintf("user-%v", i)),
+				Enabled:  gocloak.BoolP(true),
+				Attributes: &map[string][]string{
+					"Organization": {"ACME"},
+					"Project":      {"X"},
+				},
+			})
+		}
+		writeJSON(w, users)
+	})
+	um := NewKeycloakUserManagerFromSession(session)
+	return um, &queries
+}
+
+func TestUserIterator(t *testing.T) {
+	ctx := context.Background()
+	um, queries := newFakeUserManager(t, 25)
+
+	it, err := um.IterateUsers(ctx, "enabled=true", []string{"Project"}, 10)
+	assert.NoError(t, err)
+	defer it.Close()
+
+	count := 0
+	for it.Next() {
+		usr := it.User()
+		assert.Equal(t, fmt.Sprintf("user-%v", count), usr.Username)
+		assert.Equal(t, map[string]string{"Project": "X"}, usr.Attributes)
+		count++
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, 25, count)
+	assert.Len(t, *queries, 3)
+	for _, q := range *queries {
+		assert.True(t, strings.Contains(q, "enabled=true"), q)
+	}
+
+	all, err := um.ListUsers(ctx, "", nil)
+	assert.NoError(t, err)
+	assert.Len(t, *all, 25)
+}
+
+func TestUserIteratorCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	um, _ := newFakeUserManager(t, 1000)
+
+	it, err := um.IterateUsers(ctx, "", nil, 10)
+	assert.NoError(t, err)
+
+	count := 0
+	for it.Next() {
+		count++
+		if count == 15 {
+			cancel()
+		}
+	}
+	assert.ErrorIs(t, it.Err(), context.Canceled)
+	assert.Less(t, count, 1000)
+	assert.False(t, it.Next())
+}
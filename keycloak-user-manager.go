@@ -4,6 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 
 	"github.com/Nerzal/gocloak/v13"
 	"github.com/appliedres/cloudy"
@@ -25,60 +28,138 @@ func init() {
 
 type KeycloakUserManagerFactory struct{}
 
+// Create accepts a *KeycloakConfig, or an already built *KeycloakUserManager. When the
+// config lists several realms a *KeycloakRealmRouter is returned
 func (umf *KeycloakUserManagerFactory) Create(cfg interface{}) (cloudy.UserManager, error) {
-	return cfg.(*KeycloakUserManager), nil
+	switch c := cfg.(type) {
+	case *KeycloakConfig:
+		session, err := NewKeycloakSessionFromConfig(c)
+		if err != nil {
+			return nil, err
+		}
+		schema, err := c.AttributeSchema()
+		if err != nil {
+			return nil, err
+		}
+		if len(c.Realms) > 0 {
+			router := NewKeycloakRealmRouter(session, RestrictRealms(ContextRealmResolver(c.Realm), c.Realms...))
+			router.SetAttributeSchema(schema)
+			if c.ReconcileProfile {
+				router.SetReconcileOnConnect(&ReconcileOptions{})
+			}
+			return router, nil
+		}
+		um := NewKeycloakUserManagerFromSession(session)
+		um.SetAttributeSchema(schema)
+		if c.ReconcileProfile {
+			um.SetReconcileOnConnect(&ReconcileOptions{})
+		}
+		return um, nil
+	case *KeycloakUserManager:
+		return c, nil
+	}
+	return nil, fmt.Errorf("%w: expected *KeycloakConfig, got %T", cloudy.ErrInvalidConfiguration, cfg)
 }
 
 func (umf *KeycloakUserManagerFactory) FromEnv(env *cloudy.Environment) (interface{}, error) {
-	cfg := NewKeycloakUserManagerFromEnv(context.Background(), env)
-	return cfg, nil
+	return KeycloakConfigFromEnv(env)
 }
 
 /// ------------- USER MANAGER
 
 type KeycloakUserManager struct {
-	address string
-	user    string
-	pwd     string
+	session *KeycloakSession
 	realm   string
 	client  *gocloak.GoCloak
-	jwt     *gocloak.JWT
+	// Swapped atomically, the router may set it while calls are made
+	schema atomic.Pointer[AttributeSchema]
+
+	mu        sync.Mutex
+	validate  bool
+	validator *UserValidator
+	// Bumped whenever the cached validator is dropped
+	validatorGen int
+
+	// Options of the reconcile made on the first connect, nil when off
+	reconcile   *ReconcileOptions
+	reconcileMu sync.Mutex
+	reconciled  bool
 }
 
 func NewKeycloakUserManager(address string, user string, pwd string, realm string) *KeycloakUserManager {
-	return &KeycloakUserManager{
-		address: address,
-		user:    user,
-		pwd:     pwd,
+	return NewKeycloakUserManagerFromSession(NewKeycloakSession(address, user, pwd, realm))
+}
+
+func NewKeycloakUserManagerFromEnv(ctx context.Context, env *cloudy.Environment) (*KeycloakUserManager, error) {
+	session, err := NewKeycloakSessionFromEnv(env)
+	if err != nil {
+		return nil, err
+	}
+	return NewKeycloakUserManagerFromSession(session), nil
+}
+
+// NewKeycloakUserManagerFromSession creates a user manager that shares the login of the given session
+func NewKeycloakUserManagerFromSession(session *KeycloakSession) *KeycloakUserManager {
+	return NewKeycloakUserManagerForRealm(session, session.Realm())
+}
+
+// NewKeycloakUserManagerForRealm creates a user manager for any realm the session is allowed to manage
+func NewKeycloakUserManagerForRealm(session *KeycloakSession, realm string) *KeycloakUserManager {
+	um := &KeycloakUserManager{
+		session: session,
 		realm:   realm,
+		client:  session.Client(),
 	}
+	um.schema.Store(DefaultAttributeSchema())
+	return um
+}
+
+func (um *KeycloakUserManager) Realm() string {
+	return um.realm
 }
 
-func NewKeycloakUserManagerFromEnv(ctx context.Context, env *cloudy.Environment) *KeycloakUserManager {
-	cfg := &KeycloakUserManager{}
-	cfg.address = env.Force("KEYCLOAK_HOST")
-	cfg.user = env.Force("KEYCLOAK_USER")
-	cfg.pwd = env.Force("KEYCLOAK_PWD")
-	cfg.realm = env.Default("KEYCLOAK_REALM", "master")
-	return cfg
+func (um *KeycloakUserManager) Session() *KeycloakSession {
+	return um.session
 }
 
+// connect logs in. The user profile is only changed by ReconcileAttributeSchema, or on the
+// first connect when SetReconcileOnConnect asked for it
 func (um *KeycloakUserManager) connect(ctx context.Context) error {
-	//FIXME : CHECK EXPIRED
-	if um.jwt != nil {
+	err := um.session.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	return um.reconcileOnConnect(ctx)
+}
+
+// SetReconcileOnConnect makes the first call of the manager reconcile the user profile with
+// its AttributeSchema, as managers did before ReconcileAttributeSchema existed. A failed
+// reconcile fails that call and is tried again by the next. Nil turns it off
+func (um *KeycloakUserManager) SetReconcileOnConnect(opts *ReconcileOptions) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.reconcile = opts
+}
+
+func (um *KeycloakUserManager) reconcileOnConnect(ctx context.Context) error {
+	um.mu.Lock()
+	opts := um.reconcile
+	um.mu.Unlock()
+	if opts == nil {
 		return nil
 	}
 
-	client := gocloak.NewClient(um.address)
-	token, err := client.LoginAdmin(ctx, um.user, um.pwd, um.realm)
+	um.reconcileMu.Lock()
+	defer um.reconcileMu.Unlock()
+	if um.reconciled {
+		return nil
+	}
+	_, err := um.reconcileUserProfile(ctx, um.schema.Load().ProfileAttributes(), *opts)
 	if err != nil {
-		return err
+		return fmt.Errorf("could not reconcile the user profile: %w", err)
 	}
-	um.jwt = token
-	um.client = client
-
-	// Add all the attributes
-	return um.AddUserAttributes(ctx, AdditionalAttributes)
+	um.reconciled = true
+	return nil
 }
 
 // ForceUserName takes a proposed user name, validates it and transforms it.
@@ -90,9 +171,11 @@ func (um *KeycloakUserManager) ForceUserName(ctx context.Context, name string) (
 		return name, false, err
 	}
 
-	found, err := um.client.GetUsers(ctx, um.jwt.AccessToken, um.realm, gocloak.GetUsersParams{
-		Username: &name,
-		Exact:    gocloak.BoolP(true),
+	found, err := withToken(ctx, um.session, func(token string) ([]*gocloak.User, error) {
+		return um.client.GetUsers(ctx, token, um.realm, gocloak.GetUsersParams{
+			Username: &name,
+			Exact:    gocloak.BoolP(true),
+		})
 	})
 
 	if err != nil {
@@ -106,82 +189,74 @@ func (um *KeycloakUserManager) ForceUserName(ctx context.Context, name string) (
 	return name, false, nil
 }
 
+// ListUsers lists every user matching the filter, see ParseUserFilter for the syntax.
+// When attrs is not empty only those custom attributes are returned
 func (um *KeycloakUserManager) ListUsers(ctx context.Context, filter string, attrs []string) (*[]models.User, error) {
 	err := um.connect(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	params := gocloak.GetUsersParams{}
-	all, err := um.client.GetUsers(ctx, um.jwt.AccessToken, um.realm, params)
+	f, err := ParseUserFilter(filter)
 	if err != nil {
 		return nil, err
 	}
 
-	var users []models.User
+	params, err := f.Params()
+	if err != nil {
+		return nil, err
+	}
+	all, err := um.listUsers(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]models.User, 0, len(all))
 	for _, usr := range all {
-		users = append(users, *UserToCloudy(usr))
+		u := um.schema.Load().ToCloudy(usr)
+		trimAttributes(u, attrs)
+		users = append(users, *u)
 	}
 
 	return &users, nil
 }
 
-func (um *KeycloakUserManager) listUsers(ctx context.Context, page interface{}, filter interface{}) ([]*models.User, interface{}, error) {
-	err := um.connect(ctx)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	var all []*models.User
-	var nextPage *PageRequest
-	for {
-		some, next, err := um.listUserPage(ctx, nextPage)
+// listUsers reads every page of users matching params. Use IterateUsers to avoid
+// holding every user in memory
+func (um *KeycloakUserManager) listUsers(ctx context.Context, params gocloak.GetUsersParams) ([]*gocloak.User, error) {
+	var all []*gocloak.User
+	nextPage := &PageRequest{First: 0, Max: PageSize}
+	for nextPage != nil {
+		some, next, err := um.listUserPage(ctx, params, nextPage)
 		if err != nil {
-			return all, nil, err
+			return all, err
 		}
 		all = append(all, some...)
-		if next == nil {
-			return all, nil, nil
-		}
 		nextPage = next
 	}
+	return all, nil
 }
 
-func (um *KeycloakUserManager) listUserPage(ctx context.Context, page *PageRequest) ([]*models.User, *PageRequest, error) {
-	err := um.connect(ctx)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	params := gocloak.GetUsersParams{}
-	if page != nil {
-		params.Max = cloudy.IntP(page.Max)
-		params.First = cloudy.IntP(page.First)
-	}
+func (um *KeycloakUserManager) listUserPage(ctx context.Context, params gocloak.GetUsersParams, page *PageRequest) ([]*gocloak.User, *PageRequest, error) {
+	params.First = cloudy.IntP(page.First)
+	params.Max = cloudy.IntP(page.Max)
 
-	var nextPage *PageRequest
-
-	all, err := um.client.GetUsers(ctx, um.jwt.AccessToken, um.realm, params)
+	all, err := withToken(ctx, um.session, func(token string) ([]*gocloak.User, error) {
+		return um.client.GetUsers(ctx, token, um.realm, params)
+	})
 	if err != nil {
 		return nil, nil, err
 	}
-	rtn := make([]*models.User, len(all))
-	for i, keyUser := range all {
-		rtn[i] = UserToCloudy(keyUser)
-	}
 
-	if len(all) == PageSize {
-		first := 0
-		if params.First != nil {
-			first = *params.First
-		}
+	var nextPage *PageRequest
+	if len(all) == page.Max {
 		nextPage = &PageRequest{
-			First: first + PageSize,
-			Max:   PageSize,
+			First: page.First + page.Max,
+			Max:   page.Max,
 		}
 	}
 
-	return rtn, nextPage, nil
+	return all, nextPage, nil
 }
 
 // Retrieves a specific user.
@@ -196,7 +271,7 @@ func (um *KeycloakUserManager) GetUser(ctx context.Context, uid string) (*models
 	if u == nil || err != nil {
 		return nil, err
 	}
-	return UserToCloudy(u), err
+	return um.schema.Load().ToCloudy(u), err
 }
 
 // Placeholder if we want to use attributes defined outside of cloudy-keycloak
@@ -211,8 +286,10 @@ func (um *KeycloakUserManager) GetUserByEmail(ctx context.Context, email string,
 		return nil, err
 	}
 
-	found, err := um.client.GetUsers(ctx, um.jwt.AccessToken, um.realm, gocloak.GetUsersParams{
-		Email: &email,
+	found, err := withToken(ctx, um.session, func(token string) ([]*gocloak.User, error) {
+		return um.client.GetUsers(ctx, token, um.realm, gocloak.GetUsersParams{
+			Email: &email,
+		})
 	})
 	if err != nil {
 		return nil, err
@@ -220,7 +297,7 @@ func (um *KeycloakUserManager) GetUserByEmail(ctx context.Context, email string,
 	if len((found)) == 0 {
 		return nil, nil
 	}
-	return UserToCloudy(found[0]), nil
+	return um.schema.Load().ToCloudy(found[0]), nil
 }
 
 // NewUser creates a new user with the given information and returns the new user with any additional
@@ -231,23 +308,44 @@ func (um *KeycloakUserManager) NewUser(ctx context.Context, newUser *models.User
 		return nil, err
 	}
 
-	u := UserToKeycloak(newUser)
-	uid, err := um.client.CreateUser(ctx, um.jwt.AccessToken, um.realm, *u)
+	err = um.checkUser(ctx, newUser)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := um.schema.Load().ToKeycloak(newUser)
+	if err != nil {
+		return nil, err
+	}
+	uid, err := withToken(ctx, um.session, func(token string) (string, error) {
+		return um.client.CreateUser(ctx, token, um.realm, *u)
+	})
 	if uid != "" {
 		newUser.UID = uid
 	}
 	return newUser, err
 }
 
+// UpdateUser replaces the user, including every attribute. Use PatchUser to change only
+// some fields of a user that may not be complete, such as one from GetGroupMembers
 func (um *KeycloakUserManager) UpdateUser(ctx context.Context, usr *models.User) error {
 	err := um.connect(ctx)
 	if err != nil {
 		return err
 	}
 
-	u := UserToKeycloak(usr)
-	err = um.client.UpdateUser(ctx, um.jwt.AccessToken, um.realm, *u)
-	return err
+	err = um.checkUser(ctx, usr)
+	if err != nil {
+		return err
+	}
+
+	u, err := um.schema.Load().ToKeycloak(usr)
+	if err != nil {
+		return err
+	}
+	return um.session.Do(ctx, func(token string) error {
+		return um.client.UpdateUser(ctx, token, um.realm, *u)
+	})
 }
 
 func (um *KeycloakUserManager) Enable(ctx context.Context, uid string) error {
@@ -256,11 +354,10 @@ func (um *KeycloakUserManager) Enable(ctx context.Context, uid string) error {
 		return err
 	}
 
-	u := &gocloak.User{
-		ID:      &uid,
-		Enabled: cloudy.BoolP(true),
-	}
-	err = um.client.UpdateUser(ctx, um.jwt.AccessToken, um.realm, *u)
+	_, err = um.PatchUser(ctx, uid, &UserPatch{
+		User:   &models.User{Enabled: true},
+		Fields: []string{FieldEnabled},
+	})
 	return err
 }
 
@@ -270,11 +367,10 @@ func (um *KeycloakUserManager) Disable(ctx context.Context, uid string) error {
 		return err
 	}
 
-	u := &gocloak.User{
-		ID:      &uid,
-		Enabled: cloudy.BoolP(false),
-	}
-	err = um.client.UpdateUser(ctx, um.jwt.AccessToken, um.realm, *u)
+	_, err = um.PatchUser(ctx, uid, &UserPatch{
+		User:   &models.User{Enabled: false},
+		Fields: []string{FieldEnabled},
+	})
 	return err
 }
 
@@ -300,51 +396,19 @@ func (um *KeycloakUserManager) DeleteUser(ctx context.Context, uid string) error
 	// 	return err
 	// }
 
-	err = um.client.DeleteUser(ctx, um.jwt.AccessToken, um.realm, uid)
-	return err
+	return um.session.Do(ctx, func(token string) error {
+		return um.client.DeleteUser(ctx, token, um.realm, uid)
+	})
 }
 
+// UserToCloudy converts a Keycloak user using DefaultAttributeSchema
 func UserToCloudy(user *gocloak.User) *models.User {
-	u := &models.User{
-		UID:         str(user.ID, ""),
-		Username:    str(user.Username, ""),
-		FirstName:   str(user.FirstName, ""),
-		LastName:    str(user.LastName, ""),
-		Email:       str(user.Email, ""),
-		Enabled:     *user.Enabled,
-		DisplayName: first(user.Attributes, "DisplayName"),
-	}
-
-	u.Attributes = make(map[string]string)
-	for _, attr := range AdditionalAttributes {
-		if first(user.Attributes, attr.Name) != "" {
-			u.Attributes[attr.Name] = first(user.Attributes, attr.Name)
-		}
-	}
-
-	return u
+	return DefaultAttributeSchema().ToCloudy(user)
 }
 
+// UserToKeycloak converts a cloudy user using DefaultAttributeSchema
 func UserToKeycloak(u *models.User) *gocloak.User {
-	attrs := make(map[string][]string)
-
-	for _, attr := range AdditionalAttributes {
-		val, ok := u.Attributes[attr.Name]
-		if ok {
-			attrs[attr.Name] = []string{val}
-		}
-	}
-
-	user := &gocloak.User{
-		ID:         &u.UID,
-		Username:   &u.Username,
-		Enabled:    &u.Enabled,
-		FirstName:  &u.FirstName,
-		LastName:   &u.LastName,
-		Email:      &u.Email,
-		Attributes: &attrs,
-	}
-
+	user, _ := DefaultAttributeSchema().ToKeycloak(u)
 	return user
 }
 
@@ -354,7 +418,9 @@ func (um *KeycloakUserManager) KeycloakGetUser(ctx context.Context, uid string)
 		return nil, err
 	}
 
-	user, err := um.client.GetUserByID(ctx, um.jwt.AccessToken, um.realm, uid)
+	user, err := withToken(ctx, um.session, func(token string) (*gocloak.User, error) {
+		return um.client.GetUserByID(ctx, token, um.realm, uid)
+	})
 	if Is404(err) {
 		return nil, nil
 	}
@@ -381,9 +447,17 @@ func str(val *string, d string) string {
 }
 
 func Is404(err error) bool {
+	return isStatus(err, 404)
+}
+
+func Is401(err error) bool {
+	return isStatus(err, 401)
+}
+
+func isStatus(err error, code int) bool {
 	var apiErr *gocloak.APIError
 	if errors.As(err, &apiErr) {
-		return apiErr.Code == 404
+		return apiErr.Code == code
 	}
 	return false
 }
@@ -391,7 +465,7 @@ func Is404(err error) bool {
 // Found in map components with key "org.keycloak.userprofile.UserProfileProvider"
 // ID is "4c3baf89-84ee-42b5-a3ad-bdaea817b80e"
 func (um *KeycloakUserManager) ParseProfileConfig(component *gocloak.Component) (*UserProfileConfig, error) {
-	if component != nil {
+	if component != nil && component.ComponentConfig != nil {
 		cfg := *component.ComponentConfig
 		val := cfg["kc.user.profile.config"]
 		if len(val) == 1 {
@@ -403,6 +477,8 @@ func (um *KeycloakUserManager) ParseProfileConfig(component *gocloak.Component)
 	return nil, nil
 }
 
+// FindUserProfileComponent returns the component holding the user profile before Keycloak 24,
+// use GetUserProfile which works with every version
 func (um *KeycloakUserManager) FindUserProfileComponent(ctx context.Context) (*gocloak.Component, error) {
 	return um.FindComponent(ctx, "declarative-user-profile")
 }
@@ -412,13 +488,18 @@ func (um *KeycloakUserManager) FindComponent(ctx context.Context, providerId str
 	if err != nil {
 		return nil, err
 	}
+	return um.findComponent(ctx, providerId)
+}
 
-	components, err := um.client.GetComponents(ctx, um.jwt.AccessToken, um.realm)
+func (um *KeycloakUserManager) findComponent(ctx context.Context, providerId string) (*gocloak.Component, error) {
+	components, err := withToken(ctx, um.session, func(token string) ([]*gocloak.Component, error) {
+		return um.client.GetComponents(ctx, token, um.realm)
+	})
 	if err != nil {
 		return nil, err
 	}
 	for _, c := range components {
-		if *c.ProviderID == providerId {
+		if c.ProviderID != nil && *c.ProviderID == providerId {
 			return c, nil
 		}
 	}
@@ -426,44 +507,32 @@ func (um *KeycloakUserManager) FindComponent(ctx context.Context, providerId str
 }
 
 func (um *KeycloakUserManager) SetUserPassword(ctx context.Context, userid string, pwd string, mustChange bool) error {
-	return um.client.SetPassword(ctx, um.jwt.AccessToken, userid, um.realm, pwd, mustChange)
-}
-
-func (um *KeycloakUserManager) AddUserAttributes(ctx context.Context, attributes []*Attribute) error {
-	component, err := um.FindUserProfileComponent(ctx)
-	if err != nil {
-		return err
-	}
-	if component == nil {
-		return errors.New("No User Profile Found")
-	}
-	var config UserProfileConfig
-	cfg := *component.ComponentConfig
-	val := cfg["kc.user.profile.config"]
-	if len(val) != 1 {
-		return errors.New("Bad kc.user.profile.config")
-	}
-	err = json.Unmarshal([]byte(val[0]), &config)
+	err := um.connect(ctx)
 	if err != nil {
 		return err
 	}
 
-	for _, attr := range attributes {
-		existing := config.FindAttributeByName(attr.Name)
-		if existing != nil {
-			continue
-		}
-		config.Attributes = append(config.Attributes, attr)
-	}
-
-	strCfg, err := json.Marshal(config)
-	if err != nil {
-		panic(err)
-	}
-
-	cfg["kc.user.profile.config"] = []string{string(strCfg)}
-	component.ComponentConfig = &cfg
+	return um.session.Do(ctx, func(token string) error {
+		return um.client.SetPassword(ctx, token, userid, um.realm, pwd, mustChange)
+	})
+}
 
-	err = um.client.UpdateComponent(ctx, um.jwt.AccessToken, um.realm, *component)
-	return err
+// AddUserAttributes adds the attributes missing from the user profile and leaves existing
+// ones as they are. ReconcileUserProfile also updates them
+func (um *KeycloakUserManager) AddUserAttributes(ctx context.Context, attributes []*Attribute) error {
+	return um.updateUserProfile(ctx, func(config *UserProfileConfig) error {
+		changed := false
+		for _, attr := range attributes {
+			existing := config.FindAttributeByName(attr.Name)
+			if existing != nil {
+				continue
+			}
+			config.Attributes = append(config.Attributes, attr)
+			changed = true
+		}
+		if !changed {
+			return errNoChange
+		}
+		return nil
+	})
 }
@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Nerzal/gocloak/v13"
 	"github.com/appliedres/cloudy"
 	"github.com/appliedres/cloudy/models"
 	"github.com/stretchr/testify/assert"
@@ -58,7 +59,11 @@ func startTestKeycloak(ctx context.Context) *cloudy.Environment {
 func TestUserManager(t *testing.T) {
 	ctx := cloudy.StartContext()
 	env := startTestKeycloak(ctx)
-	um := NewKeycloakUserManagerFromEnv(ctx, env)
+	um, err := NewKeycloakUserManagerFromEnv(ctx, env)
+	assert.NoError(t, err)
+
+	_, err = um.ReconcileAttributeSchema(ctx, ReconcileOptions{})
+	assert.NoError(t, err)
 
 	created, err := um.NewUser(ctx, &models.User{
 		Username:  "test.user@arkloud.us",
@@ -97,19 +102,22 @@ func TestUserManager(t *testing.T) {
 		Enabled:     true,
 		DisplayName: "DisplayName",
 	}
-	usr.Attributes = make(map[string]string)
-	usr.Attributes["JobTitle"] = "JoBTitle"
-	usr.Attributes["MobilePhone"] = "999-999-9999"
-	usr.Attributes["OfficePhone"] = "111-999-9999"
-	usr.Attributes["ProgramRole"] = "ProgramRole"
-	usr.Attributes["Organization"] = "Organization"
-	usr.Attributes["Project"] = "Project"
-	usr.Attributes["AccountType"] = "AccountType"
-	usr.Attributes["Company"] = "Company"
-	usr.Attributes["ContractDate"] = time.Now().Format(time.RFC3339)
-	usr.Attributes["ContractNumber"] = "1234"
-	usr.Attributes["Department"] = "Department"
-	usr.Attributes["Citizenship"] = "USA"
+	details := &UserDetails{
+		JobTitle:       "JoBTitle",
+		MobilePhone:    "999-999-9999",
+		OfficePhone:    "111-999-9999",
+		ProgramRole:    "ProgramRole",
+		Organization:   "Organization",
+		Project:        "Project",
+		AccountType:    "AccountType",
+		Company:        "Company",
+		ContractDate:   time.Now().Truncate(time.Second),
+		ContractNumber: "1234",
+		Department:     "Department",
+		Citizenship:    "USA",
+	}
+	err = details.ApplyTo(usr)
+	assert.NoError(t, err)
 
 	createdUsa, err := um.NewUser(ctx, usr)
 	assert.NoError(t, err)
@@ -122,6 +130,11 @@ func TestUserManager(t *testing.T) {
 	assert.NotNil(t, foundUsa)
 	assert.EqualValues(t, createdUsa, foundUsa)
 
+	foundDetails, err := UserDetailsFromUser(foundUsa)
+	assert.NoError(t, err)
+	assert.True(t, details.ContractDate.Equal(foundDetails.ContractDate))
+	assert.Equal(t, CountryCode("USA"), foundDetails.Citizenship)
+
 	assert.True(t, createdUsa.Enabled)
 	err = um.Disable(ctx, foundUsa.UID)
 	assert.NoError(t, err)
@@ -153,6 +166,135 @@ func TestUserManager(t *testing.T) {
 	assert.NoError(t, err)
 	assert.True(t, exists)
 
+	byOrg, err := um.FindUsersByAttribute(ctx, "Organization", "Organization")
+	assert.NoError(t, err)
+	assert.Len(t, byOrg, 1)
+
+	none, err := um.FindUsersByAttribute(ctx, "Organization", "Organ")
+	assert.NoError(t, err)
+	assert.Empty(t, none)
+
+	some, _, err := um.FindUsers(ctx, &AttributeSearch{
+		Attributes: map[string]string{"Organization": "Organ", "Citizenship": "USA"},
+	}, nil)
+	assert.NoError(t, err)
+	assert.Len(t, some, 1)
+}
+
+func TestUserManagerOtherRealm(t *testing.T) {
+	ctx := cloudy.StartContext()
+	env := startTestKeycloak(ctx)
+	os.Setenv("KEYCLOAK_REALM", "acme")
+	defer os.Unsetenv("KEYCLOAK_REALM")
+
+	// The admin lives in master but manages acme
+	session, err := NewKeycloakSessionFromEnv(env)
+	assert.NoError(t, err)
+	assert.Equal(t, "master", session.AuthRealm())
+	assert.Equal(t, "acme", session.Realm())
+
+	err = session.Do(ctx, func(token string) error {
+		_, err := session.Client().CreateRealm(ctx, token, gocloak.RealmRepresentation{
+			Realm:   gocloak.StringP("acme"),
+			Enabled: gocloak.BoolP(true),
+		})
+		return err
+	})
+	assert.NoError(t, err)
+
+	um := NewKeycloakUserManagerFromSession(session)
+	created, err := um.NewUser(ctx, &models.User{
+		Username:  "acme.user",
+		FirstName: "Acme",
+		LastName:  "User",
+		Email:     "acme.user@email.arkloud.us",
+	})
+	assert.NoError(t, err)
+	assert.NotEmpty(t, created.UID)
+
+	// Not visible in master
+	master := NewKeycloakUserManagerForRealm(session, "master")
+	_, exists, err := master.ForceUserName(ctx, "acme.user")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	_, exists, err = um.ForceUserName(ctx, "acme.user")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestUserProfileManagement(t *testing.T) {
+	ctx := cloudy.StartContext()
+	env := startTestKeycloak(ctx)
+	um, err := NewKeycloakUserManagerFromEnv(ctx, env)
+	assert.NoError(t, err)
+
+	// Nothing is provisioned until asked
+	cfg, err := um.GetUserProfile(ctx)
+	assert.NoError(t, err)
+	assert.Nil(t, cfg.FindAttributeByName("Organization"))
+
+	plan, err := um.ReconcileAttributeSchema(ctx, ReconcileOptions{DryRun: true})
+	assert.NoError(t, err)
+	assert.Len(t, plan.Changes, len(AdditionalAttributes))
+
+	plan, err = um.ReconcileAttributeSchema(ctx, ReconcileOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, plan.Changes, len(AdditionalAttributes))
+
+	plan, err = um.ReconcileAttributeSchema(ctx, ReconcileOptions{})
+	assert.NoError(t, err)
+	assert.True(t, plan.Empty(), plan.String())
+
+	citizenship, err := um.GetUserProfileAttribute(ctx, "Citizenship")
+	assert.NoError(t, err)
+	assert.Equal(t, PermissionsAdminEditable, citizenship.Permissions)
+	mobile, err := um.GetUserProfileAttribute(ctx, "MobilePhone")
+	assert.NoError(t, err)
+	assert.Equal(t, PermissionsUserEditable, mobile.Permissions)
+
+	err = um.AddUserProfileGroup(ctx, &AttributeGroup{Name: "work", DisplayHeader: "Work"})
+	assert.NoError(t, err)
+
+	badge := &Attribute{
+		Name:  "Badge",
+		Group: "work",
+		Validations: Validation{
+			Pattern: &ValidationPattern{Pattern: "^[0-9]+$", ErrorMessage: "digits only"},
+		},
+		Permissions: Permissions{
+			View: []string{AttributePermissionAdmin},
+			Edit: []string{AttributePermissionAdmin},
+		},
+	}
+	err = um.AddUserProfileAttribute(ctx, badge)
+	assert.NoError(t, err)
+
+	err = um.AddUserProfileAttribute(ctx, badge)
+	assert.ErrorIs(t, err, ErrAttributeExists)
+
+	badge.DisplayName = "Badge Number"
+	err = um.UpdateUserProfileAttribute(ctx, badge)
+	assert.NoError(t, err)
+
+	found, err := um.GetUserProfileAttribute(ctx, "Badge")
+	assert.NoError(t, err)
+	assert.Equal(t, "Badge Number", found.DisplayName)
+	assert.Equal(t, "^[0-9]+$", found.Validations.Pattern.Pattern)
+
+	err = um.RemoveUserProfileGroup(ctx, "work")
+	assert.Error(t, err)
+
+	err = um.RemoveUserProfileAttribute(ctx, "Badge")
+	assert.NoError(t, err)
+	err = um.RemoveUserProfileGroup(ctx, "work")
+	assert.NoError(t, err)
+
+	cfg, err = um.GetUserProfile(ctx)
+	assert.NoError(t, err)
+	assert.Nil(t, cfg.FindAttributeByName("Badge"))
+	assert.Nil(t, cfg.FindGroupByName("work"))
+	assert.NotNil(t, cfg.FindAttributeByName("Organization"))
 }
 
 func TestUserManagerBulk(t *testing.T) {
@@ -161,7 +303,8 @@ func TestUserManagerBulk(t *testing.T) {
 	env := startTestKeycloak(ctx)
 	elapsedContainer := time.Since(startContainer)
 
-	um := NewKeycloakUserManagerFromEnv(ctx, env)
+	um, err := NewKeycloakUserManagerFromEnv(ctx, env)
+	assert.NoError(t, err)
 
 	start := time.Now()
 
@@ -190,6 +333,10 @@ func TestUserManagerBulk(t *testing.T) {
 	assert.NoError(t, err)
 	assert.GreaterOrEqual(t, len(*all), 1000)
 
+	some, err := um.ListUsers(ctx, "lastName=User-42&exact=true", nil)
+	assert.NoError(t, err)
+	assert.Len(t, *some, 1)
+
 	fmt.Printf("Time To Start: %v\n", elapsedContainer)
 	fmt.Printf("Time To Add: %v\n", elapsed)
 	fmt.Printf("Time To List: %v\n", elapsedList)
@@ -0,0 +1,223 @@
+package keycloak
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy/models"
+)
+
+var ErrConflict = errors.New("user was changed by someone else")
+var ErrUserNotFound = errors.New("user not found")
+
+// Fields of a UserPatch mask. A single attribute is "attributes.Name"
+const (
+	FieldUsername    = "username"
+	FieldEmail       = "email"
+	FieldFirstName   = "firstName"
+	FieldLastName    = "lastName"
+	FieldEnabled     = "enabled"
+	FieldDisplayName = "displayName"
+	// Every attribute present in the patch user, other attributes are kept
+	FieldAttributes = "attributes"
+
+	attributeFieldPrefix = "attributes."
+)
+
+// AttributeField is the mask field of a single attribute
+func AttributeField(name string) string {
+	return attributeFieldPrefix + name
+}
+
+// UserPatch changes only the masked fields of a user, taking their values from User.
+// An attribute named in the mask but missing from User.Attributes is removed
+type UserPatch struct {
+	User   *models.User
+	Fields []string
+	// Fingerprint of the user the patch was made from, see GetUserForUpdate. When set the
+	// patch fails with ErrConflict if the user has changed since
+	IfMatch string
+}
+
+// GetUserForUpdate returns a user along with the fingerprint to pass as UserPatch.IfMatch
+func (um *KeycloakUserManager) GetUserForUpdate(ctx context.Context, uid string) (*models.User, string, error) {
+	u, err := um.KeycloakGetUser(ctx, uid)
+	if err != nil {
+		return nil, "", err
+	}
+	if u == nil {
+		return nil, "", nil
+	}
+	fingerprint, err := UserFingerprint(u)
+	if err != nil {
+		return nil, "", err
+	}
+	return um.schema.Load().ToCloudy(u), fingerprint, nil
+}
+
+// PatchUser reads the user, applies the masked fields and writes it back, so everything
+// outside the mask is kept as Keycloak has it. Keycloak has no conditional update, the
+// IfMatch check narrows the window for lost updates to the time between read and write
+func (um *KeycloakUserManager) PatchUser(ctx context.Context, uid string, patch *UserPatch) (*models.User, error) {
+	err := um.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := um.KeycloakGetUser(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, fmt.Errorf("%w: %v", ErrUserNotFound, uid)
+	}
+
+	if patch.IfMatch != "" {
+		fingerprint, err := UserFingerprint(current)
+		if err != nil {
+			return nil, err
+		}
+		if fingerprint != patch.IfMatch {
+			return nil, fmt.Errorf("%w: %v", ErrConflict, uid)
+		}
+	}
+
+	err = um.applyPatch(current, patch)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the patched fields are validated, so that enabling a user does not fail
+	// on some other field
+	patched := um.schema.Load().ToCloudy(current)
+	err = um.checkUser(ctx, patched)
+	var errs ValidationErrors
+	if errors.As(err, &errs) {
+		err = errs.only(patchedFields(patch))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = um.session.Do(ctx, func(token string) error {
+		return um.client.UpdateUser(ctx, token, um.realm, *current)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return patched, nil
+}
+
+func (um *KeycloakUserManager) applyPatch(u *gocloak.User, patch *UserPatch) error {
+	src := patch.User
+	if src == nil {
+		src = &models.User{}
+	}
+
+	// Masked attributes go through the schema like a full update would
+	attrs := make(map[string]string)
+	var removed []string
+	for _, field := range patch.Fields {
+		switch field {
+		case FieldUsername:
+			u.Username = gocloak.StringP(src.Username)
+		case FieldEmail:
+			u.Email = gocloak.StringP(src.Email)
+		case FieldFirstName:
+			u.FirstName = gocloak.StringP(src.FirstName)
+		case FieldLastName:
+			u.LastName = gocloak.StringP(src.LastName)
+		case FieldEnabled:
+			u.Enabled = gocloak.BoolP(src.Enabled)
+		case FieldDisplayName:
+			if src.DisplayName == "" {
+				removed = append(removed, AttrDisplayName.Name)
+			} else {
+				attrs[AttrDisplayName.Name] = src.DisplayName
+			}
+		case FieldAttributes:
+			for name, val := range src.Attributes {
+				attrs[name] = val
+			}
+		default:
+			name, ok := strings.CutPrefix(field, attributeFieldPrefix)
+			if !ok || name == "" {
+				return fmt.Errorf("unknown user patch field %q", field)
+			}
+			if val, ok := src.Attributes[name]; ok {
+				attrs[name] = val
+			} else {
+				removed = append(removed, name)
+			}
+		}
+	}
+
+	if len(attrs) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	converted, err := um.schema.Load().ToKeycloak(&models.User{Attributes: attrs})
+	if err != nil {
+		return err
+	}
+	merged := make(map[string][]string)
+	if u.Attributes != nil {
+		for name, values := range *u.Attributes {
+			merged[name] = values
+		}
+	}
+	for name, values := range *converted.Attributes {
+		merged[name] = values
+	}
+	for _, name := range removed {
+		delete(merged, name)
+	}
+	u.Attributes = &merged
+	return nil
+}
+
+// patchedFields are the user profile names of the fields a patch changes
+func patchedFields(patch *UserPatch) map[string]bool {
+	rtn := make(map[string]bool)
+	for _, field := range patch.Fields {
+		switch field {
+		case FieldDisplayName:
+			rtn[AttrDisplayName.Name] = true
+		case FieldAttributes:
+			if patch.User != nil {
+				for name := range patch.User.Attributes {
+					rtn[name] = true
+				}
+			}
+		default:
+			rtn[strings.TrimPrefix(field, attributeFieldPrefix)] = true
+		}
+	}
+	return rtn
+}
+
+// UserFingerprint identifies the state of a user's editable fields. It changes whenever
+// any of them change
+func UserFingerprint(u *gocloak.User) (string, error) {
+	data, err := json.Marshal(struct {
+		Username        *string              `json:"username"`
+		Email           *string              `json:"email"`
+		FirstName       *string              `json:"firstName"`
+		LastName        *string              `json:"lastName"`
+		Enabled         *bool                `json:"enabled"`
+		EmailVerified   *bool                `json:"emailVerified"`
+		Attributes      *map[string][]string `json:"attributes"`
+		RequiredActions *[]string            `json:"requiredActions"`
+	}{u.Username, u.Email, u.FirstName, u.LastName, u.Enabled, u.EmailVerified, u.Attributes, u.RequiredActions})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
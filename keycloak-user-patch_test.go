@@ -0,0 +1,116 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeUserServer(t *testing.T, stored *gocloak.User) *KeycloakUserManager {
+	mux, session := fakeKeycloak(t)
+	mux.HandleFunc("/admin/realms/master/users/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/admin/realms/master/users/"+*stored.ID {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodPut {
+			*stored = gocloak.User{}
+			_ = json.NewDecoder(r.Body).Decode(stored)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeJSON(w, stored)
+	})
+	return NewKeycloakUserManagerFromSession(session)
+}
+
+func TestPatchUser(t *testing.T) {
+	ctx := context.Background()
+	stored := &gocloak.User{
+		ID:        gocloak.StringP("id-1"),
+		Username:  gocloak.StringP("bob"),
+		FirstName: gocloak.StringP("Bob"),
+		Email:     gocloak.StringP("bob@example.com"),
+		Enabled:   gocloak.BoolP(true),
+		Attributes: &map[string][]string{
+			"DisplayName":  {"Bobby"},
+			"Organization": {"ACME"},
+			"Project":      {"X"},
+		},
+	}
+	um := newFakeUserServer(t, stored)
+
+	// Only the masked fields change
+	usr, err := um.PatchUser(ctx, "id-1", &UserPatch{
+		User:   &models.User{FirstName: "Robert", Email: "ignored@example.com", Attributes: map[string]string{"Project": "Y"}},
+		Fields: []string{FieldFirstName, AttributeField("Project"), AttributeField("Organization")},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "Robert", usr.FirstName)
+	assert.Equal(t, "Bobby", usr.DisplayName)
+	assert.Equal(t, "Robert", *stored.FirstName)
+	assert.Equal(t, "bob@example.com", *stored.Email)
+	assert.Equal(t, map[string][]string{"DisplayName": {"Bobby"}, "Project": {"Y"}}, *stored.Attributes)
+
+	_, err = um.PatchUser(ctx, "id-1", &UserPatch{
+		User:   &models.User{DisplayName: "Rob"},
+		Fields: []string{FieldDisplayName},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Rob"}, (*stored.Attributes)["DisplayName"])
+	assert.Equal(t, []string{"Y"}, (*stored.Attributes)["Project"])
+
+	_, err = um.PatchUser(ctx, "id-1", &UserPatch{Fields: []string{"nickname"}})
+	assert.Error(t, err)
+
+	// Enabling and disabling keep the attributes
+	assert.NoError(t, um.Disable(ctx, "id-1"))
+	assert.False(t, *stored.Enabled)
+	assert.Equal(t, "Robert", *stored.FirstName)
+	assert.Equal(t, []string{"Rob"}, (*stored.Attributes)["DisplayName"])
+	assert.NoError(t, um.Enable(ctx, "id-1"))
+	assert.True(t, *stored.Enabled)
+
+	_, err = um.PatchUser(ctx, "missing", &UserPatch{Fields: []string{FieldEnabled}})
+	assert.ErrorIs(t, err, ErrUserNotFound)
+}
+
+func TestPatchUserConflict(t *testing.T) {
+	ctx := context.Background()
+	stored := &gocloak.User{
+		ID:       gocloak.StringP("id-1"),
+		Username: gocloak.StringP("bob"),
+		Enabled:  gocloak.BoolP(true),
+	}
+	um := newFakeUserServer(t, stored)
+
+	usr, fingerprint, err := um.GetUserForUpdate(ctx, "id-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "bob", usr.Username)
+
+	// Someone else changes the user in between
+	stored.LastName = gocloak.StringP("Smith")
+
+	_, err = um.PatchUser(ctx, "id-1", &UserPatch{
+		User:    &models.User{FirstName: "Bob"},
+		Fields:  []string{FieldFirstName},
+		IfMatch: fingerprint,
+	})
+	assert.ErrorIs(t, err, ErrConflict)
+	assert.Nil(t, stored.FirstName)
+
+	_, fingerprint, err = um.GetUserForUpdate(ctx, "id-1")
+	assert.NoError(t, err)
+	_, err = um.PatchUser(ctx, "id-1", &UserPatch{
+		User:    &models.User{FirstName: "Bob"},
+		Fields:  []string{FieldFirstName},
+		IfMatch: fingerprint,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "Bob", *stored.FirstName)
+}
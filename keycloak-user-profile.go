@@ -0,0 +1,417 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrAttributeExists = errors.New("user profile attribute already exists")
+var ErrAttributeNotFound = errors.New("user profile attribute not found")
+var ErrAttributeGroupExists = errors.New("user profile attribute group already exists")
+var ErrAttributeGroupNotFound = errors.New("user profile attribute group not found")
+
+/// ------------- VALIDATOR JSON
+
+type validationFields Validation
+
+func (v *Validation) UnmarshalJSON(data []byte) error {
+	var all map[string]json.RawMessage
+	err := json.Unmarshal(data, &all)
+	if err != nil {
+		return err
+	}
+
+	var fields validationFields
+	err = json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+
+	// Whatever the fields did not take is kept as is
+	known, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	var knownKeys map[string]json.RawMessage
+	_ = json.Unmarshal(known, &knownKeys)
+	for key := range knownKeys {
+		delete(all, key)
+	}
+
+	*v = Validation(fields)
+	if len(all) > 0 {
+		v.Other = all
+	}
+	return nil
+}
+
+func (v Validation) MarshalJSON() ([]byte, error) {
+	data, err := json.Marshal(validationFields(v))
+	if err != nil || len(v.Other) == 0 {
+		return data, err
+	}
+
+	var all map[string]json.RawMessage
+	err = json.Unmarshal(data, &all)
+	if err != nil {
+		return nil, err
+	}
+	for key, raw := range v.Other {
+		if _, ok := all[key]; !ok {
+			all[key] = raw
+		}
+	}
+	return json.Marshal(all)
+}
+
+// The admin console saves validator numbers as strings, accept both
+
+func (l *ValidationLength) UnmarshalJSON(data []byte) error {
+	type plain ValidationLength
+	data, err := unquoteNumbers(data, "min", "max")
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, (*plain)(l))
+}
+
+func (e *ValidationEmail) UnmarshalJSON(data []byte) error {
+	type plain ValidationEmail
+	data, err := unquoteNumbers(data, "max-local-length")
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, (*plain)(e))
+}
+
+func (r *ValidationRange) UnmarshalJSON(data []byte) error {
+	type plain ValidationRange
+	data, err := unquoteNumbers(data, "min", "max")
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, (*plain)(r))
+}
+
+// unquoteNumbers turns the given keys of a JSON object from "3" into 3. Empty strings are removed
+func unquoteNumbers(data []byte, keys ...string) ([]byte, error) {
+	var all map[string]json.RawMessage
+	err := json.Unmarshal(data, &all)
+	if err != nil || all == nil {
+		return data, err
+	}
+
+	changed := false
+	for _, key := range keys {
+		raw, ok := all[key]
+		if !ok || !strings.HasPrefix(string(raw), `"`) {
+			continue
+		}
+		var s string
+		err = json.Unmarshal(raw, &s)
+		if err != nil {
+			return nil, err
+		}
+		changed = true
+		if strings.TrimSpace(s) == "" {
+			delete(all, key)
+			continue
+		}
+		if _, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err != nil {
+			return nil, fmt.Errorf("validator %v must be a number, got %q", key, s)
+		}
+		all[key] = json.RawMessage(strings.TrimSpace(s))
+	}
+	if !changed {
+		return data, nil
+	}
+	return json.Marshal(all)
+}
+
+/// ------------- USER PROFILE
+
+// GetUserProfile reads the realm's declarative user profile
+func (um *KeycloakUserManager) GetUserProfile(ctx context.Context) (*UserProfileConfig, error) {
+	err := um.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return um.getUserProfile(ctx)
+}
+
+// PutUserProfile replaces the realm's declarative user profile
+func (um *KeycloakUserManager) PutUserProfile(ctx context.Context, cfg *UserProfileConfig) error {
+	err := um.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return um.putUserProfile(ctx, cfg)
+}
+
+// GetUserProfileAttribute returns the attribute with the given name, or nil
+func (um *KeycloakUserManager) GetUserProfileAttribute(ctx context.Context, name string) (*Attribute, error) {
+	cfg, err := um.GetUserProfile(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.FindAttributeByName(name), nil
+}
+
+// AddUserProfileAttribute adds an attribute, failing with ErrAttributeExists if it is already there
+func (um *KeycloakUserManager) AddUserProfileAttribute(ctx context.Context, attr *Attribute) error {
+	return um.updateUserProfile(ctx, func(cfg *UserProfileConfig) error {
+		if cfg.FindAttributeByName(attr.Name) != nil {
+			return fmt.Errorf("%w: %v", ErrAttributeExists, attr.Name)
+		}
+		cfg.Attributes = append(cfg.Attributes, attr)
+		return nil
+	})
+}
+
+// UpdateUserProfileAttribute replaces an attribute, failing with ErrAttributeNotFound if it is missing
+func (um *KeycloakUserManager) UpdateUserProfileAttribute(ctx context.Context, attr *Attribute) error {
+	return um.updateUserProfile(ctx, func(cfg *UserProfileConfig) error {
+		for i, existing := range cfg.Attributes {
+			if existing.Name == attr.Name {
+				cfg.Attributes[i] = attr
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %v", ErrAttributeNotFound, attr.Name)
+	})
+}
+
+// RemoveUserProfileAttribute removes an attribute. Removing a missing attribute does nothing.
+// The values users already have are not deleted
+func (um *KeycloakUserManager) RemoveUserProfileAttribute(ctx context.Context, name string) error {
+	return um.updateUserProfile(ctx, func(cfg *UserProfileConfig) error {
+		for i, existing := range cfg.Attributes {
+			if existing.Name == name {
+				cfg.Attributes = append(cfg.Attributes[:i], cfg.Attributes[i+1:]...)
+				return nil
+			}
+		}
+		return errNoChange
+	})
+}
+
+// GetUserProfileGroup returns the attribute group with the given name, or nil
+func (um *KeycloakUserManager) GetUserProfileGroup(ctx context.Context, name string) (*AttributeGroup, error) {
+	cfg, err := um.GetUserProfile(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.FindGroupByName(name), nil
+}
+
+// AddUserProfileGroup adds an attribute group, failing with ErrAttributeGroupExists if it is already there
+func (um *KeycloakUserManager) AddUserProfileGroup(ctx context.Context, group *AttributeGroup) error {
+	return um.updateUserProfile(ctx, func(cfg *UserProfileConfig) error {
+		if cfg.FindGroupByName(group.Name) != nil {
+			return fmt.Errorf("%w: %v", ErrAttributeGroupExists, group.Name)
+		}
+		cfg.Groups = append(cfg.Groups, group)
+		return nil
+	})
+}
+
+// UpdateUserProfileGroup replaces an attribute group, failing with ErrAttributeGroupNotFound if it is missing
+func (um *KeycloakUserManager) UpdateUserProfileGroup(ctx context.Context, group *AttributeGroup) error {
+	return um.updateUserProfile(ctx, func(cfg *UserProfileConfig) error {
+		for i, existing := range cfg.Groups {
+			if existing.Name == group.Name {
+				cfg.Groups[i] = group
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %v", ErrAttributeGroupNotFound, group.Name)
+	})
+}
+
+// RemoveUserProfileGroup removes an attribute group. It fails while attributes are still in
+// the group, removing a missing group does nothing
+func (um *KeycloakUserManager) RemoveUserProfileGroup(ctx context.Context, name string) error {
+	return um.updateUserProfile(ctx, func(cfg *UserProfileConfig) error {
+		var used []string
+		for _, attr := range cfg.Attributes {
+			if attr.Group == name {
+				used = append(used, attr.Name)
+			}
+		}
+		if len(used) > 0 {
+			return fmt.Errorf("attribute group %v is still used by %v", name, strings.Join(used, ", "))
+		}
+
+		for i, existing := range cfg.Groups {
+			if existing.Name == name {
+				cfg.Groups = append(cfg.Groups[:i], cfg.Groups[i+1:]...)
+				return nil
+			}
+		}
+		return errNoChange
+	})
+}
+
+// errNoChange tells updateUserProfile there is nothing to write
+var errNoChange = errors.New("no change")
+
+// updateUserProfile reads the profile, applies the change and writes it back
+func (um *KeycloakUserManager) updateUserProfile(ctx context.Context, change func(cfg *UserProfileConfig) error) error {
+	err := um.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := um.getUserProfile(ctx)
+	if err != nil {
+		return err
+	}
+	err = change(cfg)
+	if errors.Is(err, errNoChange) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return um.putUserProfile(ctx, cfg)
+}
+
+// UserProfileAPIVersion is the first Keycloak version whose user profile is read and
+// written through admin/realms/{realm}/users/profile. Older servers keep it in the
+// declarative-user-profile component
+const UserProfileAPIVersion = 24
+
+// usesUserProfileAPI decides between the users/profile endpoint and the component from the
+// server version. When the version can not be read, which needs a role service accounts
+// do not always have, the endpoint is tried instead
+func (um *KeycloakUserManager) usesUserProfileAPI(ctx context.Context) (bool, error) {
+	s := um.session
+	s.mu.Lock()
+	known := s.profileAPI
+	s.mu.Unlock()
+	if known != nil {
+		return *known, nil
+	}
+
+	var useAPI bool
+	version, err := s.ServerVersion(ctx)
+	if major := MajorVersion(version); err == nil && major > 0 {
+		useAPI = major >= UserProfileAPIVersion
+	} else {
+		_, err = um.getUserProfileAPI(ctx)
+		switch {
+		case err == nil:
+			useAPI = true
+		case Is404(err):
+			useAPI = false
+		default:
+			return false, err
+		}
+	}
+
+	s.mu.Lock()
+	s.profileAPI = &useAPI
+	s.mu.Unlock()
+	return useAPI, nil
+}
+
+func (um *KeycloakUserManager) getUserProfile(ctx context.Context) (*UserProfileConfig, error) {
+	useAPI, err := um.usesUserProfileAPI(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if useAPI {
+		return um.getUserProfileAPI(ctx)
+	}
+	return um.getUserProfileComponent(ctx)
+}
+
+func (um *KeycloakUserManager) putUserProfile(ctx context.Context, cfg *UserProfileConfig) error {
+	useAPI, err := um.usesUserProfileAPI(ctx)
+	if err != nil {
+		return err
+	}
+
+	if useAPI {
+		err = um.putUserProfileAPI(ctx, cfg)
+	} else {
+		err = um.putUserProfileComponent(ctx, cfg)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The validator follows the new profile
+	um.ReloadUserValidation()
+	return nil
+}
+
+func (um *KeycloakUserManager) getUserProfileAPI(ctx context.Context) (*UserProfileConfig, error) {
+	return withToken(ctx, um.session, func(token string) (*UserProfileConfig, error) {
+		var cfg UserProfileConfig
+		resp, err := um.client.GetRequestWithBearerAuth(ctx, token).
+			SetResult(&cfg).
+			Get(um.session.adminURL(um.realm, "users", "profile"))
+		if err := checkResponse(resp, err, "could not get user profile"); err != nil {
+			return nil, err
+		}
+		return &cfg, nil
+	})
+}
+
+func (um *KeycloakUserManager) putUserProfileAPI(ctx context.Context, cfg *UserProfileConfig) error {
+	return um.session.Do(ctx, func(token string) error {
+		resp, err := um.client.GetRequestWithBearerAuth(ctx, token).
+			SetBody(cfg).
+			Put(um.session.adminURL(um.realm, "users", "profile"))
+		return checkResponse(resp, err, "could not update user profile")
+	})
+}
+
+func (um *KeycloakUserManager) getUserProfileComponent(ctx context.Context) (*UserProfileConfig, error) {
+	component, err := um.findComponent(ctx, "declarative-user-profile")
+	if err != nil {
+		return nil, err
+	}
+	if component == nil {
+		return nil, errors.New("No User Profile Found")
+	}
+	cfg, err := um.ParseProfileConfig(component)
+	if err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		return nil, errors.New("Bad kc.user.profile.config")
+	}
+	return cfg, nil
+}
+
+func (um *KeycloakUserManager) putUserProfileComponent(ctx context.Context, cfg *UserProfileConfig) error {
+	component, err := um.findComponent(ctx, "declarative-user-profile")
+	if err != nil {
+		return err
+	}
+	if component == nil {
+		return errors.New("No User Profile Found")
+	}
+
+	strCfg, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+
+	compCfg := make(map[string][]string)
+	if component.ComponentConfig != nil {
+		compCfg = *component.ComponentConfig
+	}
+	compCfg["kc.user.profile.config"] = []string{string(strCfg)}
+	component.ComponentConfig = &compCfg
+
+	return um.session.Do(ctx, func(token string) error {
+		return um.client.UpdateComponent(ctx, token, um.realm, *component)
+	})
+}
@@ -0,0 +1,177 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/stretchr/testify/assert"
+)
+
+const testUserProfile = `{
+  "attributes": [
+    {
+      "name": "username",
+      "displayName": "${username}",
+      "validations": {
+        "length": {"min": 3, "max": 255},
+        "username-prohibited-characters": {},
+        "up-username-not-idn-homograph": {}
+      },
+      "permissions": {"view": ["admin", "user"], "edit": ["admin", "user"]},
+      "multivalued": false
+    },
+    {
+      "name": "firstName",
+      "displayName": "${firstName}",
+      "validations": {
+        "length": {"max": "255"},
+        "person-name-prohibited-characters": {}
+      },
+      "required": {"roles": ["user"]},
+      "permissions": {"view": ["admin", "user"], "edit": ["admin", "user"]},
+      "multivalued": false
+    },
+    {
+      "name": "Badge",
+      "validations": {
+        "pattern": {"pattern": "^[0-9]+$", "error-message": "digits only"},
+        "integer": {"min": "1", "max": 99999},
+        "my-custom-validator": {"strict": true}
+      },
+      "annotations": {"inputType": "text"},
+      "selector": {"scopes": ["badge"]},
+      "permissions": {"view": ["admin"], "edit": ["admin"]},
+      "group": "work",
+      "multivalued": false
+    }
+  ],
+  "groups": [
+    {"name": "work", "displayHeader": "Work", "annotations": {"order": 1}}
+  ],
+  "unmanagedAttributePolicy": "ADMIN_VIEW"
+}`
+
+func TestUserProfileJSON(t *testing.T) {
+	var cfg UserProfileConfig
+	err := json.Unmarshal([]byte(testUserProfile), &cfg)
+	assert.NoError(t, err)
+
+	assert.Equal(t, UnmanagedAttributesAdminView, cfg.UnmanagedAttributePolicy)
+	assert.Equal(t, "Work", cfg.FindGroupByName("work").DisplayHeader)
+
+	username := cfg.FindAttributeByName("username")
+	assert.Equal(t, &ValidationLength{Min: 3, Max: 255}, username.Validations.Length)
+	assert.NotNil(t, username.Validations.UsernameProhibitedCharacters)
+	assert.NotNil(t, username.Validations.UsernameNotIDNHomograph)
+
+	firstName := cfg.FindAttributeByName("firstName")
+	assert.Equal(t, 255, firstName.Validations.Length.Max)
+	assert.Equal(t, []string{"user"}, firstName.Required.Roles)
+
+	badge := cfg.FindAttributeByName("Badge")
+	assert.Equal(t, "^[0-9]+$", badge.Validations.Pattern.Pattern)
+	assert.Equal(t, 1.0, *badge.Validations.Integer.Min)
+	assert.Equal(t, 99999.0, *badge.Validations.Integer.Max)
+	assert.Equal(t, []string{"badge"}, badge.Selector.Scopes)
+	assert.Equal(t, "work", badge.Group)
+	assert.JSONEq(t, `{"strict": true}`, string(badge.Validations.Other["my-custom-validator"]))
+
+	// Writing it back keeps everything, with the numbers normalized
+	data, err := json.Marshal(&cfg)
+	assert.NoError(t, err)
+
+	var again UserProfileConfig
+	err = json.Unmarshal(data, &again)
+	assert.NoError(t, err)
+	againData, err := json.Marshal(&again)
+	assert.NoError(t, err)
+	assert.JSONEq(t, string(data), string(againData))
+
+	var raw map[string]interface{}
+	_ = json.Unmarshal(data, &raw)
+	validations := raw["attributes"].([]interface{})[2].(map[string]interface{})["validations"].(map[string]interface{})
+	assert.Contains(t, validations, "my-custom-validator")
+	assert.Equal(t, 1.0, validations["integer"].(map[string]interface{})["min"])
+
+	var bad Validation
+	err = json.Unmarshal([]byte(`{"length": {"min": "three"}}`), &bad)
+	assert.Error(t, err)
+}
+
+// newFakeProfileServer serves a user profile from users/profile or from the component
+// list, depending on the version it reports. An empty version forbids serverinfo
+func newFakeProfileServer(t *testing.T, version string) (*KeycloakUserManager, *UserProfileConfig) {
+	profile := &UserProfileConfig{Attributes: []*Attribute{AttrUsername}}
+	modern := version == "" || MajorVersion(version) >= UserProfileAPIVersion
+
+	mux, session := fakeKeycloak(t)
+	fakeServerInfo(mux, version)
+	mux.HandleFunc("/admin/realms/master/users/profile", func(w http.ResponseWriter, r *http.Request) {
+		if !modern {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Method == http.MethodPut {
+			_ = json.NewDecoder(r.Body).Decode(profile)
+		}
+		writeJSON(w, profile)
+	})
+	mux.HandleFunc("/admin/realms/master/components", func(w http.ResponseWriter, r *http.Request) {
+		assert.False(t, modern, "components used on a modern server")
+		data, _ := json.Marshal(profile)
+		writeJSON(w, []gocloak.Component{
+			{ID: gocloak.StringP("other")},
+			{
+				ID:              gocloak.StringP("up"),
+				ProviderID:      gocloak.StringP("declarative-user-profile"),
+				ComponentConfig: &map[string][]string{"kc.user.profile.config": {string(data)}},
+			},
+		})
+	})
+	mux.HandleFunc("/admin/realms/master/components/up", func(w http.ResponseWriter, r *http.Request) {
+		assert.False(t, modern, "components used on a modern server")
+		var component gocloak.Component
+		_ = json.NewDecoder(r.Body).Decode(&component)
+		_ = json.Unmarshal([]byte((*component.ComponentConfig)["kc.user.profile.config"][0]), profile)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	um := NewKeycloakUserManagerFromSession(session)
+	um.SetAttributeSchema(NewAttributeSchema(AttrOrganization))
+	return um, profile
+}
+
+func TestUserProfileVersions(t *testing.T) {
+	for _, version := range []string{"24.0.4", "21.1.2", ""} {
+		t.Run("version "+version, func(t *testing.T) {
+			ctx := context.Background()
+			um, profile := newFakeProfileServer(t, version)
+
+			cfg, err := um.GetUserProfile(ctx)
+			assert.NoError(t, err)
+			assert.Nil(t, cfg.FindAttributeByName("Organization"))
+
+			_, err = um.ReconcileAttributeSchema(ctx, ReconcileOptions{})
+			assert.NoError(t, err)
+			assert.NotNil(t, profile.FindAttributeByName("Organization"))
+
+			// Opting in reconciles on the first call only
+			um.SetAttributeSchema(NewAttributeSchema(AttrOrganization, AttrProject))
+			um.SetReconcileOnConnect(&ReconcileOptions{})
+			_, err = um.GetUserProfile(ctx)
+			assert.NoError(t, err)
+			assert.NotNil(t, profile.FindAttributeByName("Project"))
+			profile.Attributes = profile.Attributes[:len(profile.Attributes)-1]
+			_, err = um.GetUserProfile(ctx)
+			assert.NoError(t, err)
+			assert.Nil(t, profile.FindAttributeByName("Project"))
+
+			err = um.AddUserProfileAttribute(ctx, &Attribute{Name: "Badge"})
+			assert.NoError(t, err)
+			assert.NotNil(t, profile.FindAttributeByName("Badge"))
+			assert.NotNil(t, profile.FindAttributeByName("username"))
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package keycloak
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy/models"
+)
+
+// AttributeSearch finds users by their custom attributes. Every attribute must match
+type AttributeSearch struct {
+	Attributes map[string]string
+	// Exact requires whole values to match, otherwise a value matches when it contains
+	// the search value. Keycloak ignores case either way
+	Exact bool
+	// Custom attributes to return, empty returns all of them
+	Attrs []string
+}
+
+// FindUsersByAttribute returns every user whose attribute exactly equals value
+func (um *KeycloakUserManager) FindUsersByAttribute(ctx context.Context, name string, value string) ([]*models.User, error) {
+	search := &AttributeSearch{
+		Attributes: map[string]string{name: value},
+		Exact:      true,
+	}
+
+	var rtn []*models.User
+	page := &PageRequest{First: 0, Max: PageSize}
+	for page != nil {
+		some, next, err := um.FindUsers(ctx, search, page)
+		if err != nil {
+			return rtn, err
+		}
+		rtn = append(rtn, some...)
+		page = next
+	}
+	return rtn, nil
+}
+
+// FindUsers returns one page of the users matching the search through Keycloak's q
+// parameter, along with the next page to request. The next page is nil at the end.
+// A nil page starts at the beginning with PageSize users
+func (um *KeycloakUserManager) FindUsers(ctx context.Context, search *AttributeSearch, page *PageRequest) ([]*models.User, *PageRequest, error) {
+	if search == nil || len(search.Attributes) == 0 {
+		return nil, nil, errors.New("attribute search requires at least one attribute")
+	}
+	q, err := AttributeQuery(search.Attributes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = um.connect(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if page == nil {
+		page = &PageRequest{First: 0, Max: PageSize}
+	}
+
+	params := gocloak.GetUsersParams{
+		Q:     &q,
+		Exact: gocloak.BoolP(search.Exact),
+	}
+	found, next, err := um.listUserPage(ctx, params, page)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rtn := make([]*models.User, 0, len(found))
+	for _, usr := range found {
+		u := um.schema.Load().ToCloudy(usr)
+		trimAttributes(u, search.Attrs)
+		rtn = append(rtn, u)
+	}
+	return rtn, next, nil
+}
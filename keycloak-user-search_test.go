@@ -0,0 +1,42 @@
+package keycloak
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindUsers(t *testing.T) {
+	ctx := context.Background()
+	um, queries := newFakeUserManager(t, 250)
+
+	found, err := um.FindUsersByAttribute(ctx, "Organization", "ACME")
+	assert.NoError(t, err)
+	assert.Len(t, found, 250)
+	assert.Len(t, *queries, 3)
+	for _, raw := range *queries {
+		q, _ := url.ParseQuery(raw)
+		assert.Equal(t, "Organization:ACME", q.Get("q"))
+		assert.Equal(t, "true", q.Get("exact"))
+	}
+
+	*queries = nil
+	page, next, err := um.FindUsers(ctx, &AttributeSearch{
+		Attributes: map[string]string{"Organization": "AC", "Project": "X"},
+		Attrs:      []string{"Project"},
+	}, &PageRequest{First: 10, Max: 20})
+	assert.NoError(t, err)
+	assert.Len(t, page, 20)
+	assert.Equal(t, "user-10", page[0].Username)
+	assert.Equal(t, map[string]string{"Project": "X"}, page[0].Attributes)
+	assert.Equal(t, &PageRequest{First: 30, Max: 20}, next)
+
+	q, _ := url.ParseQuery((*queries)[0])
+	assert.Equal(t, "Organization:AC Project:X", q.Get("q"))
+	assert.Equal(t, "false", q.Get("exact"))
+
+	_, _, err = um.FindUsers(ctx, &AttributeSearch{}, nil)
+	assert.Error(t, err)
+}
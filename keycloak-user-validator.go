@@ -0,0 +1,352 @@
+package keycloak
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/appliedres/cloudy/models"
+)
+
+var ErrInvalidUser = errors.New("invalid user")
+
+// Default patterns of Keycloak's person-name-prohibited-characters and
+// username-prohibited-characters validators
+var personNameProhibited = regexp.MustCompile(`[<>&"$%!#?§;*~/\\|^=\[\]{}()\x00-\x1F\x7F]`)
+var usernameProhibited = regexp.MustCompile(`[<>&"'\s$%!#?§,;:*~/\\|^=\[\]{}()` + "`" + `\x00-\x1F\x7F]`)
+
+// FieldError is a problem with one user field or attribute
+type FieldError struct {
+	// Attribute name, username, email, firstName, lastName or a custom attribute
+	Field string
+	// Validator that failed, such as length or pattern. "required" for missing values
+	Validator string
+	Message   string
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Field, e.Message)
+}
+
+// ValidationErrors are all the problems found with a user. errors.Is(err, ErrInvalidUser) is true
+type ValidationErrors []*FieldError
+
+func (v ValidationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v {
+		msgs[i] = e.Error()
+	}
+	return fmt.Sprintf("%v: %v", ErrInvalidUser, strings.Join(msgs, "; "))
+}
+
+func (v ValidationErrors) Is(target error) bool {
+	return target == ErrInvalidUser
+}
+
+// Field returns the errors of one field
+func (v ValidationErrors) Field(name string) []*FieldError {
+	var rtn []*FieldError
+	for _, e := range v {
+		if e.Field == name {
+			rtn = append(rtn, e)
+		}
+	}
+	return rtn
+}
+
+// only keeps the errors of the given fields, nil when none are left
+func (v ValidationErrors) only(fields map[string]bool) error {
+	var rtn ValidationErrors
+	for _, e := range v {
+		if fields[e.Field] {
+			rtn = append(rtn, e)
+		}
+	}
+	if len(rtn) == 0 {
+		return nil
+	}
+	return rtn
+}
+
+// UserValidator checks users against a realm's user profile before they are sent to
+// Keycloak. It applies the built in validators the way an admin would be checked, so
+// attributes required only for the user role are not required. Custom validators, the
+// IDN homograph check, local-date, which depends on the user's locale, and Java patterns
+// Go can not compile, such as lookaheads or backreferences, are left to the server
+type UserValidator struct {
+	profile *UserProfileConfig
+}
+
+func NewUserValidator(profile *UserProfileConfig) *UserValidator {
+	return &UserValidator{profile: profile}
+}
+
+// Validate returns ValidationErrors listing every problem, or nil
+func (v *UserValidator) Validate(u *models.User) error {
+	var errs ValidationErrors
+	for _, attr := range v.profile.Attributes {
+		errs = append(errs, validateAttribute(attr, userValues(u, attr.Name))...)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func userValues(u *models.User, name string) []string {
+	switch name {
+	case "username":
+		return nonEmpty(u.Username)
+	case "email":
+		return nonEmpty(u.Email)
+	case "firstName":
+		return nonEmpty(u.FirstName)
+	case "lastName":
+		return nonEmpty(u.LastName)
+	}
+	var rtn []string
+	for _, val := range GetAttributeValues(u, name) {
+		rtn = append(rtn, nonEmpty(val)...)
+	}
+	return rtn
+}
+
+func nonEmpty(val string) []string {
+	if strings.TrimSpace(val) == "" {
+		return nil
+	}
+	return []string{val}
+}
+
+func validateAttribute(attr *Attribute, values []string) []*FieldError {
+	var errs []*FieldError
+	fail := func(validator string, custom string, format string, args ...interface{}) {
+		msg := custom
+		if msg == "" {
+			msg = fmt.Sprintf(format, args...)
+		}
+		errs = append(errs, &FieldError{Field: attr.Name, Validator: validator, Message: msg})
+	}
+
+	if len(values) == 0 {
+		if isRequiredForAdmin(attr) {
+			fail("required", "", "is required")
+		}
+		return errs
+	}
+
+	val := attr.Validations
+	if m := val.Multivalued; m != nil {
+		if m.Min > 0 && len(values) < m.Min {
+			fail("multivalued", m.ErrorMessage, "needs at least %v values", m.Min)
+		}
+		if m.Max > 0 && len(values) > m.Max {
+			fail("multivalued", m.ErrorMessage, "allows at most %v values", m.Max)
+		}
+	} else if !attr.Multivalued && len(values) > 1 {
+		fail("multivalued", "", "allows only one value")
+	}
+
+	// Keycloak matches Java patterns against the whole value. Ones RE2 can not compile are skipped
+	var pattern *regexp.Regexp
+	if p := val.Pattern; p != nil {
+		pattern, _ = regexp.Compile("^(?:" + p.Pattern + ")$")
+	}
+
+	for _, value := range values {
+		if l := val.Length; l != nil {
+			s := value
+			if !l.TrimDisabled {
+				s = strings.TrimSpace(s)
+			}
+			n := utf8.RuneCountInString(s)
+			if (l.Min > 0 && n < l.Min) || (l.Max > 0 && n > l.Max) {
+				fail("length", l.ErrorMessage, "length must be between %v and %v", l.Min, lengthMax(l.Max))
+			}
+		}
+		if p := val.Pattern; pattern != nil && !pattern.MatchString(value) {
+			fail("pattern", p.ErrorMessage, "does not match %v", p.Pattern)
+		}
+		if e := val.Email; e != nil {
+			maxLocal := e.MaxLocalLength
+			if maxLocal == 0 {
+				maxLocal = 64
+			}
+			addr, err := mail.ParseAddress(value)
+			if err != nil || addr.Address != value || addr.Name != "" {
+				fail("email", e.ErrorMessage, "is not a valid email address")
+			} else if local, _, _ := strings.Cut(value, "@"); len(local) > maxLocal {
+				fail("email", e.ErrorMessage, "has more than %v characters before the @", maxLocal)
+			}
+		}
+		if o := val.Options; o != nil && !slices.Contains(o.Options, value) {
+			fail("options", o.ErrorMessage, "must be one of %v", strings.Join(o.Options, ", "))
+		}
+		if m := val.PersonNameProhibitedCharacters; m != nil && personNameProhibited.MatchString(value) {
+			fail("person-name-prohibited-characters", m.ErrorMessage, "contains characters that are not allowed in names")
+		}
+		if m := val.UsernameProhibitedCharacters; m != nil && usernameProhibited.MatchString(value) {
+			fail("username-prohibited-characters", m.ErrorMessage, "contains characters that are not allowed in user names")
+		}
+		if u := val.URI; u != nil {
+			if msg := checkURI(u, value); msg != "" {
+				fail("uri", u.ErrorMessage, msg)
+			}
+		}
+		if r := val.Integer; r != nil {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				fail("integer", r.ErrorMessage, "must be a whole number")
+			} else if !inRange(r, float64(n)) {
+				fail("integer", r.ErrorMessage, "must be %v", rangeText(r))
+			}
+		}
+		if r := val.Double; r != nil {
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				fail("double", r.ErrorMessage, "must be a number")
+			} else if !inRange(r, n) {
+				fail("double", r.ErrorMessage, "must be %v", rangeText(r))
+			}
+		}
+		if m := val.ISODate; m != nil {
+			if _, err := time.Parse(time.DateOnly, value); err != nil {
+				fail("iso-date", m.ErrorMessage, "must be a date such as 2024-01-31")
+			}
+		}
+	}
+	return errs
+}
+
+// isRequiredForAdmin is true when the attribute is required with no roles or for the admin role
+func isRequiredForAdmin(attr *Attribute) bool {
+	if attr.Required == nil {
+		return false
+	}
+	return len(attr.Required.Roles) == 0 || slices.Contains(attr.Required.Roles, AttributePermissionAdmin)
+}
+
+func lengthMax(max int) interface{} {
+	if max == 0 {
+		return "any"
+	}
+	return max
+}
+
+func inRange(r *ValidationRange, n float64) bool {
+	return (r.Min == nil || n >= *r.Min) && (r.Max == nil || n <= *r.Max)
+}
+
+func rangeText(r *ValidationRange) string {
+	switch {
+	case r.Min != nil && r.Max != nil:
+		return fmt.Sprintf("between %v and %v", *r.Min, *r.Max)
+	case r.Min != nil:
+		return fmt.Sprintf("at least %v", *r.Min)
+	case r.Max != nil:
+		return fmt.Sprintf("at most %v", *r.Max)
+	}
+	return "a number"
+}
+
+// checkURI follows Keycloak's uri validator, which allows http and https by default
+func checkURI(cfg *ValidationURI, value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return "is not a valid uri"
+	}
+	schemes := cfg.AllowedSchemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+	if !slices.Contains(schemes, u.Scheme) {
+		return fmt.Sprintf("must use %v", strings.Join(schemes, " or "))
+	}
+	if cfg.AllowFragment != nil && !*cfg.AllowFragment && u.Fragment != "" {
+		return "must not have a fragment"
+	}
+	if (cfg.RequireValidUrl == nil || *cfg.RequireValidUrl) && u.Host == "" && u.Opaque == "" {
+		return "is not a valid url"
+	}
+	return ""
+}
+
+/// ------------- USER MANAGER
+
+// SetUserValidation turns on checking users against the realm's user profile in NewUser
+// and UpdateUser. Invalid users fail with ValidationErrors without calling Keycloak
+func (um *KeycloakUserManager) SetUserValidation(enabled bool) {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.validate = enabled
+}
+
+// ValidateUser checks a user against the realm's user profile, returning ValidationErrors
+func (um *KeycloakUserManager) ValidateUser(ctx context.Context, u *models.User) error {
+	err := um.connect(ctx)
+	if err != nil {
+		return err
+	}
+	validator, err := um.userValidator(ctx)
+	if err != nil {
+		return err
+	}
+	return validator.Validate(u)
+}
+
+// checkUser validates the user when validation is turned on
+func (um *KeycloakUserManager) checkUser(ctx context.Context, u *models.User) error {
+	um.mu.Lock()
+	enabled := um.validate
+	um.mu.Unlock()
+	if !enabled {
+		return nil
+	}
+	validator, err := um.userValidator(ctx)
+	if err != nil {
+		return err
+	}
+	return validator.Validate(u)
+}
+
+// ReloadUserValidation drops the cached user profile so the next validation reads it again.
+// Call it when the profile may have been changed outside this manager
+func (um *KeycloakUserManager) ReloadUserValidation() {
+	um.mu.Lock()
+	defer um.mu.Unlock()
+	um.validator = nil
+	um.validatorGen++
+}
+
+// userValidator returns the validator of the current profile. It is loaded once and only
+// reloaded after this manager changes the profile or ReloadUserValidation is called
+func (um *KeycloakUserManager) userValidator(ctx context.Context) (*UserValidator, error) {
+	um.mu.Lock()
+	validator, gen := um.validator, um.validatorGen
+	um.mu.Unlock()
+	if validator != nil {
+		return validator, nil
+	}
+
+	profile, err := um.getUserProfile(ctx)
+	if err != nil {
+		return nil, err
+	}
+	validator = NewUserValidator(profile)
+
+	// A profile read before a reload may be stale, use it but do not cache it
+	um.mu.Lock()
+	if um.validatorGen == gen {
+		um.validator = validator
+	}
+	um.mu.Unlock()
+	return validator, nil
+}
@@ -0,0 +1,142 @@
+package keycloak
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/appliedres/cloudy/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserValidator(t *testing.T) {
+	var profile UserProfileConfig
+	err := json.Unmarshal([]byte(testUserProfile), &profile)
+	assert.NoError(t, err)
+	profile.Attributes = append(profile.Attributes,
+		&Attribute{
+			Name:     "email",
+			Required: &Required{Roles: []string{"admin", "user"}},
+			Validations: Validation{
+				Email: &ValidationEmail{},
+			},
+		},
+		&Attribute{
+			Name: "Citizenship",
+			Validations: Validation{
+				Options: &ValidationOptions{Options: []string{"US", "CA"}},
+			},
+		},
+		&Attribute{
+			Name:        "Phones",
+			Multivalued: true,
+			Validations: Validation{
+				Pattern:     &ValidationPattern{Pattern: `^\+?[0-9 -]+$`},
+				Multivalued: &ValidationLength{Max: 2},
+			},
+		},
+	)
+	validator := NewUserValidator(&profile)
+
+	good := &models.User{
+		Username:   "bob.smith",
+		FirstName:  "Bob",
+		Email:      "bob@example.com",
+		Attributes: map[string]string{"Badge": "1234", "Citizenship": "US"},
+	}
+	SetAttributeValues(good, "Phones", "+1 555 0100", "555-0101")
+	assert.NoError(t, validator.Validate(good))
+
+	bad := &models.User{
+		Username:   "b<b",
+		FirstName:  "Bob (the builder)",
+		Attributes: map[string]string{"Badge": "12ab", "Citizenship": "FR"},
+	}
+	SetAttributeValues(bad, "Phones", "1", "2", "three")
+	err = validator.Validate(bad)
+	assert.True(t, errors.Is(err, ErrInvalidUser))
+
+	var errs ValidationErrors
+	assert.True(t, errors.As(err, &errs))
+	assert.Equal(t, "username-prohibited-characters", errs.Field("username")[0].Validator)
+	assert.Equal(t, "person-name-prohibited-characters", errs.Field("firstName")[0].Validator)
+	assert.Equal(t, "required", errs.Field("email")[0].Validator)
+	assert.Equal(t, "options", errs.Field("Citizenship")[0].Validator)
+
+	badge := errs.Field("Badge")
+	assert.Len(t, badge, 2)
+	assert.Equal(t, "digits only", badge[0].Message)
+	assert.Equal(t, "integer", badge[1].Validator)
+
+	phones := errs.Field("Phones")
+	assert.Len(t, phones, 2)
+	assert.Equal(t, "multivalued", phones[0].Validator)
+	assert.Equal(t, "pattern", phones[1].Validator)
+}
+
+func TestUserManagerValidation(t *testing.T) {
+	ctx := context.Background()
+	um, profile := newFakeProfileServer(t, "24.0.4")
+	profile.Attributes = append(profile.Attributes, &Attribute{
+		Name:        "Organization",
+		Validations: Validation{Length: &ValidationLength{Max: 5}},
+	})
+
+	usr := &models.User{Username: "bob", Attributes: map[string]string{"Organization": "Too long"}}
+	err := um.ValidateUser(ctx, usr)
+	assert.ErrorIs(t, err, ErrInvalidUser)
+
+	// Off by default, so the fake server's missing users endpoint is reached
+	_, err = um.NewUser(ctx, usr)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrInvalidUser)
+
+	um.SetUserValidation(true)
+	_, err = um.NewUser(ctx, usr)
+	assert.ErrorIs(t, err, ErrInvalidUser)
+	err = um.UpdateUser(ctx, usr)
+	assert.ErrorIs(t, err, ErrInvalidUser)
+
+	// Changing the profile through the manager updates the validator
+	err = um.UpdateUserProfileAttribute(ctx, &Attribute{Name: "Organization"})
+	assert.NoError(t, err)
+	assert.NoError(t, um.ValidateUser(ctx, usr))
+
+	// Changes made elsewhere are seen only after a reload
+	profile.Attributes[len(profile.Attributes)-1].Validations.Length = &ValidationLength{Max: 5}
+	assert.NoError(t, um.ValidateUser(ctx, usr))
+	um.ReloadUserValidation()
+	assert.ErrorIs(t, um.ValidateUser(ctx, usr), ErrInvalidUser)
+
+	// A failed change keeps the cached validator
+	cached := um.validator
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	err = um.UpdateUserProfileAttribute(cancelled, &Attribute{Name: "Organization"})
+	assert.Error(t, err)
+	assert.Same(t, cached, um.validator)
+}
+
+func TestUserValidatorPatternsAndDates(t *testing.T) {
+	validator := NewUserValidator(&UserProfileConfig{Attributes: []*Attribute{
+		{Name: "Code", Validations: Validation{Pattern: &ValidationPattern{Pattern: `[a-z]+`}}},
+		{Name: "Lookahead", Validations: Validation{Pattern: &ValidationPattern{Pattern: `(?=.*[0-9])[a-z0-9]+`}}},
+		{Name: "Possessive", Validations: Validation{Pattern: &ValidationPattern{Pattern: `a++`}}},
+		{Name: "Birthday", Validations: Validation{LocalDate: &ValidationMessage{}}},
+		{Name: "Hired", Validations: Validation{ISODate: &ValidationMessage{}}},
+	}})
+
+	valid := &models.User{Attributes: map[string]string{"Code": "abc", "Lookahead": "abc1", "Birthday": "31/01/2024", "Hired": "2024-01-31"}}
+	assert.NoError(t, validator.Validate(valid))
+
+	// Patterns must match the whole value, local dates and Java only patterns are left to Keycloak
+	invalid := &models.User{Attributes: map[string]string{"Code": "abc1", "Lookahead": "abc", "Possessive": "b", "Hired": "31/01/2024"}}
+	var errs ValidationErrors
+	assert.True(t, errors.As(validator.Validate(invalid), &errs))
+	assert.Equal(t, "pattern", errs.Field("Code")[0].Validator)
+	assert.Empty(t, errs.Field("Lookahead"))
+	assert.Empty(t, errs.Field("Possessive"))
+	assert.Equal(t, "iso-date", errs.Field("Hired")[0].Validator)
+	assert.Empty(t, errs.Field("Birthday"))
+}
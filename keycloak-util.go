@@ -2,9 +2,11 @@ package keycloak
 
 import (
 	"context"
+	"errors"
 	"fmt"
 
 	"github.com/Nerzal/gocloak/v13"
+	"github.com/appliedres/cloudy"
 )
 
 type KeyCloakConn struct {
@@ -12,46 +14,96 @@ type KeyCloakConn struct {
 	User    string
 	Pwd     string
 	Realm   string
-	Client  *gocloak.GoCloak
+	// Realm the user logs in to, defaults to Realm
+	AuthRealm string
+	Client    *gocloak.GoCloak
+	// Token the connection logged in with, CurrentToken keeps it up to date
 	Token   *gocloak.JWT
+	Session *KeycloakSession
 }
 
 func NewKeyCloakConn(ctx context.Context, address string, user string, pwd string, realm string) (*KeyCloakConn, error) {
-	client := gocloak.NewClient(address)
-	if realm == "" {
-		realm = "master"
+	key := &KeyCloakConn{
+		Address: address,
+		User:    user,
+		Pwd:     pwd,
+		Realm:   realm,
 	}
-	token, err := client.LoginAdmin(ctx, user, pwd, realm)
+	err := key.Connect(ctx)
 	if err != nil {
 		return nil, err
 	}
+	return key, nil
+}
 
+func NewKeyCloakConnFromEnv(ctx context.Context, env *cloudy.Environment) (*KeyCloakConn, error) {
+	session, err := NewKeycloakSessionFromEnv(env)
+	if err != nil {
+		return nil, err
+	}
+	key := NewKeyCloakConnFromSession(session)
+	err = key.Session.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = key.CurrentToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// NewKeyCloakConnFromSession creates a connection that shares the login of the given session.
+// Token is the session's token, nil until the session has logged in
+func NewKeyCloakConnFromSession(session *KeycloakSession) *KeyCloakConn {
 	return &KeyCloakConn{
-		Address: address,
-		User:    user,
-		Pwd:     pwd,
-		Realm:   realm,
-		Client:  client,
-		Token:   token,
-	}, nil
+		Address:   session.Address(),
+		Realm:     session.Realm(),
+		AuthRealm: session.AuthRealm(),
+		Client:    session.Client(),
+		Token:     session.tokens.last(),
+		Session:   session,
+	}
+}
+
+var ErrNotConnected = errors.New("keycloak connection is not connected")
+
+// CurrentToken returns the session's current token, refreshing it when it is about to
+// expire, and stores it in Token. It fails with ErrNotConnected before Connect. Prefer
+// Session.Do, which also retries rejected tokens
+func (key *KeyCloakConn) CurrentToken(ctx context.Context) (*gocloak.JWT, error) {
+	if key.Session == nil {
+		return nil, ErrNotConnected
+	}
+	token, err := key.Session.tokens.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key.Token = token
+	return token, nil
 }
 
 func (key *KeyCloakConn) Connect(ctx context.Context) error {
-	client := gocloak.NewClient(key.Address)
 	if key.Realm == "" {
 		key.Realm = "master"
 	}
-	token, err := client.LoginAdmin(ctx, key.User, key.Pwd, key.Realm)
+	if key.AuthRealm == "" {
+		key.AuthRealm = key.Realm
+	}
+	creds := &AdminCredentials{User: key.User, Password: key.Pwd}
+	session := NewKeycloakSessionWithCredentials(key.Address, creds, key.AuthRealm, key.Realm)
+	err := session.Connect(ctx)
 	if err != nil {
 		return err
 	}
-	key.Client = client
-	key.Token = token
-	return nil
+	key.Client = session.Client()
+	key.Session = session
+	_, err = key.CurrentToken(ctx)
+	return err
 }
 
 func (key *KeyCloakConn) NewOIDCWebClient(ctx context.Context, name string, url string, urlRedirect string, urlLogout string) (string, error) {
-	rtn, err := key.Client.CreateClient(ctx, key.Token.AccessToken, key.Realm, gocloak.Client{
+	client := gocloak.Client{
 		WebOrigins:         &[]string{"*"},
 		ClientID:           ptr(name),
 		Name:               ptr(name),
@@ -64,8 +116,10 @@ func (key *KeyCloakConn) NewOIDCWebClient(ctx context.Context, name string, url
 		Attributes: &map[string]string{
 			"post.logout.redirect.uris": "http://localhost:4200##http://localhost:4200/signout##http://localhost:4200/signin",
 		},
+	}
+	return withToken(ctx, key.Session, func(token string) (string, error) {
+		return key.Client.CreateClient(ctx, token, key.Realm, client)
 	})
-	return rtn, err
 }
 
 func ptr[T any](i T) *T {
@@ -84,15 +138,19 @@ func (key *KeyCloakConn) SyncLdapNow(ctx context.Context, ldapname string, fullS
 		url += "?action=triggerChangedUsersSync"
 	}
 
-	if response, postErr := key.Client.RestyClient().NewRequest().SetAuthToken(key.Token.AccessToken).Post(url); postErr != nil {
-		return postErr
-	} else {
-		if response.StatusCode() != 200 {
-			postErr = fmt.Errorf("got status code '%d' with response body '%s'", response.StatusCode(), response.String())
+	return key.Session.Do(ctx, func(token string) error {
+		if response, postErr := key.Client.RestyClient().NewRequest().SetContext(ctx).SetAuthToken(token).Post(url); postErr != nil {
 			return postErr
+		} else {
+			if response.StatusCode() != 200 {
+				return &gocloak.APIError{
+					Code:    response.StatusCode(),
+					Message: fmt.Sprintf("got status code '%d' with response body '%s'", response.StatusCode(), response.String()),
+				}
+			}
 		}
-	}
-	return nil
+		return nil
+	})
 }
 
 func (key *KeyCloakConn) AddADLdapSync(ctx context.Context, host string, port string, baseDn string, user string, bindPwd string) (string, error) {
@@ -104,7 +162,9 @@ func (key *KeyCloakConn) AddADLdapSync(ctx context.Context, host string, port st
 	bindDN := fmt.Sprintf("CN=%v,%v", "Administrator", usersDN)
 
 	fmt.Printf("bindDN : %v\n", bindDN)
-	r, err := key.Client.GetRealm(ctx, key.Token.AccessToken, key.Realm)
+	r, err := withToken(ctx, key.Session, func(token string) (*gocloak.RealmRepresentation, error) {
+		return key.Client.GetRealm(ctx, token, key.Realm)
+	})
 	if err != nil {
 		return "", err
 	}
@@ -146,7 +206,9 @@ func (key *KeyCloakConn) AddADLdapSync(ctx context.Context, host string, port st
 		ParentID:        r.ID,
 		ComponentConfig: &userFederationConfig,
 	}
-	ldapComponentId, err := key.Client.CreateComponent(ctx, key.Token.AccessToken, key.Realm, userFederation)
+	ldapComponentId, err := withToken(ctx, key.Session, func(token string) (string, error) {
+		return key.Client.CreateComponent(ctx, token, key.Realm, userFederation)
+	})
 	if err != nil {
 		return "", err
 	}
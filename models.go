@@ -1,30 +1,94 @@
 package keycloak
 
+import "encoding/json"
+
 const (
 	AttributePermissionAdmin = "admin"
-	AttributePermissionUser  = "admin"
+	AttributePermissionUser  = "user"
 )
 
+// Unmanaged attribute policies of a user profile, attributes outside the profile are
+// not stored at all when the policy is unset
+const (
+	UnmanagedAttributesEnabled   = "ENABLED"
+	UnmanagedAttributesAdminView = "ADMIN_VIEW"
+	UnmanagedAttributesAdminEdit = "ADMIN_EDIT"
+)
+
+// UserProfileConfig is Keycloak's declarative user profile
 type UserProfileConfig struct {
-	Attributes []*Attribute      `json:"attributes"`
-	Groups     []*AttributeGroup `json:"groups"`
+	Attributes               []*Attribute      `json:"attributes"`
+	Groups                   []*AttributeGroup `json:"groups"`
+	UnmanagedAttributePolicy string            `json:"unmanagedAttributePolicy,omitempty"`
 }
 
 type AttributeGroup struct {
-	Name               string `json:"name"`
-	DisplayHeader      string `json:"displayHeader"`
-	DisplayDescription string `json:"displayDescription"`
+	Name               string                 `json:"name"`
+	DisplayHeader      string                 `json:"displayHeader,omitempty"`
+	DisplayDescription string                 `json:"displayDescription,omitempty"`
+	Annotations        map[string]interface{} `json:"annotations,omitempty"`
 }
 
+// Validation holds the validators of an attribute, keyed by validator name in Keycloak.
+// Validators that are not modelled here, such as custom ones, are kept in Other so they
+// survive reading and writing the profile
 type Validation struct {
-	Length *ValidationLength `json:"length"`
-	// UsernameProhibitedCharacters struct{}          `json:"username-prohibited-characters"`
-	// UPUsernameNotIDNHomograph    struct{}          `json:"up-username-not-idn-homograph"`
+	Length                         *ValidationLength  `json:"length,omitempty"`
+	Pattern                        *ValidationPattern `json:"pattern,omitempty"`
+	Email                          *ValidationEmail   `json:"email,omitempty"`
+	Options                        *ValidationOptions `json:"options,omitempty"`
+	PersonNameProhibitedCharacters *ValidationMessage `json:"person-name-prohibited-characters,omitempty"`
+	UsernameProhibitedCharacters   *ValidationMessage `json:"username-prohibited-characters,omitempty"`
+	UsernameNotIDNHomograph        *ValidationMessage `json:"up-username-not-idn-homograph,omitempty"`
+	URI                            *ValidationURI     `json:"uri,omitempty"`
+	Integer                        *ValidationRange   `json:"integer,omitempty"`
+	Double                         *ValidationRange   `json:"double,omitempty"`
+	LocalDate                      *ValidationMessage `json:"local-date,omitempty"`
+	ISODate                        *ValidationMessage `json:"iso-date,omitempty"`
+	Multivalued                    *ValidationLength  `json:"multivalued,omitempty"`
+
+	Other map[string]json.RawMessage `json:"-"`
 }
 
 type ValidationLength struct {
-	Min int `json:"min"`
-	Max int `json:"max"`
+	Min          int    `json:"min,omitempty"`
+	Max          int    `json:"max,omitempty"`
+	TrimDisabled bool   `json:"trim-disabled,omitempty"`
+	ErrorMessage string `json:"error-message,omitempty"`
+}
+
+type ValidationPattern struct {
+	Pattern      string `json:"pattern"`
+	ErrorMessage string `json:"error-message,omitempty"`
+}
+
+type ValidationEmail struct {
+	MaxLocalLength int    `json:"max-local-length,omitempty"`
+	ErrorMessage   string `json:"error-message,omitempty"`
+}
+
+type ValidationOptions struct {
+	Options      []string `json:"options"`
+	ErrorMessage string   `json:"error-message,omitempty"`
+}
+
+type ValidationURI struct {
+	AllowedSchemes  []string `json:"allowedSchemes,omitempty"`
+	AllowFragment   *bool    `json:"allowFragment,omitempty"`
+	RequireValidUrl *bool    `json:"requireValidUrl,omitempty"`
+	ErrorMessage    string   `json:"error-message,omitempty"`
+}
+
+// ValidationRange configures the integer and double validators
+type ValidationRange struct {
+	Min          *float64 `json:"min,omitempty"`
+	Max          *float64 `json:"max,omitempty"`
+	ErrorMessage string   `json:"error-message,omitempty"`
+}
+
+// ValidationMessage configures validators that only take an error message
+type ValidationMessage struct {
+	ErrorMessage string `json:"error-message,omitempty"`
 }
 
 type Permissions struct {
@@ -32,19 +96,36 @@ type Permissions struct {
 	Edit []string `json:"edit"`
 }
 
+// Required makes an attribute required for the given roles (admin, user) and, for users,
+// only when one of the scopes is requested
+type Required struct {
+	Roles  []string `json:"roles,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// Selector limits an attribute to logins requesting one of the scopes
+type Selector struct {
+	Scopes []string `json:"scopes,omitempty"`
+}
+
 type Attribute struct {
-	Name        string      `json:"name"`
-	DisplayName string      `json:"displayName"`
-	Validations Validation  `json:"validations"`
-	Permissions Permissions `json:"permissions"`
-	Multivalued bool        `json:"multivalued"`
+	Name        string                 `json:"name"`
+	DisplayName string                 `json:"displayName,omitempty"`
+	Validations Validation             `json:"validations"`
+	Annotations map[string]interface{} `json:"annotations,omitempty"`
+	Required    *Required              `json:"required,omitempty"`
+	Permissions Permissions            `json:"permissions"`
+	Selector    *Selector              `json:"selector,omitempty"`
+	// Name of the AttributeGroup the attribute is shown in
+	Group       string `json:"group,omitempty"`
+	Multivalued bool   `json:"multivalued"`
 }
 
 var AttrUsername = &Attribute{
 	Name:        "username",
 	DisplayName: "${username}",
 	Validations: Validation{
-		&ValidationLength{Min: 3, Max: 255},
+		Length: &ValidationLength{Min: 3, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
@@ -57,7 +138,7 @@ var AttrEmail = &Attribute{
 	Name:        "email",
 	DisplayName: "${email}",
 	Validations: Validation{
-		&ValidationLength{Min: 3, Max: 255},
+		Length: &ValidationLength{Min: 3, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
@@ -70,7 +151,7 @@ var AttrFirstName = &Attribute{
 	Name:        "firstName",
 	DisplayName: "${firstName}",
 	Validations: Validation{
-		&ValidationLength{Min: 3, Max: 255},
+		Length: &ValidationLength{Min: 3, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
@@ -83,7 +164,7 @@ var AttrLastName = &Attribute{
 	Name:        "lastName",
 	DisplayName: "${lastName}",
 	Validations: Validation{
-		&ValidationLength{Min: 3, Max: 255},
+		Length: &ValidationLength{Min: 3, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
@@ -105,15 +186,24 @@ func (cfg *UserProfileConfig) FindAttributeByName(name string) *Attribute {
 	return nil
 }
 
+func (cfg *UserProfileConfig) FindGroupByName(name string) *AttributeGroup {
+	for _, existing := range cfg.Groups {
+		if existing.Name == name {
+			return existing
+		}
+	}
+	return nil
+}
+
 var AttrAccountType = &Attribute{
 	Name:        "AccountType",
 	DisplayName: "AccountType",
 	Validations: Validation{
-		&ValidationLength{Min: 1, Max: 255},
+		Length: &ValidationLength{Min: 1, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
-		Edit: []string{AttributePermissionAdmin, AttributePermissionUser},
+		Edit: []string{AttributePermissionAdmin},
 	},
 	Multivalued: false,
 }
@@ -121,11 +211,11 @@ var AttrCitizenship = &Attribute{
 	Name:        "Citizenship",
 	DisplayName: "Citizenship",
 	Validations: Validation{
-		&ValidationLength{Min: 1, Max: 255},
+		Length: &ValidationLength{Min: 1, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
-		Edit: []string{AttributePermissionAdmin, AttributePermissionUser},
+		Edit: []string{AttributePermissionAdmin},
 	},
 	Multivalued: false,
 }
@@ -134,11 +224,11 @@ var AttrCompany = &Attribute{
 	Name:        "Company",
 	DisplayName: "Company",
 	Validations: Validation{
-		&ValidationLength{Min: 1, Max: 255},
+		Length: &ValidationLength{Min: 1, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
-		Edit: []string{AttributePermissionAdmin, AttributePermissionUser},
+		Edit: []string{AttributePermissionAdmin},
 	},
 	Multivalued: false,
 }
@@ -147,11 +237,11 @@ var AttrContractDate = &Attribute{
 	Name:        "ContractDate",
 	DisplayName: "ContractDate",
 	Validations: Validation{
-		&ValidationLength{Min: 1, Max: 255},
+		Length: &ValidationLength{Min: 1, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
-		Edit: []string{AttributePermissionAdmin, AttributePermissionUser},
+		Edit: []string{AttributePermissionAdmin},
 	},
 	Multivalued: false,
 }
@@ -160,11 +250,11 @@ var AttrContractNumber = &Attribute{
 	Name:        "ContractNumber",
 	DisplayName: "ContractNumber",
 	Validations: Validation{
-		&ValidationLength{Min: 1, Max: 255},
+		Length: &ValidationLength{Min: 1, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
-		Edit: []string{AttributePermissionAdmin, AttributePermissionUser},
+		Edit: []string{AttributePermissionAdmin},
 	},
 	Multivalued: false,
 }
@@ -173,11 +263,11 @@ var AttrDepartment = &Attribute{
 	Name:        "Department",
 	DisplayName: "Department",
 	Validations: Validation{
-		&ValidationLength{Min: 1, Max: 255},
+		Length: &ValidationLength{Min: 1, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
-		Edit: []string{AttributePermissionAdmin, AttributePermissionUser},
+		Edit: []string{AttributePermissionAdmin},
 	},
 	Multivalued: false,
 }
@@ -186,11 +276,11 @@ var AttrDisplayName = &Attribute{
 	Name:        "DisplayName",
 	DisplayName: "DisplayName",
 	Validations: Validation{
-		&ValidationLength{Min: 1, Max: 255},
+		Length: &ValidationLength{Min: 1, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
-		Edit: []string{AttributePermissionAdmin, AttributePermissionUser},
+		Edit: []string{AttributePermissionAdmin},
 	},
 	Multivalued: false,
 }
@@ -199,7 +289,7 @@ var AttrMobilePhone = &Attribute{
 	Name:        "MobilePhone",
 	DisplayName: "MobilePhone",
 	Validations: Validation{
-		&ValidationLength{Min: 1, Max: 255},
+		Length: &ValidationLength{Min: 1, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
@@ -212,7 +302,7 @@ var AttrOfficePhone = &Attribute{
 	Name:        "OfficePhone",
 	DisplayName: "OfficePhone",
 	Validations: Validation{
-		&ValidationLength{Min: 1, Max: 255},
+		Length: &ValidationLength{Min: 1, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
@@ -225,11 +315,11 @@ var AttrOrganization = &Attribute{
 	Name:        "Organization",
 	DisplayName: "Organization",
 	Validations: Validation{
-		&ValidationLength{Min: 1, Max: 255},
+		Length: &ValidationLength{Min: 1, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
-		Edit: []string{AttributePermissionAdmin, AttributePermissionUser},
+		Edit: []string{AttributePermissionAdmin},
 	},
 	Multivalued: false,
 }
@@ -238,11 +328,11 @@ var AttrJobTitle = &Attribute{
 	Name:        "JobTitle",
 	DisplayName: "JobTitle",
 	Validations: Validation{
-		&ValidationLength{Min: 1, Max: 255},
+		Length: &ValidationLength{Min: 1, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
-		Edit: []string{AttributePermissionAdmin, AttributePermissionUser},
+		Edit: []string{AttributePermissionAdmin},
 	},
 	Multivalued: false,
 }
@@ -251,11 +341,11 @@ var AttrProgramRole = &Attribute{
 	Name:        "ProgramRole",
 	DisplayName: "ProgramRole",
 	Validations: Validation{
-		&ValidationLength{Min: 1, Max: 255},
+		Length: &ValidationLength{Min: 1, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
-		Edit: []string{AttributePermissionAdmin, AttributePermissionUser},
+		Edit: []string{AttributePermissionAdmin},
 	},
 	Multivalued: false,
 }
@@ -264,11 +354,11 @@ var AttrProject = &Attribute{
 	Name:        "Project",
 	DisplayName: "Project",
 	Validations: Validation{
-		&ValidationLength{Min: 1, Max: 255},
+		Length: &ValidationLength{Min: 1, Max: 255},
 	},
 	Permissions: Permissions{
 		View: []string{AttributePermissionAdmin, AttributePermissionUser},
-		Edit: []string{AttributePermissionAdmin, AttributePermissionUser},
+		Edit: []string{AttributePermissionAdmin},
 	},
 	Multivalued: false,
 }